@@ -40,11 +40,14 @@ func (a *App) StartStream() ClientCreated {
 		}
 	}
 
-	a.streamer = core.NewStreamer()
+	//The streamer is kept across stops, starting it again reconnects with the same identity
+	if a.streamer == nil {
+		a.streamer = core.NewStreamer()
 
-	a.streamer.EventHandler.Subscribe(func(data interface{}) {
-		runtime.EventsEmit(a.ctx, "UpdateEvent", data)
-	})
+		a.streamer.Events.Subscribe(func(event core.Event) {
+			runtime.EventsEmit(a.ctx, string(event.Type()), event)
+		})
+	}
 
 	err := a.streamer.Start()
 
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+
+	"github.com/MutsiMutsi/go-novon/core"
+)
+
+func runCommand(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	configPath := fs.String("config", "./config.json", "path to the go-novon config file")
+	mtxConfigPath := fs.String("mediamtx", "", "path to the MediaMTX config file (default mediamtx.yml)")
+	rtmpAddress := fs.String("rtmp", "", "RTMP listen address, overrides the MediaMTX config (e.g. :1935)")
+	logLevel := fs.String("log-level", "info", "log level: debug, info, warn or error")
+	statePath := fs.String("state", defaultStatePath, "path of the state file read by status and stop")
+	relayOrigin := fs.String("relay", "", "republish the stream of this origin host address instead of ingesting RTMP")
+	fs.Parse(args)
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return fmt.Errorf("invalid log level %q", *logLevel)
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	slog.SetDefault(logger)
+
+	if st, err := readState(*statePath); err == nil && st.isAlive() {
+		return fmt.Errorf("a host is already running with pid %d", st.PID)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	state := newStateWriter(*statePath)
+	defer state.remove()
+	go state.run(ctx)
+
+	prepare := func(s *core.Streamer) {
+		channel := channelName(s)
+		channelLogger := logger.With("channel", channel)
+		s.Events.Subscribe(func(event core.Event) {
+			logEvent(channelLogger, event)
+			state.event(channel, event)
+		})
+	}
+
+	//A relay is a single streamer fed by its origin, a host runs every configured channel
+	var start func() error
+	var stopHost func()
+	var streamers func() []*core.Streamer
+	if *relayOrigin != "" {
+		relay := core.NewStreamer(core.WithConfigPath(*configPath), core.WithRelay(*relayOrigin))
+		prepare(relay)
+		start, stopHost = relay.Start, relay.Stop
+		streamers = func() []*core.Streamer { return []*core.Streamer{relay} }
+	} else {
+		host := core.NewHost(
+			core.WithConfigPath(*configPath),
+			core.WithMediaMTXConfigPath(*mtxConfigPath),
+			core.WithRtmpAddress(*rtmpAddress),
+		)
+		host.Prepare = prepare
+		start, stopHost, streamers = host.Start, host.Stop, host.Streamers
+	}
+
+	if err := start(); err != nil {
+		stopHost()
+		return err
+	}
+
+	for _, s := range streamers() {
+		state.identity(channelName(s), s.ClientAddress(), s.ClientWalletAddress())
+		logger.Info("channel running", "channel", channelName(s), "address", s.ClientAddress(), "wallet", s.ClientWalletAddress())
+	}
+
+	<-ctx.Done()
+	logger.Info("shutting down")
+	stopHost()
+
+	return nil
+}
+
+// channelName labels a streamer in logs and state, a streamer without path accepts any path
+func channelName(s *core.Streamer) string {
+	if s.Path() == "" {
+		return "default"
+	}
+	return s.Path()
+}
+
+// logEvent prints a streamer event as a single structured log line, publish events are only shown on debug level.
+func logEvent(logger *slog.Logger, event core.Event) {
+	//The json representation is what the frontend sees, log the same fields
+	var fields map[string]any
+	bin, _ := json.Marshal(event)
+	json.Unmarshal(bin, &fields)
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	attrs := make([]any, 0, len(keys)*2+2)
+	attrs = append(attrs, "type", string(event.Type()))
+	for _, k := range keys {
+		attrs = append(attrs, k, fields[k])
+	}
+
+	level := slog.LevelInfo
+	if event.Type() == core.EventPublish {
+		level = slog.LevelDebug
+	}
+	logger.Log(context.Background(), level, "event", attrs...)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/MutsiMutsi/go-novon/core"
+)
+
+const defaultStatePath = "./novon.state.json"
+
+// A running host writes its state every stateHeartbeat, even without events, and at most once every
+// stateWriteInterval. A state file that was not written for staleStateAfter belongs to a host that is gone.
+const (
+	stateWriteInterval = time.Second
+	stateHeartbeat     = 3 * time.Second
+	staleStateAfter    = 15 * time.Second
+)
+
+// hostState is what a running host shares with the status and stop commands.
+type hostState struct {
+	PID       int                      `json:"pid"`
+	StartedAt time.Time                `json:"startedAt"`
+	UpdatedAt time.Time                `json:"updatedAt"`
+	Channels  map[string]*channelState `json:"channels"`
+}
+
+type channelState struct {
+	Address string         `json:"address,omitempty"`
+	Wallet  string         `json:"wallet,omitempty"`
+	Events  map[string]any `json:"events"`
+}
+
+func (st *hostState) isAlive() bool {
+	return time.Since(st.UpdatedAt) < staleStateAfter
+}
+
+func readState(path string) (*hostState, error) {
+	bin, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var st hostState
+	if err := json.Unmarshal(bin, &st); err != nil {
+		return nil, fmt.Errorf("error parsing state file: %w", err)
+	}
+	return &st, nil
+}
+
+// stateWriter keeps the state file of this process up to date. Changes are written by run, so a burst of events
+// is written once.
+type stateWriter struct {
+	mu        sync.Mutex
+	path      string
+	state     hostState
+	dirty     bool
+	removed   bool
+	interval  time.Duration
+	heartbeat time.Duration
+}
+
+func newStateWriter(path string) *stateWriter {
+	w := &stateWriter{
+		path: path,
+		state: hostState{
+			PID:       os.Getpid(),
+			StartedAt: time.Now(),
+			Channels:  make(map[string]*channelState),
+		},
+		interval:  stateWriteInterval,
+		heartbeat: stateHeartbeat,
+	}
+	w.mu.Lock()
+	w.flush()
+	w.mu.Unlock()
+	return w
+}
+
+// run writes changes every interval and the heartbeat when nothing changed, until the context is done.
+func (w *stateWriter) run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			if w.dirty || time.Since(w.state.UpdatedAt) >= w.heartbeat {
+				w.flush()
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+func (w *stateWriter) identity(channel, address, wallet string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ch := w.channel(channel)
+	ch.Address = address
+	ch.Wallet = wallet
+	w.dirty = true
+}
+
+// event records the last event of every event type.
+func (w *stateWriter) event(channel string, event core.Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.channel(channel).Events[string(event.Type())] = event
+	w.dirty = true
+}
+
+// channel returns the state of a channel, must be called with the lock held.
+func (w *stateWriter) channel(name string) *channelState {
+	ch, ok := w.state.Channels[name]
+	if !ok {
+		ch = &channelState{Events: make(map[string]any)}
+		w.state.Channels[name] = ch
+	}
+	return ch
+}
+
+// remove deletes the state file, it is not written again afterwards.
+func (w *stateWriter) remove() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.removed = true
+	os.Remove(w.path)
+}
+
+// flush writes the state atomically so readers never see a partial file, must be called with the lock held.
+func (w *stateWriter) flush() {
+	if w.removed {
+		return
+	}
+	w.dirty = false
+	w.state.UpdatedAt = time.Now()
+	bin, err := json.MarshalIndent(w.state, "", "  ")
+	if err != nil {
+		return
+	}
+
+	tmp := w.path + ".tmp"
+	if err := os.WriteFile(tmp, bin, 0644); err != nil {
+		return
+	}
+	os.Rename(tmp, w.path)
+}
+
+func statusCommand(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	statePath := fs.String("state", defaultStatePath, "path of the state file written by run")
+	fs.Parse(args)
+
+	st, err := readState(*statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.New("not running")
+	}
+	if err != nil {
+		return err
+	}
+	if !st.isAlive() {
+		return fmt.Errorf("not running, state of pid %d was last updated %s", st.PID, st.UpdatedAt.Format(time.RFC3339))
+	}
+
+	bin, _ := json.MarshalIndent(st, "", "  ")
+	fmt.Println(string(bin))
+	return nil
+}
+
+func stopCommand(args []string) error {
+	fs := flag.NewFlagSet("stop", flag.ExitOnError)
+	statePath := fs.String("state", defaultStatePath, "path of the state file written by run")
+	timeout := fs.Duration("timeout", 30*time.Second, "how long to wait for the host to shut down")
+	fs.Parse(args)
+
+	st, err := readState(*statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.New("not running")
+	}
+	if err != nil {
+		return err
+	}
+	//A stale state file may name a pid that now belongs to another process
+	if !st.isAlive() {
+		return fmt.Errorf("not running, state of pid %d was last updated %s", st.PID, st.UpdatedAt.Format(time.RFC3339))
+	}
+
+	process, err := os.FindProcess(st.PID)
+	if err != nil {
+		return err
+	}
+
+	//Interrupt is not supported on every platform, fall back to killing the process
+	if err := process.Signal(os.Interrupt); err != nil {
+		if err := process.Kill(); err != nil {
+			return fmt.Errorf("error signalling pid %d: %w", st.PID, err)
+		}
+		//A killed host cannot remove its own state file
+		os.Remove(*statePath)
+		fmt.Println("stopped")
+		return nil
+	}
+
+	deadline := time.Now().Add(*timeout)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(*statePath); errors.Is(err, os.ErrNotExist) {
+			fmt.Println("stopped")
+			return nil
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+
+	return fmt.Errorf("pid %d did not stop within %s", st.PID, *timeout)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MutsiMutsi/go-novon/core"
+)
+
+// waitForState polls the state file until the condition holds or fails the test
+func waitForState(t *testing.T, path string, what string, condition func(st *hostState, err error) bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		st, err := readState(path)
+		if condition(st, err) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStateWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "novon.state.json")
+	w := newStateWriter(path)
+	w.interval, w.heartbeat = 20*time.Millisecond, 100*time.Millisecond
+
+	st, err := readState(path)
+	if err != nil || st.PID != os.Getpid() || !st.isAlive() {
+		t.Fatalf("state = %+v, %v, want this process alive", st, err)
+	}
+
+	//Events are written together on the next tick, not one by one
+	for i := 0; i < 10; i++ {
+		w.event("default", core.StreamStateEvent{State: core.StateLive})
+	}
+	w.identity("default", "address", "wallet")
+	if st, _ := readState(path); len(st.Channels) != 0 {
+		t.Fatal("state written for every event")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.run(ctx)
+	waitForState(t, path, "the events", func(st *hostState, err error) bool {
+		return err == nil && st.Channels["default"] != nil && st.Channels["default"].Address == "address"
+	})
+	var events map[string]json.RawMessage
+	st, _ = readState(path)
+	bin, _ := json.Marshal(st.Channels["default"].Events)
+	if json.Unmarshal(bin, &events) != nil || len(events) != 1 {
+		t.Fatalf("events = %s, want the last stream state", bin)
+	}
+
+	//Without events the heartbeat keeps the state alive
+	updated := st.UpdatedAt
+	waitForState(t, path, "the heartbeat", func(st *hostState, err error) bool {
+		return err == nil && st.UpdatedAt.After(updated)
+	})
+
+	//Once removed the state is not written again
+	w.remove()
+	w.event("default", core.StreamStateEvent{State: core.StateIdle})
+	time.Sleep(5 * w.interval)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("state file written after it was removed: %v", err)
+	}
+}
+
+func TestStaleState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "novon.state.json")
+	args := []string{"-state", path}
+
+	for name, command := range map[string]func([]string) error{"status": statusCommand, "stop": stopCommand} {
+		if err := command(args); err == nil || err.Error() != "not running" {
+			t.Fatalf("%s without state = %v, want not running", name, err)
+		}
+	}
+
+	//A state that was not written for a while belongs to a host that is gone, its pid may be reused
+	bin, _ := json.Marshal(hostState{PID: os.Getpid(), UpdatedAt: time.Now().Add(-2 * staleStateAfter)})
+	if err := os.WriteFile(path, bin, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for name, command := range map[string]func([]string) error{"status": statusCommand, "stop": stopCommand} {
+		if err := command(args); err == nil || !strings.HasPrefix(err.Error(), "not running") {
+			t.Fatalf("%s with a stale state = %v, want not running", name, err)
+		}
+	}
+}
+
+// TestHelperHost is the host stopped by TestRunningState, it only runs as a subprocess
+func TestHelperHost(t *testing.T) {
+	path := os.Getenv("NOVON_TEST_STATE")
+	if path == "" {
+		t.Skip("subprocess of TestRunningState")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	state := newStateWriter(path)
+	go state.run(ctx)
+	<-ctx.Done()
+	state.remove()
+}
+
+func TestRunningState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "novon.state.json")
+	args := []string{"-state", path}
+
+	host := exec.Command(os.Args[0], "-test.run=^TestHelperHost$")
+	host.Env = append(os.Environ(), "NOVON_TEST_STATE="+path)
+	if err := host.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		host.Process.Kill()
+		host.Wait()
+	})
+	waitForState(t, path, "the host to start", func(st *hostState, err error) bool { return err == nil })
+
+	if err := statusCommand(args); err != nil {
+		t.Fatalf("status = %v", err)
+	}
+	if err := runCommand(args); err == nil || !strings.Contains(err.Error(), "already running") {
+		t.Fatalf("run while a host is running = %v", err)
+	}
+
+	if err := stopCommand(append(args, "-timeout", "5s")); err != nil {
+		t.Fatalf("stop = %v", err)
+	}
+	if err := host.Wait(); err != nil {
+		t.Fatalf("host exited with %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("state file left after stop: %v", err)
+	}
+}
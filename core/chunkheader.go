@@ -0,0 +1,433 @@
+package core
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"log"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// Chunk header versions, viewers receive the version that comes with the control protocol version they speak
+const (
+	// ChunkHeaderLegacy is 12 bytes: segment id, chunk id and total chunks as little endian uint32
+	ChunkHeaderLegacy = 0
+	// ChunkHeaderV2 is the extended header described by ChunkHeader
+	ChunkHeaderV2 = 2
+)
+
+// Size of the fixed part of a v2 chunk header, HeaderLength may be larger when later versions append fields
+const chunkHeaderV2Size = 40
+
+// HeaderLength is a single byte, so no header including its extensions is larger than this
+const maxChunkHeaderSize = 255
+
+// Chunk flags
+const (
+	// ChunkFlagKeyframe marks segments that start with a keyframe
+	ChunkFlagKeyframe = 1 << 0
+	// ChunkFlagDiscontinuity marks the first segment of a new ingest, timestamps do not continue from the previous segment
+	ChunkFlagDiscontinuity = 1 << 1
+	// ChunkFlagParity marks Reed-Solomon parity chunks, their chunk id counts on after the data chunks
+	ChunkFlagParity = 1 << 2
+	// ChunkFlagEncrypted marks segments of a private stream, encrypted with the content key of the key id extension
+	ChunkFlagEncrypted = 1 << 3
+)
+
+// Header extensions follow the fixed header as type, length and value, HeaderLength includes them
+const (
+	// chunkExtensionFEC holds the number of parity chunks as uint16 and the shard size as uint32
+	chunkExtensionFEC = 1
+	// chunkExtensionSignature holds the SHA-256 hash of the segment and the host signature, see VerifySegment
+	chunkExtensionSignature = 2
+	// chunkExtensionKeyId holds the id of the content key as uint32, see DecryptSegment
+	chunkExtensionKeyId = 3
+)
+
+var (
+	ErrChunkTooShort       = errors.New("chunk too short")
+	ErrChunkMissing        = errors.New("not enough chunks to rebuild the segment")
+	ErrChunkMismatch       = errors.New("chunks belong to different segments")
+	ErrChunkHeaderVersion  = errors.New("unsupported chunk header version")
+	ErrChunkChecksum       = errors.New("chunk checksum mismatch")
+	ErrChunkTooManyChunks  = errors.New("segment has too many chunks")
+	ErrChunkSize           = errors.New("chunk size must be positive")
+	errChunkHeaderTooShort = errors.New("chunk header length too short")
+)
+
+// ChunkHeader precedes every chunk of a segment, all fields are little endian:
+//
+//	0  version        uint8
+//	1  flags          uint8
+//	2  quality level  uint8, 0 is the source quality
+//	3  header length  uint8, offset of the payload
+//	4  segment id     uint32
+//	8  chunk id       uint16
+//	10 total chunks   uint16
+//	12 duration       uint32, segment duration in milliseconds
+//	16 pts            int64, presentation timestamp of the segment in 90kHz units
+//	24 wallclock      int64, unix milliseconds when the host ingested the segment
+//	32 checksum       uint32, CRC-32 (IEEE) of the chunk payload
+//	36 segment size   uint32, size of the whole segment in bytes
+//	40 extensions     type uint8, length uint8 and value, up to the header length
+//
+// Segments protected by forward error correction carry the FEC extension on every chunk: the number of parity
+// chunks (uint16) and the shard size (uint32). Parity chunks have ChunkFlagParity set and chunk ids from
+// TotalChunks on, data chunks are zero padded to the shard size to rebuild a segment with ReassembleSegment.
+//
+// Segments of a host signing its stream carry the signature extension on every chunk: the SHA-256 hash of the
+// segment followed by the ed25519 signature of the host, checked with VerifySegment.
+//
+// Segments of a private stream have ChunkFlagEncrypted set and carry the key id extension with the id of the content
+// key the segment was encrypted with. The segment size, hash and chunks are those of the encrypted segment.
+type ChunkHeader struct {
+	Version      uint8
+	Flags        uint8
+	Quality      uint8
+	HeaderLength uint8
+	SegmentId    uint32
+	ChunkId      uint16
+	TotalChunks  uint16
+	DurationMs   uint32
+	PTS          int64
+	Wallclock    int64
+	Checksum     uint32
+	SegmentSize  uint32
+
+	// FEC extension, zero when the segment has no parity chunks
+	ParityChunks uint16
+	ShardSize    uint32
+
+	// Signature extension, Signature is nil when the segment is not signed
+	SegmentHash [32]byte
+	Signature   []byte
+
+	// Key id extension of encrypted segments
+	KeyId uint32
+}
+
+func (h *ChunkHeader) IsKeyframe() bool {
+	return h.Flags&ChunkFlagKeyframe != 0
+}
+
+func (h *ChunkHeader) IsDiscontinuity() bool {
+	return h.Flags&ChunkFlagDiscontinuity != 0
+}
+
+func (h *ChunkHeader) IsParity() bool {
+	return h.Flags&ChunkFlagParity != 0
+}
+
+func (h *ChunkHeader) IsEncrypted() bool {
+	return h.Flags&ChunkFlagEncrypted != 0
+}
+
+// Length is the encoded size of the header including extensions
+func (h *ChunkHeader) Length() int {
+	length := chunkHeaderV2Size
+	if h.ParityChunks > 0 {
+		length += 2 + 6
+	}
+	if h.Signature != nil {
+		length += 2 + sha256.Size + ed25519.SignatureSize
+	}
+	if h.IsEncrypted() {
+		length += 2 + 4
+	}
+	return length
+}
+
+// AppendHeader appends the v2 encoding of the header to b
+func (h *ChunkHeader) AppendHeader(b []byte) []byte {
+	b = append(b, ChunkHeaderV2, h.Flags, h.Quality, uint8(h.Length()))
+	b = binary.LittleEndian.AppendUint32(b, h.SegmentId)
+	b = binary.LittleEndian.AppendUint16(b, h.ChunkId)
+	b = binary.LittleEndian.AppendUint16(b, h.TotalChunks)
+	b = binary.LittleEndian.AppendUint32(b, h.DurationMs)
+	b = binary.LittleEndian.AppendUint64(b, uint64(h.PTS))
+	b = binary.LittleEndian.AppendUint64(b, uint64(h.Wallclock))
+	b = binary.LittleEndian.AppendUint32(b, h.Checksum)
+	b = binary.LittleEndian.AppendUint32(b, h.SegmentSize)
+
+	if h.ParityChunks > 0 {
+		b = append(b, chunkExtensionFEC, 6)
+		b = binary.LittleEndian.AppendUint16(b, h.ParityChunks)
+		b = binary.LittleEndian.AppendUint32(b, h.ShardSize)
+	}
+	if h.Signature != nil {
+		b = append(b, chunkExtensionSignature, sha256.Size+ed25519.SignatureSize)
+		b = append(b, h.SegmentHash[:]...)
+		b = append(b, h.Signature...)
+	}
+	if h.IsEncrypted() {
+		b = append(b, chunkExtensionKeyId, 4)
+		b = binary.LittleEndian.AppendUint32(b, h.KeyId)
+	}
+	return b
+}
+
+// ParseChunkHeader splits a v2 chunk into its header and payload and verifies the payload checksum
+func ParseChunkHeader(chunk []byte) (ChunkHeader, []byte, error) {
+	if len(chunk) < chunkHeaderV2Size {
+		return ChunkHeader{}, nil, ErrChunkTooShort
+	}
+	if chunk[0] != ChunkHeaderV2 {
+		return ChunkHeader{}, nil, ErrChunkHeaderVersion
+	}
+
+	h := ChunkHeader{
+		Version:      chunk[0],
+		Flags:        chunk[1],
+		Quality:      chunk[2],
+		HeaderLength: chunk[3],
+		SegmentId:    binary.LittleEndian.Uint32(chunk[4:]),
+		ChunkId:      binary.LittleEndian.Uint16(chunk[8:]),
+		TotalChunks:  binary.LittleEndian.Uint16(chunk[10:]),
+		DurationMs:   binary.LittleEndian.Uint32(chunk[12:]),
+		PTS:          int64(binary.LittleEndian.Uint64(chunk[16:])),
+		Wallclock:    int64(binary.LittleEndian.Uint64(chunk[24:])),
+		Checksum:     binary.LittleEndian.Uint32(chunk[32:]),
+		SegmentSize:  binary.LittleEndian.Uint32(chunk[36:]),
+	}
+
+	if int(h.HeaderLength) < chunkHeaderV2Size {
+		return ChunkHeader{}, nil, errChunkHeaderTooShort
+	}
+	if len(chunk) < int(h.HeaderLength) {
+		return ChunkHeader{}, nil, ErrChunkTooShort
+	}
+
+	//Unknown extensions are skipped, they are meant for newer viewers
+	extensions := chunk[chunkHeaderV2Size:h.HeaderLength]
+	for len(extensions) >= 2 {
+		typ, length := extensions[0], int(extensions[1])
+		if len(extensions) < 2+length {
+			return ChunkHeader{}, nil, ErrChunkTooShort
+		}
+		value := extensions[2 : 2+length]
+
+		if typ == chunkExtensionFEC && length >= 6 {
+			h.ParityChunks = binary.LittleEndian.Uint16(value)
+			h.ShardSize = binary.LittleEndian.Uint32(value[2:])
+		}
+		if typ == chunkExtensionSignature && length >= sha256.Size+ed25519.SignatureSize {
+			copy(h.SegmentHash[:], value)
+			h.Signature = bytes.Clone(value[sha256.Size : sha256.Size+ed25519.SignatureSize])
+		}
+		if typ == chunkExtensionKeyId && length >= 4 {
+			h.KeyId = binary.LittleEndian.Uint32(value)
+		}
+		extensions = extensions[2+length:]
+	}
+
+	payload := chunk[h.HeaderLength:]
+	if crc32.ChecksumIEEE(payload) != h.Checksum {
+		return ChunkHeader{}, nil, ErrChunkChecksum
+	}
+	return h, payload, nil
+}
+
+// segmentMeta is what every chunk header of a segment has in common
+type segmentMeta struct {
+	id        int
+	quality   int
+	timing    segmentTiming
+	wallclock int64
+	flags     uint8
+	fec       *FECConfig
+
+	//Segments are signed when the key is set
+	signingKey ed25519.PrivateKey
+	//Id of the content key when the segment is encrypted
+	keyId uint32
+}
+
+// chunkSegmentV2 splits a segment in chunks of at most chunkSize bytes, each prefixed with a v2 header,
+// followed by parity chunks when forward error correction is configured
+func chunkSegmentV2(data []byte, chunkSize int, meta segmentMeta) ([][]byte, error) {
+	if chunkSize <= 0 {
+		return nil, ErrChunkSize
+	}
+
+	totalChunks := max((len(data)+chunkSize-1)/chunkSize, 1)
+	if totalChunks > 0xFFFF {
+		return nil, ErrChunkTooManyChunks
+	}
+
+	flags := meta.flags
+	if meta.timing.keyframe {
+		flags |= ChunkFlagKeyframe
+	}
+
+	header := ChunkHeader{
+		Flags:       flags,
+		Quality:     uint8(meta.quality),
+		SegmentId:   uint32(meta.id),
+		TotalChunks: uint16(totalChunks),
+		DurationMs:  uint32(meta.timing.duration.Milliseconds()),
+		PTS:         meta.timing.pts,
+		Wallclock:   meta.wallclock,
+		SegmentSize: uint32(len(data)),
+		KeyId:       meta.keyId,
+	}
+
+	if meta.signingKey != nil {
+		header.SegmentHash, header.Signature = signSegment(meta.signingKey, &header, data)
+	}
+
+	return writeChunks(data, chunkSize, header, meta.fec.parityChunks(totalChunks)), nil
+}
+
+// rechunkSegment chunks a segment again with the header and chunk size it was received with, the chunks are byte for
+// byte those the origin sent, including its signature and the parity chunks
+func rechunkSegment(data []byte, header ChunkHeader, chunkSize int) ([][]byte, error) {
+	if header.ShardSize > 0 {
+		chunkSize = int(header.ShardSize)
+	}
+	if len(data) != int(header.SegmentSize) || chunkSize <= 0 {
+		return nil, ErrChunkMismatch
+	}
+
+	header.Flags &^= ChunkFlagParity
+	return writeChunks(data, chunkSize, header, int(header.ParityChunks)), nil
+}
+
+// writeChunks splits the segment in TotalChunks chunks prefixed with the header followed by the parity chunks.
+// With parity the segment is split in shards of equal size instead of chunkSize, so parity chunks of a short segment
+// are as short as its data chunks. The shard size follows from the segment size and TotalChunks alone.
+func writeChunks(data []byte, chunkSize int, header ChunkHeader, parityChunks int) [][]byte {
+	totalChunks := int(header.TotalChunks)
+	header.ParityChunks, header.ShardSize = 0, 0
+
+	var parity [][]byte
+	if parityChunks > 0 {
+		shardSize := max((len(data)+totalChunks-1)/totalChunks, 1)
+
+		var err error
+		if totalChunks+parityChunks > 256 {
+			log.Printf("WARNING: segment of %v chunks too large for forward error correction, sending without parity\n", totalChunks)
+		} else if parity, err = parityShards(data, shardSize, totalChunks, parityChunks); err != nil {
+			log.Println("Error creating parity chunks:", err)
+		} else {
+			//Every chunk carries the FEC extension, so a viewer can rebuild the segment from any of them
+			header.ParityChunks = uint16(parityChunks)
+			header.ShardSize = uint32(shardSize)
+			chunkSize = shardSize
+		}
+	}
+
+	chunks := make([][]byte, 0, totalChunks+len(parity))
+	appendChunk := func(payload []byte) {
+		header.Checksum = crc32.ChecksumIEEE(payload)
+
+		chunk := make([]byte, 0, header.Length()+len(payload))
+		chunk = header.AppendHeader(chunk)
+		chunks = append(chunks, append(chunk, payload...))
+	}
+
+	buffer := bytes.NewBuffer(data)
+	for chunkId := 0; chunkId < totalChunks; chunkId++ {
+		header.ChunkId = uint16(chunkId)
+		appendChunk(buffer.Next(chunkSize))
+	}
+
+	header.Flags |= ChunkFlagParity
+	for i, payload := range parity {
+		header.ChunkId = uint16(totalChunks + i)
+		appendChunk(payload)
+	}
+
+	return chunks
+}
+
+// parityShards encodes the Reed-Solomon parity of data split in dataShards shards of shardSize bytes, zero padded
+func parityShards(data []byte, shardSize int, dataShards int, parityShards int) ([][]byte, error) {
+	enc, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	shards := make([][]byte, dataShards+parityShards)
+	for i := range shards {
+		shards[i] = make([]byte, shardSize)
+		if i < dataShards && i*shardSize < len(data) {
+			copy(shards[i], data[i*shardSize:])
+		}
+	}
+
+	if err := enc.Encode(shards); err != nil {
+		return nil, err
+	}
+	return shards[dataShards:], nil
+}
+
+// ReassembleSegment rebuilds a segment from its v2 chunks in any order. Chunks that fail to parse are ignored,
+// with forward error correction any TotalChunks of the data and parity chunks are enough.
+func ReassembleSegment(chunks [][]byte) ([]byte, error) {
+	var first *ChunkHeader
+	var payloads [][]byte
+
+	for _, chunk := range chunks {
+		h, payload, err := ParseChunkHeader(chunk)
+		if err != nil {
+			continue
+		}
+
+		if first == nil {
+			first = &h
+			payloads = make([][]byte, int(h.TotalChunks)+int(h.ParityChunks))
+		} else if h.SegmentId != first.SegmentId || h.Quality != first.Quality {
+			return nil, ErrChunkMismatch
+		}
+
+		if int(h.ChunkId) < len(payloads) {
+			payloads[h.ChunkId] = payload
+		}
+	}
+	if first == nil {
+		return nil, ErrChunkMissing
+	}
+
+	dataChunks := int(first.TotalChunks)
+	complete := true
+	for _, payload := range payloads[:dataChunks] {
+		complete = complete && payload != nil
+	}
+
+	if !complete {
+		if first.ParityChunks == 0 {
+			return nil, ErrChunkMissing
+		}
+
+		//Shards must all have the shard size, the last data chunk is shorter
+		shardSize := int(first.ShardSize)
+		for i, payload := range payloads {
+			if payload != nil && len(payload) < shardSize {
+				padded := make([]byte, shardSize)
+				copy(padded, payload)
+				payloads[i] = padded
+			}
+		}
+
+		enc, err := reedsolomon.New(dataChunks, int(first.ParityChunks))
+		if err != nil {
+			return nil, err
+		}
+		if err := enc.ReconstructData(payloads); err != nil {
+			return nil, ErrChunkMissing
+		}
+	}
+
+	segment := make([]byte, 0, first.SegmentSize)
+	for _, payload := range payloads[:dataChunks] {
+		segment = append(segment, payload...)
+	}
+	if len(segment) < int(first.SegmentSize) {
+		return nil, ErrChunkMissing
+	}
+	return segment[:first.SegmentSize], nil
+}
@@ -0,0 +1,171 @@
+package core
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestChunkSegmentV2ParitySize(t *testing.T) {
+	fec := &FECConfig{DataChunks: 4, ParityChunks: 1}
+
+	for _, size := range []int{1, 100, 4096, CHUNK_SIZE, 3*CHUNK_SIZE + 17} {
+		segment := make([]byte, size)
+		rand.Read(segment)
+
+		chunks, err := chunkSegmentV2(segment, CHUNK_SIZE, segmentMeta{id: 1, fec: fec})
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+
+		//Every chunk carries at most one shard, a shard is at most the segment split over the data chunks
+		h, _, err := ParseChunkHeader(chunks[0])
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		dataChunks, parityChunks := int(h.TotalChunks), int(h.ParityChunks)
+		if parityChunks == 0 || len(chunks) != dataChunks+parityChunks {
+			t.Fatalf("%d bytes: %d chunks, %d data and %d parity", size, len(chunks), dataChunks, parityChunks)
+		}
+		if want := (size + dataChunks - 1) / dataChunks; int(h.ShardSize) != want {
+			t.Fatalf("%d bytes: shard size %d, want %d", size, h.ShardSize, want)
+		}
+
+		wire := 0
+		for _, chunk := range chunks {
+			wire += len(chunk)
+		}
+		maxWire := size + parityChunks*int(h.ShardSize) + len(chunks)*h.Length()
+		if wire > maxWire {
+			t.Fatalf("%d bytes: %d bytes on the wire, want at most %d", size, wire, maxWire)
+		}
+
+		//Any data chunk can be lost
+		for lost := 0; lost < dataChunks; lost++ {
+			received := append(append([][]byte{}, chunks[:lost]...), chunks[lost+1:]...)
+			reassembled, err := ReassembleSegment(received)
+			if err != nil {
+				t.Fatalf("%d bytes without chunk %d: %v", size, lost, err)
+			}
+			if !bytes.Equal(reassembled, segment) {
+				t.Fatalf("%d bytes without chunk %d: reassembled segment differs", size, lost)
+			}
+		}
+	}
+}
+
+// testChunk encodes the header followed by the payload, with the checksum of the payload
+func testChunk(h ChunkHeader, payload []byte) []byte {
+	h.Checksum = crc32.ChecksumIEEE(payload)
+	return append(h.AppendHeader(nil), payload...)
+}
+
+func TestChunkHeaderRoundTrip(t *testing.T) {
+	signature := make([]byte, ed25519.SignatureSize)
+	rand.Read(signature)
+	full := ChunkHeader{
+		Flags:        ChunkFlagKeyframe | ChunkFlagDiscontinuity | ChunkFlagParity | ChunkFlagEncrypted,
+		Quality:      2,
+		SegmentId:    0xDEADBEEF,
+		ChunkId:      7,
+		TotalChunks:  5,
+		DurationMs:   2000,
+		PTS:          -90000,
+		Wallclock:    1700000000000,
+		SegmentSize:  123456,
+		ParityChunks: 2,
+		ShardSize:    24692,
+		SegmentHash:  sha256.Sum256([]byte("segment")),
+		Signature:    signature,
+		KeyId:        42,
+	}
+
+	tests := []struct {
+		name   string
+		header ChunkHeader
+	}{
+		{"no extensions", ChunkHeader{Flags: ChunkFlagKeyframe, SegmentId: 1, TotalChunks: 1, SegmentSize: 100}},
+		{"fec", ChunkHeader{Flags: ChunkFlagParity, TotalChunks: 4, ChunkId: 4, ParityChunks: 1, ShardSize: 25}},
+		{"signature", ChunkHeader{TotalChunks: 1, SegmentHash: full.SegmentHash, Signature: signature}},
+		{"key id", ChunkHeader{Flags: ChunkFlagEncrypted, TotalChunks: 1, KeyId: 3}},
+		{"every flag and extension", full},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := []byte("payload")
+			chunk := testChunk(tt.header, payload)
+
+			h, parsed, err := ParseChunkHeader(chunk)
+			if err != nil {
+				t.Fatalf("ParseChunkHeader: %v", err)
+			}
+			want := tt.header
+			want.Version, want.HeaderLength, want.Checksum = ChunkHeaderV2, uint8(want.Length()), crc32.ChecksumIEEE(payload)
+			if !reflect.DeepEqual(h, want) {
+				t.Fatalf("parsed %+v, want %+v", h, want)
+			}
+			if !bytes.Equal(parsed, payload) {
+				t.Fatalf("payload %q, want %q", parsed, payload)
+			}
+		})
+	}
+
+	//Unknown extensions of newer hosts are skipped
+	chunk := full.AppendHeader(nil)
+	chunk = append(chunk, 9, 3, 1, 2, 3)
+	chunk[3] += 5
+	binary.LittleEndian.PutUint32(chunk[32:], crc32.ChecksumIEEE([]byte("payload")))
+	h, payload, err := ParseChunkHeader(append(chunk, "payload"...))
+	if err != nil || h.KeyId != full.KeyId || h.ShardSize != full.ShardSize || string(payload) != "payload" {
+		t.Fatalf("header with an unknown extension = %+v, %q, %v", h, payload, err)
+	}
+}
+
+func TestChunkHeaderRejected(t *testing.T) {
+	header := ChunkHeader{Flags: ChunkFlagParity | ChunkFlagEncrypted, TotalChunks: 2, ParityChunks: 1, ShardSize: 7, KeyId: 1}
+	chunk := testChunk(header, []byte("payload"))
+
+	//Every cut into the header, including its extensions, is too short
+	for length := 0; length < header.Length(); length++ {
+		if _, _, err := ParseChunkHeader(chunk[:length]); !errors.Is(err, ErrChunkTooShort) {
+			t.Fatalf("header cut at %d bytes: %v, want %v", length, err, ErrChunkTooShort)
+		}
+	}
+
+	modified := func(modify func(chunk []byte)) []byte {
+		c := bytes.Clone(chunk)
+		modify(c)
+		return c
+	}
+	tests := []struct {
+		name  string
+		chunk []byte
+		want  error
+	}{
+		{"header length below the fixed header", modified(func(c []byte) { c[3] = chunkHeaderV2Size - 1 }), errChunkHeaderTooShort},
+		{"extension beyond the header", modified(func(c []byte) { c[chunkHeaderV2Size+1] = 100 }), ErrChunkTooShort},
+		{"other version", modified(func(c []byte) { c[0] = ChunkHeaderLegacy }), ErrChunkHeaderVersion},
+		{"corrupt payload", modified(func(c []byte) { c[len(c)-1] ^= 1 }), ErrChunkChecksum},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := ParseChunkHeader(tt.chunk); !errors.Is(err, tt.want) {
+				t.Fatalf("ParseChunkHeader = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestChunkSegmentV2ChunkSize(t *testing.T) {
+	for _, chunkSize := range []int{0, -1} {
+		if _, err := chunkSegmentV2([]byte("segment"), chunkSize, segmentMeta{}); !errors.Is(err, ErrChunkSize) {
+			t.Fatalf("chunk size %d: %v, want %v", chunkSize, err, ErrChunkSize)
+		}
+	}
+}
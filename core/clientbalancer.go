@@ -1,158 +1,319 @@
 package core
 
 import (
-	"fmt"
+	"errors"
 	"log"
-	"strconv"
-
-	"github.com/golang/protobuf/proto"
-	"github.com/nknorg/nkn-sdk-go"
-	"github.com/nknorg/nkn-sdk-go/payloads"
-	"github.com/nknorg/nkngomobile"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var clientSendIndex = 0
+// SubClientStats describes the health of a single sub client
+type SubClientStats struct {
+	Index     int  `json:"index"`
+	Connected bool `json:"connected"`
+	//Healthy sub clients are connected and not backing off after errors
+	Healthy    bool    `json:"healthy"`
+	Sends      uint64  `json:"sends"`
+	Errors     uint64  `json:"errors"`
+	LatencyMs  float64 `json:"latencyMs"`
+	Reconnects int     `json:"reconnects"`
+}
+
+// subClientHealth tracks the sends of a sub client, latency is a moving average of the send duration
+type subClientHealth struct {
+	sends             uint64
+	errors            uint64
+	consecutiveErrors int
+	latency           time.Duration
+	backoffUntil      time.Time
+	reconnects        int
+}
+
+// clientBalancer spreads sends over the healthy sub clients of the transport. Sub clients that keep failing back off
+// and are reconnected, among healthy ones the faster sub client of the next two in turn is used.
+// Closed sub clients are skipped, NKN can not reopen them so they stay skipped for good.
+type clientBalancer struct {
+	transport Transport
+	cursor    atomic.Uint64
 
-func (s *Streamer) getNextClient() *nkn.Client {
-	clientId := clientSendIndex % NUM_SUB_CLIENTS
-	client := s.nknClient.GetClient(clientId)
-	clientSendIndex++
+	mu     sync.Mutex
+	health []subClientHealth
+}
 
-	if client == nil {
-		client = s.getNextClient()
+func newClientBalancer(transport Transport) *clientBalancer {
+	return &clientBalancer{
+		transport: transport,
+		health:    make([]subClientHealth, transport.NumSubClients()),
 	}
+}
 
-	return client
+// healthy reports whether a sub client can be used, the lock must be held
+func (b *clientBalancer) healthy(i int, now time.Time) bool {
+	return now.After(b.health[i].backoffUntil) && !b.transport.SubClientClosed(i)
 }
 
-func (s *Streamer) publish(data []byte) {
-	//Foreach chunk generate a message id and predefine the payload to reuse
-	msgId, _ := nkn.RandomBytes(nkn.MessageIDSize)
-	msgPayload := &payloads.Payload{
-		Type:      payloads.PayloadType_BINARY,
-		NoReply:   true,
-		MessageId: msgId,
-		Data:      data,
+// score ranks healthy sub clients, lower is better, the lock must be held
+func (b *clientBalancer) score(i int) time.Duration {
+	return b.health[i].latency * time.Duration(1+b.health[i].consecutiveErrors)
+}
+
+// next picks the sub client for the next send, it fails when every sub client is closed
+func (b *clientBalancer) next() (int, bool) {
+	n := len(b.health)
+	start := int(b.cursor.Add(1) % uint64(n))
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	best, candidates, fallback := -1, 0, -1
+	for j := 0; j < n && candidates < 2; j++ {
+		i := (start + j) % n
+		if !b.healthy(i, now) {
+			if fallback == -1 && !b.transport.SubClientClosed(i) {
+				fallback = i
+			}
+			continue
+		}
+		candidates++
+		if best == -1 || b.score(i) < b.score(best) {
+			best = i
+		}
 	}
 
-	//Send VIEWER_SUB_CLIENTS times everytime with the next subclient in queue
-	for i := 0; i < VIEWER_SUB_CLIENTS; i++ {
-		go s.getNextClient().SendPayload(viewerSubClientAddresses[i], msgPayload, segmentSendConfig)
+	//Sub clients backing off still beat dropping the message
+	if best == -1 {
+		best = fallback
 	}
+	return best, best != -1
 }
 
-func (s *Streamer) publishQualityLevels(qualityData ...[][]byte) {
-	qualityLevels := len(qualityData)
-	qualityAddrStrings := make([][]string, qualityLevels)
-	qualityNknAddrStrings := make([][]*nkngomobile.StringArray, qualityLevels)
+// record updates the health of a sub client after a send, repeated errors back it off and reconnect it
+func (b *clientBalancer) record(i int, latency time.Duration, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-	// Build address slices
-	for i := range qualityData {
-		qualityNknAddrStrings[i] = make([]*nkngomobile.StringArray, VIEWER_SUB_CLIENTS)
+	h := &b.health[i]
+	h.sends++
+	if err == nil {
+		h.consecutiveErrors = 0
+		if h.latency == 0 {
+			h.latency = latency
+		} else {
+			h.latency = (h.latency*7 + latency) / 8
+		}
+		return
 	}
 
-	// Build viewer lists for each quality
-	for k := range s.viewers.messages {
-		qualityLevel := min(s.viewers.viewerQuality[k], qualityLevels)
-		qualityAddrStrings[qualityLevel] = append(qualityAddrStrings[qualityLevel], k)
+	h.errors++
+	h.consecutiveErrors++
+	if h.consecutiveErrors >= SUB_CLIENT_MAX_ERRORS && time.Now().After(h.backoffUntil) {
+		log.Println("sub client", i, "failing, reconnecting:", err)
+		h.backoffUntil = time.Now().Add(SUB_CLIENT_BACKOFF)
+		b.reconnect(i)
 	}
+}
 
-	// Convert to multiclient recipient nkn addreses
-	for q := 0; q < qualityLevels; q++ {
-		// Preprocess addresses for this quality level (similar to original code)
-		for j := 0; j < VIEWER_SUB_CLIENTS; j++ {
-			prefixedAddresses := make([]string, len(qualityAddrStrings[q]))
-			for k, viewer := range qualityAddrStrings[q] {
-				prefixedAddresses[k] = "__" + strconv.Itoa(j) + "__." + viewer
-			}
-			qualityNknAddrStrings[q][j] = nkn.NewStringArray(prefixedAddresses...)
+// checkHealth tries to reopen closed sub clients and gives sub clients whose back off ended a new chance
+func (b *clientBalancer) checkHealth() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	for i := range b.health {
+		h := &b.health[i]
+		if now.Before(h.backoffUntil) {
+			continue
 		}
+		if b.transport.SubClientClosed(i) {
+			h.backoffUntil = now.Add(SUB_CLIENT_BACKOFF)
+			b.reconnect(i)
+		} else if h.consecutiveErrors >= SUB_CLIENT_MAX_ERRORS {
+			h.consecutiveErrors = 0
+		}
+	}
+}
+
+// reconnect asks the transport to reconnect a sub client and counts it when it does, the lock must be held
+func (b *clientBalancer) reconnect(i int) {
+	err := b.transport.Reconnect(i)
+	if err == nil {
+		b.health[i].reconnects++
+	} else if !errors.Is(err, ErrSubClientUnavailable) {
+		log.Println("error reconnecting sub client", i, err)
 	}
+}
+
+func (b *clientBalancer) stats() []SubClientStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	stats := make([]SubClientStats, len(b.health))
+	for i, h := range b.health {
+		stats[i] = SubClientStats{
+			Index:      i,
+			Connected:  !b.transport.SubClientClosed(i),
+			Healthy:    b.healthy(i, now),
+			Sends:      h.sends,
+			Errors:     h.errors,
+			LatencyMs:  float64(h.latency.Microseconds()) / 1000,
+			Reconnects: h.reconnects,
+		}
+	}
+	return stats
+}
+
+// SubClientStats reports the health of every sub client
+func (s *Streamer) SubClientStats() []SubClientStats {
+	return s.balancer.stats()
+}
+
+// send sends the payload with the best of the next sub clients in queue, trying others when a send fails
+func (s *Streamer) send(to Recipients, payload *Payload) {
+	for attempt := 0; attempt < s.transport.NumSubClients(); attempt++ {
+		i, ok := s.balancer.next()
+		if !ok {
+			return
+		}
+
+		start := time.Now()
+		err := s.transport.Send(i, to, payload)
+		s.balancer.record(i, time.Since(start), err)
+		if err == nil || errors.Is(err, ErrTransportClosed) {
+			return
+		}
+	}
+}
+
+func (s *Streamer) publish(data []byte) {
+	//Foreach chunk generate a message id and predefine the payload to reuse
+	msgPayload := newPayload(PayloadBinary, data)
+
+	//Send once for every viewer subclient, everytime with the next subclient in queue
+	for _, recipients := range s.viewers.SubClientRecipients() {
+		s.dispatch(priorityMessage, recipients, msgPayload)
+	}
+}
+
+// qualityLevelSends lists the sends of every quality level to the viewers that receive the chunk header version and quality
+func (s *Streamer) qualityLevelSends(chunkHeader int, qualityData ...[][]byte) []pacedSend {
+	qualityLevels := len(qualityData)
+	qualityRecipients := s.qualityRecipients(qualityLevels, chunkHeader)
 
 	// Send the chunks to each quality level
+	var sends []pacedSend
 	for q := 0; q < qualityLevels; q++ {
-		for _, v := range qualityData[q] {
-			msgId, _ := nkn.RandomBytes(nkn.MessageIDSize)
-			msgPayload := &payloads.Payload{
-				Type:      payloads.PayloadType_BINARY,
-				NoReply:   true,
-				MessageId: msgId,
-				Data:      v,
-			}
+		for i, v := range qualityData[q] {
+			msgPayload := newPayload(PayloadBinary, v)
 
-			for i := 0; i < VIEWER_SUB_CLIENTS; i++ {
-				go s.getNextClient().SendPayload(qualityNknAddrStrings[q][i], msgPayload, segmentSendConfig)
+			for _, recipients := range qualityRecipients[q] {
+				sends = append(sends, pacedSend{index: i, priority: videoPriority(q, qualityLevels), to: recipients, payload: msgPayload})
 			}
 		}
 	}
+	return sends
 }
 
-func (s *Streamer) publishText(text string) {
-	//Foreach chunk generate a message id and predefine the payload to reuse
-	msgId, _ := nkn.RandomBytes(nkn.MessageIDSize)
+// recipientsKey identifies the recipients of the quality levels of a chunk header version
+type recipientsKey struct {
+	chunkHeader   int
+	qualityLevels int
+}
 
-	data, err := proto.Marshal(&payloads.TextData{Text: text})
-	if err != nil {
-		fmt.Println(err.Error())
+// cachedRecipients are the recipients of every quality level as of a version of the viewers
+type cachedRecipients struct {
+	version    uint64
+	recipients [][]Recipients
+}
+
+// qualityRecipients returns the recipients for every quality level, they are only rebuilt when the viewers or the
+// mesh assignments changed since the previous segment
+func (s *Streamer) qualityRecipients(qualityLevels int, chunkHeader int) [][]Recipients {
+	version := s.viewers.Version()
+	mesh := chunkHeader == ChunkHeaderV2 && s.mesh != nil
+
+	s.recipientsMu.Lock()
+	defer s.recipientsMu.Unlock()
+
+	key := recipientsKey{chunkHeader: chunkHeader, qualityLevels: qualityLevels}
+	if cached, ok := s.recipients[key]; ok && cached.version == version && !(mesh && s.mesh.pending()) {
+		return cached.recipients
 	}
 
-	msgPayload := &payloads.Payload{
-		Type:      payloads.PayloadType_TEXT,
-		NoReply:   true,
-		MessageId: msgId,
-		Data:      data,
+	// Build viewer lists for each quality
+	qualityAddrStrings := s.viewers.QualityGroups(qualityLevels, chunkHeader)
+	if mesh {
+		qualityAddrStrings = s.meshRoute(qualityAddrStrings)
 	}
 
-	//Send VIEWER_SUB_CLIENTS times everytime with the next subclient in queue
-	for i := 0; i < VIEWER_SUB_CLIENTS; i++ {
-		go s.getNextClient().SendPayload(viewerSubClientAddresses[i], msgPayload, segmentSendConfig)
+	// Convert to recipients for every viewer subclient
+	qualityRecipients := make([][]Recipients, qualityLevels)
+	for q := 0; q < qualityLevels; q++ {
+		qualityRecipients[q] = s.viewers.ChunkRecipients(qualityAddrStrings[q]...)
 	}
+
+	s.recipients[key] = cachedRecipients{version: version, recipients: qualityRecipients}
+	return qualityRecipients
 }
 
-func (s *Streamer) sendToClient(address string, data []byte) {
-	msgId, _ := nkn.RandomBytes(nkn.MessageIDSize)
-	msgPayload := &payloads.Payload{
-		Type:      payloads.PayloadType_BINARY,
-		NoReply:   true,
-		MessageId: msgId,
-		Data:      data,
-	}
+func (s *Streamer) publishText(text string) {
+	//Foreach chunk generate a message id and predefine the payload to reuse
+	msgPayload := newPayload(PayloadText, []byte(text))
 
-	for i := 0; i < VIEWER_SUB_CLIENTS; i++ {
-		go s.getNextClient().SendPayload(nkn.NewStringArray("__"+strconv.Itoa(i)+"__."+address), msgPayload, &nkn.MessageConfig{
-			Unencrypted:       true,
-			NoReply:           true,
-			MaxHoldingSeconds: 0,
-		})
+	//Send once for every viewer subclient, everytime with the next subclient in queue
+	for _, recipients := range s.viewers.SubClientRecipients() {
+		s.dispatch(priorityMessage, recipients, msgPayload)
 	}
 }
 
-func (s *Streamer) reply(data []byte, msg *nkn.Message) {
-	payload, err := nkn.NewReplyPayload(data, msg.MessageID)
-	if err != nil {
-		log.Println(err)
+// publishTextTo sends a text message to the viewers that receive the chunk header version
+func (s *Streamer) publishTextTo(chunkHeader int, text string) {
+	addresses := s.viewers.QualityGroups(1, chunkHeader)[0]
+	if len(addresses) == 0 {
+		return
 	}
+	msgPayload := newPayload(PayloadText, []byte(text))
 
-	for i := 0; i < VIEWER_SUB_CLIENTS; i++ {
-		go s.getNextClient().SendPayload(nkn.NewStringArray("__"+strconv.Itoa(i)+"__."+msg.Src), payload, &nkn.MessageConfig{
-			Unencrypted:       true,
-			NoReply:           true,
-			MaxHoldingSeconds: 0,
-		})
+	for _, recipients := range s.viewers.Recipients(addresses...) {
+		s.dispatch(priorityMessage, recipients, msgPayload)
 	}
 }
 
-func (s *Streamer) replyText(text string, msg *nkn.Message) {
-	payload, err := nkn.NewReplyPayload(text, msg.MessageID)
-	if err != nil {
-		log.Println(err)
-	}
+func (s *Streamer) sendToClient(address string, data []byte) {
+	s.sendTo(priorityMessage, address, newPayload(PayloadBinary, data))
+}
+
+// sendToClientEncrypted sends a text message encrypted end-to-end, for secrets such as content keys
+func (s *Streamer) sendToClientEncrypted(address string, text string) {
+	msgPayload := newPayload(PayloadText, []byte(text))
+	msgPayload.Encrypted = true
+	s.sendTo(priorityMessage, address, msgPayload)
+}
+
+func (s *Streamer) reply(data []byte, msg *InboundMessage) {
+	s.sendTo(priorityReply, msg.Src, newReplyPayload(PayloadBinary, data, msg.MessageID))
+}
+
+func (s *Streamer) replyText(text string, msg *InboundMessage) {
+	s.sendReply(newReplyPayload(PayloadText, []byte(text), msg.MessageID), msg)
+}
+
+// replyTextEncrypted replies encrypted end-to-end, for secrets such as content keys
+func (s *Streamer) replyTextEncrypted(text string, msg *InboundMessage) {
+	payload := newReplyPayload(PayloadText, []byte(text), msg.MessageID)
+	payload.Encrypted = true
+	s.sendReply(payload, msg)
+}
+
+func (s *Streamer) sendReply(payload *Payload, msg *InboundMessage) {
+	s.sendTo(priorityReply, msg.Src, payload)
+}
 
-	for i := 0; i < VIEWER_SUB_CLIENTS; i++ {
-		go s.getNextClient().SendPayload(nkn.NewStringArray("__"+strconv.Itoa(i)+"__."+msg.Src), payload, &nkn.MessageConfig{
-			Unencrypted:       true,
-			NoReply:           true,
-			MaxHoldingSeconds: 0,
-		})
+// sendTo sends the payload to every subclient of a single client, with the subclients it negotiated
+func (s *Streamer) sendTo(priority egressPriority, address string, payload *Payload) {
+	for _, recipients := range s.viewers.Recipients(address) {
+		s.dispatch(priority, recipients, payload)
 	}
 }
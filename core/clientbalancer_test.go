@@ -0,0 +1,91 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// pick returns the sub clients the balancer picks for the sends
+func pick(t *testing.T, b *clientBalancer, sends int) map[int]int {
+	t.Helper()
+
+	picked := make(map[int]int)
+	for i := 0; i < sends; i++ {
+		subClient, ok := b.next()
+		if !ok {
+			t.Fatal("no sub client picked")
+		}
+		picked[subClient]++
+	}
+	return picked
+}
+
+func TestClientBalancerPrefersFaster(t *testing.T) {
+	b := newClientBalancer(NewMemoryNetwork().Join("host", 4))
+	for i, latency := range []time.Duration{10, 1, 10, 1} {
+		b.record(i, latency*time.Millisecond, nil)
+	}
+
+	//Of the next two sub clients in turn the faster one is used
+	picked := pick(t, b, 40)
+	if picked[0] != 0 || picked[2] != 0 || picked[1] != 20 || picked[3] != 20 {
+		t.Fatalf("picked %v, want only the fast sub clients 1 and 3", picked)
+	}
+}
+
+func TestClientBalancerBacksOff(t *testing.T) {
+	transport := NewMemoryNetwork().Join("host", 4)
+	b := newClientBalancer(transport)
+	sendErr := errors.New("send failed")
+
+	//A single error does not back off
+	b.record(1, time.Millisecond, sendErr)
+	if !b.stats()[1].Healthy {
+		t.Fatal("sub client backing off after a single error")
+	}
+	for i := 1; i < SUB_CLIENT_MAX_ERRORS; i++ {
+		b.record(1, time.Millisecond, sendErr)
+	}
+	stats := b.stats()[1]
+	if stats.Healthy || stats.Errors != SUB_CLIENT_MAX_ERRORS || stats.Reconnects != 1 {
+		t.Fatalf("stats = %+v, want the failing sub client reconnected and backing off", stats)
+	}
+
+	transport.CloseSubClient(2)
+	if picked := pick(t, b, 40); picked[1] != 0 || picked[2] != 0 {
+		t.Fatalf("picked %v, want the failing and closed sub clients skipped", picked)
+	}
+
+	//Closed sub clients are reopened, sub clients whose back off ended get a new chance
+	b.health[1].backoffUntil = time.Now().Add(-time.Second)
+	b.checkHealth()
+	if transport.SubClientClosed(2) || b.stats()[2].Reconnects != 1 {
+		t.Fatalf("stats = %+v, want the closed sub client reconnected", b.stats()[2])
+	}
+	if !b.stats()[1].Healthy || b.health[1].consecutiveErrors != 0 {
+		t.Fatalf("stats = %+v, want the sub client healthy again", b.stats()[1])
+	}
+}
+
+func TestClientBalancerFallback(t *testing.T) {
+	transport := NewMemoryNetwork().Join("host", 2)
+	b := newClientBalancer(transport)
+
+	//Sub clients backing off are used when there is nothing else
+	for i := 0; i < 2; i++ {
+		b.health[i].backoffUntil = time.Now().Add(time.Minute)
+	}
+	if picked := pick(t, b, 4); len(picked) == 0 {
+		t.Fatal("no sub client picked while all are backing off")
+	}
+
+	transport.CloseSubClient(0)
+	if picked := pick(t, b, 4); picked[0] != 0 {
+		t.Fatalf("picked %v, want the closed sub client skipped", picked)
+	}
+	transport.CloseSubClient(1)
+	if subClient, ok := b.next(); ok {
+		t.Fatalf("picked sub client %d, all are closed", subClient)
+	}
+}
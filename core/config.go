@@ -9,21 +9,80 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/nknorg/nkn-sdk-go"
 )
 
-// Config represents the configuration data
+// Config represents the configuration data, the top level channel is used when no channels are configured
 type Config struct {
-	Seed        string   `json:"seed"`
-	Title       string   `json:"title"`
-	Owner       string   `json:"owner"`
-	Transcoders []string `json:transcoders`
+	ChannelConfig
+	Channels []ChannelConfig `json:"channels,omitempty"`
+}
+
+// ChannelConfig is a single stream with its own NKN identity, fed by the RTMP path it is keyed by
+type ChannelConfig struct {
+	Path        string         `json:"path,omitempty"`
+	Seed        string         `json:"seed"`
+	Title       string         `json:"title"`
+	Owner       string         `json:"owner"`
+	Transcoders []string       `json:"transcoders"`
+	Panels      string         `json:"panels,omitempty"`
+	FEC         *FECConfig     `json:"fec,omitempty"`
+	Private     *PrivateConfig `json:"private,omitempty"`
+	Mesh        *MeshConfig    `json:"mesh,omitempty"`
+	Network     *NetworkConfig `json:"network,omitempty"`
+	//Client addresses or public keys of the relays that may republish this channel
+	Relays []string `json:"relays,omitempty"`
+	//Viewers beyond this number are redirected to a relay, 0 never redirects
+	MaxViewers int `json:"maxViewers,omitempty"`
+}
+
+// NetworkConfig sets up the NKN multiclient of the host and how viewers are reached, fields not set use the defaults
+type NetworkConfig struct {
+	//Sub clients of the host, 96 if not set
+	SubClients int `json:"subClients,omitempty"`
+	//Sub clients of a viewer every message is sent to, unless the viewer tells otherwise in its ping, 3 if not set.
+	//Viewers with a single client instead of a multiclient have 0.
+	ViewerSubClients *int `json:"viewerSubClients,omitempty"`
+	//Maximum segment bytes in a chunk, 64000 if not set
+	ChunkSize int `json:"chunkSize,omitempty"`
+	//Upload budget in kilobits per second, 0 does not limit the upload
+	UploadKbps int `json:"uploadKbps,omitempty"`
+	//Fraction of the segment duration the chunk sends of a segment are spread over, 0 sends them at once
+	Pacing float64 `json:"pacing,omitempty"`
+}
+
+// MeshConfig lets viewers that opted in forward chunks to other viewers of the same quality level
+type MeshConfig struct {
+	//Viewers a single forwarder serves at most, 4 if not set
+	FanOut int `json:"fanOut,omitempty"`
+	//Viewers needed before the host assigns forwarders
+	MinViewers int `json:"minViewers,omitempty"`
+}
+
+// PrivateConfig makes a stream private: segments are encrypted and only the owner, allowlisted viewers and viewers
+// that were granted access or paid for it receive the content key
+type PrivateConfig struct {
+	//Client addresses or public keys of viewers that can always watch
+	Allowlist []string `json:"allowlist"`
+	//Viewers donating at least this many NKN in a chat message are granted access, 0 disables paid access
+	Price int `json:"price,omitempty"`
+	//Seconds a content key is used before it is replaced, 300 if not set
+	KeyRotation int `json:"keyRotation,omitempty"`
+}
+
+// FECConfig adds ParityChunks Reed-Solomon parity chunks for every DataChunks chunks of a segment, rounded up
+type FECConfig struct {
+	DataChunks   int `json:"dataChunks"`
+	ParityChunks int `json:"parityChunks"`
 }
 
 type Transcode struct {
 	Resolution int
 	Framerate  int
+	//Video codec of the transcoded segments
+	Codec string
 }
 
 // NewConfig reads the configuration file from a specified location and populates defaults
@@ -41,7 +100,7 @@ func NewConfig(configFile string) (*Config, error) {
 			newWallet, _ := nkn.NewAccount(nil)
 			seedStr := hex.EncodeToString(newWallet.Seed())
 			// Create a default configuration
-			defaultConfig := &Config{Seed: seedStr, Title: "Unnamed Stream"}
+			defaultConfig := &Config{ChannelConfig: ChannelConfig{Seed: seedStr, Title: "Unnamed Stream"}}
 			data, err := json.MarshalIndent(defaultConfig, "", "  ")
 			if err != nil {
 				return nil, err
@@ -69,15 +128,221 @@ func NewConfig(configFile string) (*Config, error) {
 		return nil, err
 	}
 
-	// Set defaults for missing fields
+	cfg.inherit()
+
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// inherit sets defaults for missing fields, channels take the fields they leave out from the top level
+func (cfg *Config) inherit() {
 	if cfg.Title == "" {
 		cfg.Title = "Unnamed Stream"
 	}
 
-	return &cfg, nil
+	for i := range cfg.Channels {
+		ch := &cfg.Channels[i]
+		if ch.Title == "" {
+			ch.Title = cfg.Title
+		}
+		if ch.Owner == "" {
+			ch.Owner = cfg.Owner
+		}
+		if ch.Transcoders == nil {
+			ch.Transcoders = cfg.Transcoders
+		}
+		if ch.FEC == nil {
+			ch.FEC = cfg.FEC
+		}
+		if ch.Private == nil {
+			ch.Private = cfg.Private
+		}
+		if ch.Mesh == nil {
+			ch.Mesh = cfg.Mesh
+		}
+		if ch.Network == nil {
+			ch.Network = cfg.Network
+		}
+		if ch.Relays == nil {
+			ch.Relays = cfg.Relays
+		}
+		if ch.MaxViewers == 0 {
+			ch.MaxViewers = cfg.MaxViewers
+		}
+		if ch.Panels == "" {
+			ch.Panels = "panels." + sanitizeFileName(ch.Path) + ".json"
+		}
+	}
+}
+
+// validSeed reports whether the seed is 32 hex encoded bytes
+func validSeed(seed string) bool {
+	_, err := hex.DecodeString(seed)
+	return err == nil && len(seed) == 64
+}
+
+// Validate checks that every channel has its own path and identity
+func (cfg *Config) Validate() error {
+	paths := make(map[string]bool)
+	seeds := make(map[string]bool)
+
+	//The top level seed is the identity of the stream without channels, with channels it is not used
+	if (len(cfg.Channels) == 0 || cfg.Seed != "") && !validSeed(cfg.Seed) {
+		return errors.New("seed must be 32 hex encoded bytes")
+	}
+	if cfg.MaxViewers < 0 {
+		return errors.New("maxViewers can not be negative")
+	}
+
+	if err := cfg.FEC.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Private.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Network.validate(); err != nil {
+		return err
+	}
+
+	for i, ch := range cfg.Channels {
+		if ch.Path == "" {
+			return fmt.Errorf("channel %d: path is required", i)
+		}
+		if err := ch.FEC.validate(); err != nil {
+			return fmt.Errorf("channel %q: %w", ch.Path, err)
+		}
+		if err := ch.Private.validate(); err != nil {
+			return fmt.Errorf("channel %q: %w", ch.Path, err)
+		}
+		if err := ch.Network.validate(); err != nil {
+			return fmt.Errorf("channel %q: %w", ch.Path, err)
+		}
+		if strings.ContainsAny(ch.Path, " \t\n\"") || strings.HasPrefix(ch.Path, "~") {
+			return fmt.Errorf("channel %d: invalid path %q", i, ch.Path)
+		}
+		if paths[ch.Path] {
+			return fmt.Errorf("channel %d: duplicate path %q", i, ch.Path)
+		}
+		paths[ch.Path] = true
+
+		if !validSeed(ch.Seed) {
+			return fmt.Errorf("channel %q: seed must be 32 hex encoded bytes", ch.Path)
+		}
+		if ch.MaxViewers < 0 {
+			return fmt.Errorf("channel %q: maxViewers can not be negative", ch.Path)
+		}
+		if seeds[ch.Seed] {
+			return fmt.Errorf("channel %q: seed is already used by another channel", ch.Path)
+		}
+		seeds[ch.Seed] = true
+	}
+
+	return nil
+}
+
+func (fec *FECConfig) validate() error {
+	if fec == nil {
+		return nil
+	}
+	if fec.DataChunks <= 0 || fec.ParityChunks <= 0 {
+		return errors.New("fec: dataChunks and parityChunks must be positive")
+	}
+	return nil
+}
+
+func (private *PrivateConfig) validate() error {
+	if private == nil {
+		return nil
+	}
+	if private.Price < 0 || private.KeyRotation < 0 {
+		return errors.New("private: price and keyRotation can not be negative")
+	}
+	return nil
+}
+
+func (network *NetworkConfig) validate() error {
+	if network == nil {
+		return nil
+	}
+	if network.SubClients < 0 || network.SubClients > MAX_SUB_CLIENTS {
+		return fmt.Errorf("network: subClients must be between 0 (default) and %d", MAX_SUB_CLIENTS)
+	}
+	if v := network.ViewerSubClients; v != nil && (*v < 0 || *v > MAX_VIEWER_SUB_CLIENTS) {
+		return fmt.Errorf("network: viewerSubClients must be between 0 and %d", MAX_VIEWER_SUB_CLIENTS)
+	}
+	if network.ChunkSize != 0 && (network.ChunkSize < MIN_CHUNK_SIZE || network.ChunkSize > MAX_CHUNK_SIZE) {
+		return fmt.Errorf("network: chunkSize must be between %d and %d", MIN_CHUNK_SIZE, MAX_CHUNK_SIZE)
+	}
+	if network.UploadKbps < 0 {
+		return errors.New("network: uploadKbps can not be negative")
+	}
+	if network.Pacing < 0 || network.Pacing > 1 {
+		return errors.New("network: pacing must be between 0 and 1")
+	}
+	return nil
+}
+
+// withDefaults fills in the defaults for the fields that are not set
+func (network *NetworkConfig) withDefaults() NetworkConfig {
+	resolved := NetworkConfig{}
+	if network != nil {
+		resolved = *network
+	}
+	if resolved.SubClients == 0 {
+		resolved.SubClients = NUM_SUB_CLIENTS
+	}
+	if resolved.ViewerSubClients == nil {
+		viewerSubClients := VIEWER_SUB_CLIENTS
+		resolved.ViewerSubClients = &viewerSubClients
+	}
+	if resolved.ChunkSize == 0 {
+		resolved.ChunkSize = CHUNK_SIZE
+	}
+	return resolved
+}
+
+// keyLifetime is the time a content key is used before it is replaced
+func (private *PrivateConfig) keyLifetime() time.Duration {
+	if private.KeyRotation == 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(private.KeyRotation) * time.Second
+}
+
+// parityChunks is the number of parity chunks for a segment of dataChunks chunks, 0 when FEC is disabled
+func (fec *FECConfig) parityChunks(dataChunks int) int {
+	if fec == nil {
+		return 0
+	}
+	return (dataChunks*fec.ParityChunks + fec.DataChunks - 1) / fec.DataChunks
+}
+
+// ChannelConfigs returns the configured channels, or the top level channel if there are none
+func (cfg *Config) ChannelConfigs() []ChannelConfig {
+	if len(cfg.Channels) == 0 {
+		ch := cfg.ChannelConfig
+		if ch.Panels == "" {
+			ch.Panels = "panels.json"
+		}
+		return []ChannelConfig{ch}
+	}
+	return cfg.Channels
+}
+
+func sanitizeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
 }
 
-func (s *Streamer) getTranscoders(config *Config) []Transcode {
+func (s *Streamer) getTranscoders(config *ChannelConfig, sourceResolution int, sourceFramerate int) []Transcode {
 	var transcoders = make([]Transcode, 0)
 
 	for _, v := range config.Transcoders {
@@ -88,8 +353,8 @@ func (s *Streamer) getTranscoders(config *Config) []Transcode {
 			continue
 		}
 
-		if s.sourceResolution <= resolution {
-			fmt.Println("Skipping transcode value in config:", v, "stream source is smaller:", s.sourceResolution)
+		if sourceResolution <= resolution {
+			fmt.Println("Skipping transcode value in config:", v, "stream source is smaller:", sourceResolution)
 			continue
 		}
 
@@ -102,12 +367,12 @@ func (s *Streamer) getTranscoders(config *Config) []Transcode {
 			}
 		}
 
-		if framerate > s.sourceFramerate {
-			framerate = s.sourceFramerate
-			fmt.Println("Lowering transcode framerate value in config:", v, "stream source framerate:", s.sourceFramerate)
+		if framerate > sourceFramerate {
+			framerate = sourceFramerate
+			fmt.Println("Lowering transcode framerate value in config:", v, "stream source framerate:", sourceFramerate)
 		}
 
-		if s.sourceResolution == resolution && framerate == s.sourceFramerate {
+		if sourceResolution == resolution && framerate == sourceFramerate {
 			fmt.Println("Skipping transcode value in config:", v, "stream source resolution and framerate are equal")
 			continue
 		}
@@ -115,6 +380,7 @@ func (s *Streamer) getTranscoders(config *Config) []Transcode {
 		transcoders = append(transcoders, Transcode{
 			Resolution: resolution,
 			Framerate:  framerate,
+			Codec:      s.transcoder.Codec(),
 		})
 	}
 
@@ -0,0 +1,94 @@
+package core
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	const otherSeed = "2222222222222222222222222222222222222222222222222222222222222222"
+	channel := func(path string, seed string) ChannelConfig {
+		return ChannelConfig{Path: path, Seed: seed}
+	}
+
+	tests := []struct {
+		name   string
+		config Config
+		want   string
+	}{
+		{"single channel", Config{ChannelConfig: ChannelConfig{Seed: testSeed}}, ""},
+		{"channels", Config{Channels: []ChannelConfig{channel("a", testSeed), channel("b", otherSeed)}}, ""},
+		{"missing seed", Config{}, "seed must be"},
+		{"short seed", Config{ChannelConfig: ChannelConfig{Seed: testSeed[2:]}}, "seed must be"},
+		{"seed not hex", Config{ChannelConfig: ChannelConfig{Seed: strings.Repeat("z", 64)}}, "seed must be"},
+		{"invalid unused top level seed", Config{ChannelConfig: ChannelConfig{Seed: "seed"}, Channels: []ChannelConfig{channel("a", testSeed)}}, "seed must be"},
+		{"missing path", Config{Channels: []ChannelConfig{channel("", testSeed)}}, "path is required"},
+		{"invalid path", Config{Channels: []ChannelConfig{channel("a b", testSeed)}}, "invalid path"},
+		{"duplicate path", Config{Channels: []ChannelConfig{channel("a", testSeed), channel("a", otherSeed)}}, "duplicate path"},
+		{"channel seed", Config{Channels: []ChannelConfig{channel("a", "")}}, `channel "a": seed must be`},
+		{"shared seed", Config{Channels: []ChannelConfig{channel("a", testSeed), channel("b", testSeed)}}, "already used"},
+		{"negative max viewers", Config{ChannelConfig: ChannelConfig{Seed: testSeed, MaxViewers: -1}}, "maxViewers"},
+		{"fec", Config{ChannelConfig: ChannelConfig{Seed: testSeed, FEC: &FECConfig{DataChunks: 4}}}, "fec"},
+		{"private", Config{ChannelConfig: ChannelConfig{Seed: testSeed, Private: &PrivateConfig{Price: -1}}}, "private"},
+		{"network", Config{ChannelConfig: ChannelConfig{Seed: testSeed, Network: &NetworkConfig{Pacing: 2}}}, "pacing"},
+		{"channel network", Config{Channels: []ChannelConfig{{Path: "a", Seed: testSeed, Network: &NetworkConfig{ChunkSize: 1}}}}, `channel "a": network`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if tt.want == "" && err != nil {
+				t.Fatalf("Validate = %v, want valid", err)
+			}
+			if tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+				t.Fatalf("Validate = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigInherit(t *testing.T) {
+	network := &NetworkConfig{SubClients: 8}
+	cfg := Config{
+		ChannelConfig: ChannelConfig{
+			Owner:       "owner",
+			Transcoders: []string{"720p30"},
+			FEC:         &FECConfig{DataChunks: 4, ParityChunks: 1},
+			Network:     network,
+			Relays:      []string{"relay"},
+			MaxViewers:  100,
+		},
+		Channels: []ChannelConfig{
+			{Path: "inherits", Seed: testSeed},
+			{Path: "own/channel", Seed: testSeed, Title: "Own", Owner: "other", Transcoders: []string{}, Relays: []string{}, MaxViewers: 5, Panels: "panels.json"},
+		},
+	}
+	cfg.inherit()
+
+	inherits, own := cfg.Channels[0], cfg.Channels[1]
+	if cfg.Title != "Unnamed Stream" || inherits.Title != cfg.Title || inherits.Owner != "owner" {
+		t.Fatalf("title %q and owner %q, want those of the top level", inherits.Title, inherits.Owner)
+	}
+	if !slices.Equal(inherits.Transcoders, cfg.Transcoders) || inherits.FEC != cfg.FEC || inherits.Network != network {
+		t.Fatalf("channel = %+v, want the transcoders, fec and network of the top level", inherits)
+	}
+	if !slices.Equal(inherits.Relays, cfg.Relays) || inherits.MaxViewers != 100 {
+		t.Fatalf("relays %v and max viewers %d, want those of the top level", inherits.Relays, inherits.MaxViewers)
+	}
+	if inherits.Panels != "panels.inherits.json" {
+		t.Fatalf("panels = %q", inherits.Panels)
+	}
+
+	//Fields a channel sets are kept, an empty list disables what the top level enables
+	if own.Title != "Own" || own.Owner != "other" || len(own.Transcoders) != 0 || len(own.Relays) != 0 || own.MaxViewers != 5 {
+		t.Fatalf("channel = %+v, want its own fields kept", own)
+	}
+	if own.Panels != "panels.json" {
+		t.Fatalf("panels = %q", own.Panels)
+	}
+	cfg.Channels[1].Panels = ""
+	cfg.inherit()
+	if cfg.Channels[1].Panels != "panels.own_channel.json" {
+		t.Fatalf("panels = %q, want the sanitized path", cfg.Channels[1].Panels)
+	}
+}
@@ -0,0 +1,62 @@
+package core
+
+import "log"
+
+// deliveryStats is the moving average of the share of chunks a viewer lost or received too late to play
+type deliveryStats struct {
+	loss    float64
+	reports int
+}
+
+// report adds the chunks a viewer received, lost and received late since its previous report
+func (d *deliveryStats) report(received int, lost int, late int) {
+	total := received + lost
+	if total <= 0 {
+		return
+	}
+	loss := float64(min(lost+late, total)) / float64(total)
+
+	if d.reports == 0 {
+		d.loss = loss
+	} else {
+		d.loss = d.loss*(1-DELIVERY_SMOOTHING) + loss*DELIVERY_SMOOTHING
+	}
+	d.reports++
+}
+
+// redundancy is the number of sub clients of the viewer every chunk is sent to, healthy viewers get a single
+// copy and lossy viewers one on every sub client they have. Only chunks are reduced, viewers recover lost chunks
+// with parity or by asking for them again while replies and messages are never resent. Reduced copies go to the
+// first sub clients, when those fail the viewer reports the loss and gets a copy on every sub client again.
+func (d *deliveryStats) redundancy(subClients int) int {
+	switch {
+	case d.loss < DELIVERY_LOSS_LOW:
+		return min(1, subClients)
+	case d.loss < DELIVERY_LOSS_HIGH:
+		return min(2, subClients)
+	default:
+		return subClients
+	}
+}
+
+// adaptChunkSize shrinks chunks while viewers lose many of them and grows them back up to the configured size once
+// delivery is healthy, it is called for every sent segment
+func (s *Streamer) adaptChunkSize() {
+	loss, reporting := s.viewers.Loss()
+	if reporting == 0 {
+		return
+	}
+
+	current := int(s.chunkSize.Load())
+	next := current
+	if loss >= DELIVERY_LOSS_HIGH {
+		next = max(current/2, min(MIN_ADAPTIVE_CHUNK_SIZE, s.network.ChunkSize))
+	} else if loss < DELIVERY_LOSS_LOW {
+		next = min(current*5/4, s.network.ChunkSize)
+	}
+
+	if next != current {
+		log.Printf("viewer loss %.1f%%, chunk size %d -> %d", loss*100, current, next)
+		s.chunkSize.Store(int64(next))
+	}
+}
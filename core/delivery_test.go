@@ -0,0 +1,114 @@
+package core
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDeliveryRedundancy(t *testing.T) {
+	tests := []struct {
+		name                   string
+		received, lost, late   int
+		subClients, wantCopies int
+	}{
+		{"healthy", 1000, 0, 0, 3, 1},
+		{"some loss", 980, 20, 0, 3, 2},
+		{"lossy", 900, 100, 0, 3, 3},
+		{"late chunks are lost", 950, 0, 50, 3, 3},
+		{"single sub client", 900, 100, 0, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var d deliveryStats
+			d.report(tt.received, tt.lost, tt.late)
+			if copies := d.redundancy(tt.subClients); copies != tt.wantCopies {
+				t.Fatalf("redundancy = %d at %.1f%% loss, want %d", copies, d.loss*100, tt.wantCopies)
+			}
+		})
+	}
+
+	//Loss is smoothed, a single healthy report does not undo a lossy one and empty reports are ignored
+	var d deliveryStats
+	d.report(900, 100, 0)
+	d.report(0, 0, 0)
+	d.report(1000, 0, 0)
+	if d.reports != 2 || d.redundancy(3) != 3 {
+		t.Fatalf("%d reports at %.1f%% loss, want 2 reports still lossy", d.reports, d.loss*100)
+	}
+}
+
+func TestChunkRecipients(t *testing.T) {
+	viewers := NewViewers(time.Minute, NewMemoryNetwork().Join("host", 1), 3)
+	viewers.AddOrUpdateAddress("viewer", ChunkHeaderV2)
+	version := viewers.Version()
+
+	viewers.ReportDelivery("viewer", 1000, 0, 0)
+	if viewers.Version() == version {
+		t.Fatal("version unchanged after the viewer needs fewer copies")
+	}
+
+	//Only chunks are reduced, replies and messages reach every sub client
+	chunks := viewers.ChunkRecipients("viewer")
+	if len(chunks) != 1 || !slices.Equal(chunks[0].(memoryRecipients), memoryRecipients{"__0__.viewer"}) {
+		t.Fatalf("chunk recipients = %v, want a single copy", chunks)
+	}
+	if recipients := viewers.Recipients("viewer"); len(recipients) != 3 {
+		t.Fatalf("recipients = %v, want every sub client", recipients)
+	}
+	if recipients := viewers.SubClientRecipients(); len(recipients) != 3 {
+		t.Fatalf("sub client recipients = %v, want every sub client", recipients)
+	}
+	if redundancy := viewers.Redundancy(); redundancy != 1 {
+		t.Fatalf("redundancy = %v, want 1", redundancy)
+	}
+}
+
+func TestAdaptChunkSize(t *testing.T) {
+	s := NewStreamer()
+	s.network = (*NetworkConfig)(nil).withDefaults()
+	s.viewers = NewViewers(time.Minute, NewMemoryNetwork().Join("host", 1), 3)
+	s.chunkSize.Store(int64(s.network.ChunkSize))
+
+	//Nothing changes until viewers report
+	s.viewers.AddOrUpdateAddress("viewer", ChunkHeaderV2)
+	s.adaptChunkSize()
+	if size := s.chunkSize.Load(); size != int64(s.network.ChunkSize) {
+		t.Fatalf("chunk size = %d without reports", size)
+	}
+
+	//Lossy delivery halves the chunk size down to the minimum
+	s.viewers.ReportDelivery("viewer", 900, 100, 0)
+	for _, want := range []int64{CHUNK_SIZE / 2, CHUNK_SIZE / 4, MIN_ADAPTIVE_CHUNK_SIZE, MIN_ADAPTIVE_CHUNK_SIZE} {
+		s.adaptChunkSize()
+		if size := s.chunkSize.Load(); size != want {
+			t.Fatalf("chunk size = %d, want %d", size, want)
+		}
+	}
+
+	//Some loss keeps the chunk size
+	for loss, _ := s.viewers.Loss(); loss >= DELIVERY_LOSS_HIGH; loss, _ = s.viewers.Loss() {
+		s.viewers.ReportDelivery("viewer", 1000, 20, 0)
+	}
+	s.adaptChunkSize()
+	if size := s.chunkSize.Load(); size != MIN_ADAPTIVE_CHUNK_SIZE {
+		loss, _ := s.viewers.Loss()
+		t.Fatalf("chunk size = %d at %.1f%% loss, want it kept", size, loss*100)
+	}
+
+	//Healthy delivery grows it back to the configured size
+	for loss, _ := s.viewers.Loss(); loss >= DELIVERY_LOSS_LOW; loss, _ = s.viewers.Loss() {
+		s.viewers.ReportDelivery("viewer", 1000, 0, 0)
+	}
+	previous := s.chunkSize.Load()
+	for i := 0; i < 10; i++ {
+		s.adaptChunkSize()
+		if size := s.chunkSize.Load(); size < previous || size > int64(s.network.ChunkSize) {
+			t.Fatalf("chunk size %d after %d", size, previous)
+		}
+		previous = s.chunkSize.Load()
+	}
+	if previous != int64(s.network.ChunkSize) {
+		t.Fatalf("chunk size = %d, want it back at %d", previous, s.network.ChunkSize)
+	}
+}
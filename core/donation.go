@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"regexp"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/MutsiMutsi/go-novon/core/json"
@@ -17,28 +18,44 @@ import (
 )
 
 var donationRegex = regexp.MustCompile(`donate[0-9]+`)
-var donationMap map[string]string = make(map[string]string)
 
-func ValidateDonation(streamer *Streamer, message *ChatMessage, allowMempool bool) (err error) {
+// donationRegistry tracks the donation ids handed out to viewers and the transaction that claimed them
+type donationRegistry struct {
+	mu      sync.Mutex
+	entries map[string]string
+}
 
-	//Check if message text contains donation, if so validate, otherwise early true nothing to check.
-	var donationSum int
-	donateMatches := donationRegex.FindAllString(message.Text, -1)
+func newDonationRegistry() *donationRegistry {
+	return &donationRegistry{
+		entries: make(map[string]string),
+	}
+}
 
-	//No donations always valid
-	if len(donateMatches) == 0 {
-		return nil
+// claim marks a donation id as received by the transaction
+func (d *donationRegistry) claim(id string, txHash string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	//donation is has to be known
+	hash, exists := d.entries[id]
+	if !exists {
+		return errors.New("this donation id does not exist")
 	}
 
-	for _, match := range donateMatches {
-		amount, err := strconv.Atoi(match[6:]) // Remove "donate" from the start
-		if err != nil {
-			fmt.Println("Error parsing amount:", err)
-			continue // Skip to the next match if there's an error
-		}
-		donationSum += amount
+	if len(hash) > 0 {
+		return errors.New("this donation was already received")
 	}
 
+	d.entries[id] = txHash
+	return nil
+}
+
+// ValidateDonation checks the transaction of a donation in a chat message, looking it up stops when ctx is done
+func ValidateDonation(ctx context.Context, streamer *Streamer, message *ChatMessage, allowMempool bool) (err error) {
+
+	//Check if message text contains donation, if so validate, otherwise early true nothing to check.
+	donationSum := donationAmount(message.Text)
+
 	//probably donation0 was included in the message, this is not an actual donation
 	if donationSum == 0 {
 		return nil
@@ -55,31 +72,24 @@ func ValidateDonation(streamer *Streamer, message *ChatMessage, allowMempool boo
 
 	transaction := &json.Transaction{}
 	if allowMempool {
-		transaction, err = getTransactionFromMempool(message.Hash, srcAddr)
+		transaction, err = getTransactionFromMempool(ctx, message.Hash, srcAddr)
 		if err != nil {
 			return err
 		}
 	}
 
 	if transaction != nil && transaction.Hash == "" {
-		err = getTransactionWithRetry(context.Background(), message.Hash, transaction)
+		err = getTransactionWithRetry(ctx, message.Hash, transaction)
 		if err != nil {
 			return err
 		}
 	}
 
-	//donation is has to be known
-	hash, exists := donationMap[transaction.Attributes]
-	if !exists {
-		return errors.New("this donation id does not exist")
-	}
-
-	if len(hash) > 0 {
-		return errors.New("this donation was already received")
+	err = streamer.donations.claim(transaction.Attributes, transaction.Hash)
+	if err != nil {
+		return err
 	}
 
-	donationMap[transaction.Attributes] = transaction.Hash
-
 	//incorrect txtype always invalid
 	if transaction.TxType != "TRANSFER_ASSET_TYPE" {
 		return errors.New("incorrect txtype")
@@ -113,13 +123,27 @@ func ValidateDonation(streamer *Streamer, message *ChatMessage, allowMempool boo
 	}
 
 	//validate recipient is this stream host
-	if recipientAddr != streamer.nknClient.Account().WalletAddress() {
+	if recipientAddr != streamer.account.WalletAddress() {
 		return errors.New("transfer recipient is not host address")
 	}
 
 	return nil
 }
 
+// donationAmount is the sum of all "donate<amount>" mentions in a chat message in NKN
+func donationAmount(text string) int {
+	var donationSum int
+	for _, match := range donationRegex.FindAllString(text, -1) {
+		amount, err := strconv.Atoi(match[6:]) // Remove "donate" from the start
+		if err != nil {
+			fmt.Println("Error parsing amount:", err)
+			continue // Skip to the next match if there's an error
+		}
+		donationSum += amount
+	}
+	return donationSum
+}
+
 func getTransactionWithRetry(ctx context.Context, hash string, transaction *json.Transaction) (err error) {
 	for i := 0; i < 10; i++ {
 		timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
@@ -131,18 +155,22 @@ func getTransactionWithRetry(ctx context.Context, hash string, transaction *json
 		}
 
 		fmt.Printf("Transaction not found yet, retrying in %v...\n", 5*time.Second)
-		time.Sleep(5 * time.Second)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
 	}
 
 	return errors.New("transaction not found in time")
 }
 
-func getTransactionFromMempool(hash string, sender string) (*json.Transaction, error) {
+func getTransactionFromMempool(ctx context.Context, hash string, sender string) (*json.Transaction, error) {
 	var transactions []json.Transaction
 	requestBody := map[string]interface{}{"action": "txnlist", "address": sender}
 
 	for i := 0; i < 5; i++ {
-		err := nkn.RPCCall(context.Background(), "getrawmempool", requestBody, &transactions, nkn.GetDefaultRPCConfig())
+		err := nkn.RPCCall(ctx, "getrawmempool", requestBody, &transactions, nkn.GetDefaultRPCConfig())
 		if err != nil {
 			return nil, err
 		}
@@ -154,15 +182,22 @@ func getTransactionFromMempool(hash string, sender string) (*json.Transaction, e
 		}
 
 		fmt.Printf("Transaction not in mempool, retrying in %v...\n", time.Second)
-		time.Sleep(time.Second)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
 	}
 
 	return nil, nil
 }
 
-func generateDonationEntry() string {
+func (d *donationRegistry) generate() string {
 	rngBytes, _ := nkn.RandomBytes(32)
 	hex := hex.EncodeToString(rngBytes)
-	donationMap[hex] = ""
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries[hex] = ""
 	return hex
 }
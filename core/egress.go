@@ -0,0 +1,182 @@
+package core
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// egressPriority orders sends when the upload budget is exhausted, lower values go first
+type egressPriority int
+
+const (
+	//Replies to requests of viewers
+	priorityReply egressPriority = iota
+	//Chat, the manifest and other messages to viewers
+	priorityMessage
+	//Chunks, the lowest quality level has this priority and every higher level the next one
+	priorityVideo
+)
+
+// videoPriority is the priority of the chunks of a quality level, level 0 is the source and the highest quality
+func videoPriority(quality int, qualityLevels int) egressPriority {
+	return priorityVideo + egressPriority(qualityLevels-1-quality)
+}
+
+// EgressStats describes the upload budget and the sends it dropped
+type EgressStats struct {
+	LimitKbps   int `json:"limitKbps"`
+	QueuedBytes int `json:"queuedBytes"`
+	//Dropped sends by priority: replies, messages, then chunks from the lowest quality level up
+	Dropped []uint64 `json:"dropped"`
+}
+
+type egressSend struct {
+	to      Recipients
+	payload *Payload
+}
+
+// egressLimiter sends within an upload budget. Sends wait in a queue per priority holding at most
+// EGRESS_QUEUE_SECONDS of the budget; when it is full, queued sends of a lower priority are dropped to make room,
+// so replies and messages preempt chunks and high quality levels are dropped before low ones.
+type egressLimiter struct {
+	limiter   *rate.Limiter
+	limitKbps int
+	maxQueued int
+	//send returns right away, sends run in the background so one slow send does not hold up the queue
+	send func(to Recipients, payload *Payload)
+
+	mu      sync.Mutex
+	queues  [][]egressSend
+	queued  int
+	dropped []uint64
+	wake    chan struct{}
+}
+
+func newEgressLimiter(limitKbps int, maxMessage int, send func(to Recipients, payload *Payload)) *egressLimiter {
+	bytesPerSecond := limitKbps * 1000 / 8
+	return &egressLimiter{
+		//The burst has to fit the largest message or it could never be sent
+		limiter:   rate.NewLimiter(rate.Limit(bytesPerSecond), max(bytesPerSecond/4, maxMessage)),
+		limitKbps: limitKbps,
+		maxQueued: max(bytesPerSecond*EGRESS_QUEUE_SECONDS, maxMessage),
+		send:      send,
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// enqueue queues a send, it never blocks
+func (e *egressLimiter) enqueue(priority egressPriority, to Recipients, payload *Payload) {
+	if to.Len() == 0 {
+		return
+	}
+	cost := len(payload.Data)
+
+	e.mu.Lock()
+	for len(e.queues) <= int(priority) {
+		e.queues = append(e.queues, nil)
+		e.dropped = append(e.dropped, 0)
+	}
+
+	//Make room by dropping the newest sends of the lowest priority below this one
+	for e.queued+cost > e.maxQueued {
+		lowest := len(e.queues) - 1
+		for lowest > int(priority) && len(e.queues[lowest]) == 0 {
+			lowest--
+		}
+		if lowest <= int(priority) {
+			break
+		}
+		queue := e.queues[lowest]
+		e.queued -= len(queue[len(queue)-1].payload.Data)
+		e.queues[lowest] = queue[:len(queue)-1]
+		e.dropped[lowest]++
+	}
+
+	if e.queued+cost > e.maxQueued {
+		e.dropped[priority]++
+		e.mu.Unlock()
+		return
+	}
+	e.queues[priority] = append(e.queues[priority], egressSend{to: to, payload: payload})
+	e.queued += cost
+	e.mu.Unlock()
+
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next takes the oldest send of the highest priority
+func (e *egressLimiter) next() (egressSend, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for i, queue := range e.queues {
+		if len(queue) > 0 {
+			e.queues[i] = queue[1:]
+			e.queued -= len(queue[0].payload.Data)
+			return queue[0], true
+		}
+	}
+	return egressSend{}, false
+}
+
+// run sends queued sends as fast as the budget allows until the context is done
+func (e *egressLimiter) run(ctx context.Context) {
+	for {
+		send, ok := e.next()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				log.Println("egressLimiter: stopping")
+				return
+			case <-e.wake:
+				continue
+			}
+		}
+
+		//Messages larger than the burst, such as thumbnails, use the whole burst
+		if err := e.limiter.WaitN(ctx, min(max(len(send.payload.Data), 1), e.limiter.Burst())); err != nil {
+			log.Println("egressLimiter: stopping")
+			return
+		}
+		e.send(send.to, send.payload)
+	}
+}
+
+func (e *egressLimiter) stats() *EgressStats {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return &EgressStats{
+		LimitKbps:   e.limitKbps,
+		QueuedBytes: e.queued,
+		Dropped:     append([]uint64{}, e.dropped...),
+	}
+}
+
+// dispatch sends in the background, within the upload budget when one is configured
+func (s *Streamer) dispatch(priority egressPriority, to Recipients, payload *Payload) {
+	if s.egress == nil {
+		s.sendAsync(to, payload)
+		return
+	}
+	s.egress.enqueue(priority, to, payload)
+}
+
+// sendAsync sends in a goroutine that Stop waits for, so no send outlives the transport it uses
+func (s *Streamer) sendAsync(to Recipients, payload *Payload) {
+	s.goroutine(func() { s.send(to, payload) })
+}
+
+// EgressStats reports the upload budget and the sends it dropped, nil without an upload budget
+func (s *Streamer) EgressStats() *EgressStats {
+	return s.egress.stats()
+}
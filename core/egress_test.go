@@ -0,0 +1,49 @@
+package core
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+func TestEgressPriorities(t *testing.T) {
+	//1000 bytes per second queue at most 2000 bytes, sends are never run so the queue is deterministic
+	e := newEgressLimiter(8, 500, func(Recipients, *Payload) { t.Fatal("send without run") })
+	to := memoryRecipients{"viewer"}
+	send := func(priority egressPriority, size int, name string) {
+		e.enqueue(priority, to, newPayload(PayloadBinary, append([]byte(name), make([]byte, size-len(name))...)))
+	}
+
+	const levels = 3
+	send(videoPriority(0, levels), 500, "source")
+	send(videoPriority(1, levels), 500, "720p")
+	send(videoPriority(2, levels), 500, "480p")
+	send(videoPriority(2, levels), 500, "480p")
+
+	//The queue is full, replies and messages make room by dropping the highest quality levels first
+	send(priorityReply, 300, "reply")
+	send(priorityMessage, 300, "message")
+	//Nothing is queued below the source level, so more of it is dropped
+	send(videoPriority(0, levels), 500, "source")
+
+	want := []uint64{0, 0, 0, 1, 2}
+	if stats := e.stats(); !slices.Equal(stats.Dropped, want) || stats.QueuedBytes != 1600 || stats.LimitKbps != 8 {
+		t.Fatalf("stats = %+v, want %v dropped and 1600 bytes queued", stats, want)
+	}
+
+	//Replies go first, then messages, then chunks from the lowest quality level up
+	var order []string
+	for {
+		send, ok := e.next()
+		if !ok {
+			break
+		}
+		order = append(order, string(bytes.TrimRight(send.payload.Data, "\x00")))
+	}
+	if want := []string{"reply", "message", "480p", "480p"}; !slices.Equal(order, want) {
+		t.Fatalf("sent %v, want %v", order, want)
+	}
+	if e.stats().QueuedBytes != 0 {
+		t.Fatalf("%d bytes queued after sending everything", e.stats().QueuedBytes)
+	}
+}
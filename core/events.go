@@ -1,21 +1,241 @@
 package core
 
-// Define a type for event handlers
-type EventHandler func(data interface{})
+import (
+	"sync"
+	"sync/atomic"
+)
 
-// Event struct holds a list of listeners
-type Event struct {
-	listeners []EventHandler
+// EventType identifies an event, it is also the event name used towards the frontend
+type EventType string
+
+const (
+	EventFfmpegStatus   EventType = "FFMPEG_UPDATE"
+	EventNknStatus      EventType = "NKN_UPDATE"
+	EventRtmpPort       EventType = "RTMP_PORT"
+	EventRtmpPublish    EventType = "RTMP_PUBLISH"
+	EventRtmpTerminated EventType = "RTMP_TERMINATED"
+	EventPublish        EventType = "PUBLISH"
+	EventVideoInfo      EventType = "VIDEO_INFO"
+	EventStreamState    EventType = "STREAM_STATE"
+	EventPathReady      EventType = "PATH_READY"
+	EventReaderAdded    EventType = "READER_ADDED"
+	EventMediaMTXError  EventType = "MEDIAMTX_ERROR"
+)
+
+// Event is implemented by every event the Streamer emits
+type Event interface {
+	Type() EventType
+}
+
+// FfmpegStatusEvent reports whether ffmpeg is available on this machine
+type FfmpegStatusEvent struct {
+	IsInstalled bool   `json:"isInstalled"`
+	OS          string `json:"os"`
+}
+
+// NknStatusEvent reports the number of connected NKN sub clients
+type NknStatusEvent struct {
+	NumClients int `json:"numClients"`
+	//Connected sub clients that are not backing off after send errors
+	NumHealthy int    `json:"numHealthy"`
+	Status     string `json:"status"`
+	//Health of every sub client, only in the periodic reports once connected
+	SubClients []SubClientStats `json:"subClients,omitempty"`
+}
+
+// RtmpPortEvent reports the port the RTMP server listens on
+type RtmpPortEvent struct {
+	Port string `json:"port"`
+}
+
+// RtmpPublishEvent is emitted when a publisher starts streaming to the RTMP server
+type RtmpPublishEvent struct {
+	Path       string `json:"path"`
+	RemoteAddr string `json:"remoteAddr"`
+}
+
+// RtmpTerminatedEvent is emitted when the RTMP publisher disconnects
+type RtmpTerminatedEvent struct {
+	Path       string `json:"path"`
+	RemoteAddr string `json:"remoteAddr"`
+}
+
+// PublishEvent is emitted for every segment that is published to viewers
+type PublishEvent struct {
+	NumViewers  int `json:"numViewers"`
+	SegmentSize int `json:"segmentSize"`
+	NumChunks   int `json:"numChunks"`
+	//Viewers that received the segment from another viewer
+	NumForwarded int `json:"numForwarded"`
+	//Segment bytes in a chunk, adapted to the loss viewers report
+	ChunkSize int `json:"chunkSize"`
+	//Average share of chunks lost or late as reported by viewers
+	Loss float64 `json:"loss"`
+	//Average copies of every chunk sent to a viewer
+	Redundancy float64 `json:"redundancy"`
+	//Upload budget and dropped sends, only with an upload budget
+	Egress *EgressStats `json:"egress,omitempty"`
+	//Milliseconds the chunk sends of the segment are spread over, 0 without pacing
+	PacingMs int `json:"pacingMs"`
+}
+
+// VideoInfoEvent describes the incoming video stream
+type VideoInfoEvent struct {
+	Codec      string `json:"codec"`
+	Resolution string `json:"resolution"`
+	Framerate  string `json:"framerate"`
+}
+
+// StreamStateEvent is emitted on every transition of the stream state
+type StreamStateEvent struct {
+	State    StreamState `json:"state"`
+	Previous StreamState `json:"previous"`
+}
+
+// PathReadyEvent is emitted when a MediaMTX path starts or stops having a source
+type PathReadyEvent struct {
+	Path  string `json:"path"`
+	Ready bool   `json:"ready"`
+}
+
+// ReaderAddedEvent is emitted when a MediaMTX path gets a new reader, e.g. the HLS muxer producing segments
+type ReaderAddedEvent struct {
+	Path   string `json:"path"`
+	Reader string `json:"reader"`
+}
+
+// MediaMTXErrorEvent reports that MediaMTX could not be monitored
+type MediaMTXErrorEvent struct {
+	Error string `json:"error"`
+}
+
+func (FfmpegStatusEvent) Type() EventType   { return EventFfmpegStatus }
+func (NknStatusEvent) Type() EventType      { return EventNknStatus }
+func (RtmpPortEvent) Type() EventType       { return EventRtmpPort }
+func (RtmpPublishEvent) Type() EventType    { return EventRtmpPublish }
+func (RtmpTerminatedEvent) Type() EventType { return EventRtmpTerminated }
+func (PublishEvent) Type() EventType        { return EventPublish }
+func (VideoInfoEvent) Type() EventType      { return EventVideoInfo }
+func (StreamStateEvent) Type() EventType    { return EventStreamState }
+func (PathReadyEvent) Type() EventType      { return EventPathReady }
+func (ReaderAddedEvent) Type() EventType    { return EventReaderAdded }
+func (MediaMTXErrorEvent) Type() EventType  { return EventMediaMTXError }
+
+// EventHandler receives the events of a subscription
+type EventHandler func(event Event)
+
+// Number of undelivered events a subscription buffers before it starts dropping
+const eventQueueSize = 64
+
+// EventBus delivers events to subscribers without ever blocking the emitter
+type EventBus struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
 }
 
-// Register a new listener
-func (e *Event) Subscribe(handler EventHandler) {
-	e.listeners = append(e.listeners, handler)
+// Subscription is a registered handler on an EventBus
+type Subscription struct {
+	bus     *EventBus
+	handler EventHandler
+	types   map[EventType]struct{}
+	queue   chan Event
+	done    chan struct{}
+	once    sync.Once
+	dropped atomic.Uint64
 }
 
-// Raise the event (notify all listeners)
-func (e *Event) Emit(data interface{}) {
-	for _, handler := range e.listeners {
-		handler(data)
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subs: make(map[*Subscription]struct{}),
 	}
 }
+
+// Subscribe registers a handler for the given event types, or for all events if none are given.
+// Events are delivered in order on a goroutine of the subscription, a handler that falls behind
+// drops events instead of stalling the emitter.
+func (b *EventBus) Subscribe(handler EventHandler, types ...EventType) *Subscription {
+	sub := &Subscription{
+		bus:     b,
+		handler: handler,
+		queue:   make(chan Event, eventQueueSize),
+		done:    make(chan struct{}),
+	}
+
+	if len(types) > 0 {
+		sub.types = make(map[EventType]struct{}, len(types))
+		for _, t := range types {
+			sub.types[t] = struct{}{}
+		}
+	}
+
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+
+	go sub.run()
+	return sub
+}
+
+// Emit queues the event for every interested subscriber
+func (b *EventBus) Emit(event Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for sub := range b.subs {
+		sub.deliver(event)
+	}
+}
+
+// Close unsubscribes all subscribers
+func (b *EventBus) Close() {
+	b.mu.RLock()
+	subs := make([]*Subscription, 0, len(b.subs))
+	for sub := range b.subs {
+		subs = append(subs, sub)
+	}
+	b.mu.RUnlock()
+
+	for _, sub := range subs {
+		sub.Unsubscribe()
+	}
+}
+
+func (sub *Subscription) deliver(event Event) {
+	if sub.types != nil {
+		if _, ok := sub.types[event.Type()]; !ok {
+			return
+		}
+	}
+
+	select {
+	case sub.queue <- event:
+	default:
+		sub.dropped.Add(1)
+	}
+}
+
+func (sub *Subscription) run() {
+	for {
+		select {
+		case <-sub.done:
+			return
+		case event := <-sub.queue:
+			sub.handler(event)
+		}
+	}
+}
+
+// Unsubscribe stops delivery to the handler, events still queued are discarded
+func (sub *Subscription) Unsubscribe() {
+	sub.once.Do(func() {
+		sub.bus.mu.Lock()
+		delete(sub.bus.subs, sub)
+		sub.bus.mu.Unlock()
+		close(sub.done)
+	})
+}
+
+// Dropped returns how many events were discarded because the handler could not keep up
+func (sub *Subscription) Dropped() uint64 {
+	return sub.dropped.Load()
+}
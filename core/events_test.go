@@ -0,0 +1,142 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+// receiveEvents waits for the number of events from the channel
+func receiveEvents(t *testing.T, events chan Event, n int) []Event {
+	t.Helper()
+
+	received := make([]Event, 0, n)
+	timeout := time.After(5 * time.Second)
+	for len(received) < n {
+		select {
+		case e := <-events:
+			received = append(received, e)
+		case <-timeout:
+			t.Fatalf("received %d events, want %d", len(received), n)
+		}
+	}
+	return received
+}
+
+func TestEventBusOrderAndTypes(t *testing.T) {
+	bus := NewEventBus()
+	defer bus.Close()
+
+	all := make(chan Event, eventQueueSize)
+	publishes := make(chan Event, eventQueueSize)
+	bus.Subscribe(func(e Event) { all <- e })
+	bus.Subscribe(func(e Event) { publishes <- e }, EventPublish)
+
+	const n = 20
+	for i := 0; i < n; i++ {
+		bus.Emit(PublishEvent{NumViewers: i})
+		bus.Emit(PathReadyEvent{Path: "test", Ready: i%2 == 0})
+	}
+
+	//Every subscription sees its events in the order they were emitted
+	for i, e := range receiveEvents(t, all, 2*n) {
+		if i%2 == 0 && e != (PublishEvent{NumViewers: i / 2}) || i%2 == 1 && e.Type() != EventPathReady {
+			t.Fatalf("event %d = %+v, want the events in order", i, e)
+		}
+	}
+	for i, e := range receiveEvents(t, publishes, n) {
+		if e != (PublishEvent{NumViewers: i}) {
+			t.Fatalf("event %d = %+v, want publish event %d", i, e, i)
+		}
+	}
+
+	//Events of other types are not delivered
+	select {
+	case e := <-publishes:
+		t.Fatalf("received %+v, want only publish events", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestEventBusUnsubscribe(t *testing.T) {
+	bus := NewEventBus()
+	events := make(chan Event, eventQueueSize)
+	sub := bus.Subscribe(func(e Event) { events <- e })
+	other := make(chan Event, eventQueueSize)
+	bus.Subscribe(func(e Event) { other <- e })
+
+	bus.Emit(RtmpPortEvent{Port: "1935"})
+	receiveEvents(t, events, 1)
+
+	//Unsubscribing twice is harmless, the other subscription keeps receiving
+	sub.Unsubscribe()
+	sub.Unsubscribe()
+	bus.Emit(RtmpPortEvent{Port: "1936"})
+	receiveEvents(t, other, 2)
+	select {
+	case e := <-events:
+		t.Fatalf("received %+v after Unsubscribe", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	//Close unsubscribes everyone
+	bus.Close()
+	bus.Emit(RtmpPortEvent{Port: "1937"})
+	select {
+	case e := <-other:
+		t.Fatalf("received %+v after Close", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestEventBusSlowSubscriber(t *testing.T) {
+	bus := NewEventBus()
+	t.Cleanup(bus.Close)
+
+	//The slow handler blocks on its first event until released
+	release := make(chan struct{})
+	slowEvents := make(chan Event, 2*eventQueueSize)
+	slow := bus.Subscribe(func(e Event) {
+		<-release
+		slowEvents <- e
+	})
+	//Cleanups run last in first out, a failing test releases the handler before the bus is closed
+	t.Cleanup(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	})
+	fast := make(chan Event)
+	bus.Subscribe(func(e Event) { fast <- e })
+
+	//Every event reaches the fast subscriber while the slow one is stuck
+	const n = 2 * eventQueueSize
+	emitted := make(chan struct{})
+	go func() {
+		for i := 0; i < n; i++ {
+			bus.Emit(PublishEvent{NumViewers: i})
+			<-fast
+		}
+		close(emitted)
+	}()
+	select {
+	case <-emitted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Emit blocked on a slow subscriber")
+	}
+
+	//The slow subscriber drops what does not fit its queue
+	if dropped := slow.Dropped(); dropped < n-eventQueueSize-1 || dropped > n-eventQueueSize {
+		t.Fatalf("dropped %d events, want %d with a queue of %d", dropped, n-eventQueueSize, eventQueueSize)
+	}
+
+	//The events that were kept are delivered in order once the handler catches up
+	close(release)
+	kept := n - int(slow.Dropped())
+	for i, e := range receiveEvents(t, slowEvents, kept) {
+		if e != (PublishEvent{NumViewers: i}) {
+			t.Fatalf("event %d = %+v, want the first %d events in order", i, e, kept)
+		}
+	}
+}
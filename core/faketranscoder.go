@@ -0,0 +1,112 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// FakeTranscoder is a deterministic Transcoder that does not need ffmpeg, meant for tests.
+// Transcoded segments are the input truncated by the ratio of the target and source height,
+// so higher quality levels are always larger, like real output.
+type FakeTranscoder struct {
+	Info VideoInfo
+	// OutputCodec is the codec of transcoded segments
+	OutputCodec string
+
+	// Errors returned by the corresponding methods when set
+	AvailableErr error
+	ProbeErr     error
+	// TranscodeErrs fails transcodes to the quality levels with these resolutions
+	TranscodeErrs map[int]error
+
+	// TranscodeDelay is called before every transcode when set, to let transcodes take time or block
+	TranscodeDelay func(segment []byte, level Transcode) time.Duration
+
+	mu         sync.Mutex
+	probes     int
+	transcodes []Transcode
+	thumbnails int
+}
+
+// NewFakeTranscoder reports every segment as 1080p30 h264 and transcodes to h264
+func NewFakeTranscoder() *FakeTranscoder {
+	return &FakeTranscoder{
+		Info: VideoInfo{
+			Codec:     "h264",
+			Width:     1920,
+			Height:    1080,
+			Framerate: "30/1",
+		},
+		OutputCodec: "h264",
+	}
+}
+
+func (f *FakeTranscoder) Available() error {
+	return f.AvailableErr
+}
+
+func (f *FakeTranscoder) Probe(segment []byte) (VideoInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.probes++
+
+	if f.ProbeErr != nil {
+		return VideoInfo{}, f.ProbeErr
+	}
+	return f.Info, nil
+}
+
+func (f *FakeTranscoder) Transcode(segment []byte, level Transcode) ([]byte, error) {
+	if f.TranscodeDelay != nil {
+		time.Sleep(f.TranscodeDelay(segment, level))
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.transcodes = append(f.transcodes, level)
+
+	if err := f.TranscodeErrs[level.Resolution]; err != nil {
+		return nil, err
+	}
+	if f.Info.Height <= 0 {
+		return nil, fmt.Errorf("fake transcoder: no source height")
+	}
+
+	size := len(segment) * level.Resolution / f.Info.Height
+	size = min(max(size, 1), len(segment))
+	return append([]byte(nil), segment[:size]...), nil
+}
+
+func (f *FakeTranscoder) Codec() string {
+	return f.OutputCodec
+}
+
+func (f *FakeTranscoder) Thumbnail(segment []byte, width, height int) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.thumbnails++
+
+	return []byte(fmt.Sprintf("thumbnail %dx%d", width, height)), nil
+}
+
+// Probes returns how many segments were probed
+func (f *FakeTranscoder) Probes() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.probes
+}
+
+// Transcodes returns the quality levels of every transcode call in order
+func (f *FakeTranscoder) Transcodes() []Transcode {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Transcode(nil), f.transcodes...)
+}
+
+// Thumbnails returns how many thumbnails were grabbed
+func (f *FakeTranscoder) Thumbnails() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.thumbnails
+}
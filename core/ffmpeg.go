@@ -0,0 +1,112 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+)
+
+// FFmpegTranscoder shells out to the ffmpeg and ffprobe binaries, it is the default Transcoder
+type FFmpegTranscoder struct {
+	FfmpegPath  string
+	FfprobePath string
+}
+
+// NewFFmpegTranscoder uses ffmpeg and ffprobe from the PATH
+func NewFFmpegTranscoder() *FFmpegTranscoder {
+	return &FFmpegTranscoder{
+		FfmpegPath:  "ffmpeg",
+		FfprobePath: "ffprobe",
+	}
+}
+
+func (f *FFmpegTranscoder) Available() error {
+	return exec.Command(f.FfmpegPath, "-version").Run()
+}
+
+func (f *FFmpegTranscoder) Probe(segment []byte) (VideoInfo, error) {
+	// Create ffprobe command with pipe input
+	cmd := exec.Command(f.FfprobePath, "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", "-i", "-")
+	cmd.Stdin = bytes.NewReader(segment)
+
+	// Capture ffprobe output
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return VideoInfo{}, fmt.Errorf("error probing video info: %w", err)
+	}
+
+	// Parse ffprobe JSON output
+	var probe struct {
+		Streams []struct {
+			CodecType  string `json:"codec_type"`
+			CodecName  string `json:"codec_name"`
+			Width      int    `json:"width"`
+			Height     int    `json:"height"`
+			RFrameRate string `json:"r_frame_rate"`
+		} `json:"streams"`
+	}
+	err = json.Unmarshal(out, &probe)
+	if err != nil {
+		return VideoInfo{}, fmt.Errorf("error parsing ffprobe output: %w", err)
+	}
+
+	// Extract info only from the first video stream
+	for _, stream := range probe.Streams {
+		if stream.CodecType == "video" {
+			return VideoInfo{
+				Codec:     stream.CodecName,
+				Width:     stream.Width,
+				Height:    stream.Height,
+				Framerate: stream.RFrameRate,
+			}, nil
+		}
+	}
+
+	return VideoInfo{}, fmt.Errorf("error probing video info: no video stream")
+}
+
+func (f *FFmpegTranscoder) Transcode(segment []byte, level Transcode) ([]byte, error) {
+	//ultrafast superfast veryfast faster fast medium (default) slow slower veryslow
+	return f.run(segment,
+		"-hwaccel", "auto",
+		"-i", "-", // read from stdin (pipe)
+		"-c:v", "libx264", // specify video encoder (optional)
+		"-crf", "30", // set constant rate factor (quality)
+		"-preset", "ultrafast", // set encoding preset for faster processing
+		"-acodec", "copy",
+		"-filter:v", fmt.Sprintf("scale=-2:%d,fps=%d", level.Resolution, level.Framerate),
+		"-copyts",
+		"-f", "mpegts",
+		"-")
+}
+
+// Codec is h264, segments are encoded with libx264
+func (f *FFmpegTranscoder) Codec() string {
+	return "h264"
+}
+
+func (f *FFmpegTranscoder) Thumbnail(segment []byte, width, height int) ([]byte, error) {
+	return f.run(segment,
+		"-i", "-", // read from stdin (pipe)
+		"-vframes", "1",
+		"-vf", fmt.Sprintf("scale=%d:%d", width, height), // resize filter
+		"-f", "image2pipe",
+		"-")
+}
+
+// run pipes the segment through ffmpeg and returns its output
+func (f *FFmpegTranscoder) run(segment []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command(f.FfmpegPath, args...)
+
+	var stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(segment)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg: %w, stderr: %s", err, stderr.String())
+	}
+
+	return out, nil
+}
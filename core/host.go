@@ -0,0 +1,246 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	mtx "github.com/bluenviron/mediamtx/core"
+)
+
+// Host runs a Streamer for every configured channel in one process.
+//
+// The embedded MediaMTX does not tell which path a segment belongs to, so a single front ingest accepts RTMP
+// publishers on the configured paths and every channel runs its own loopback MediaMTX that pulls its path from it.
+// Without channels in the config the Host runs a single Streamer exactly like before.
+type Host struct {
+	// Prepare is called with the streamer of every channel before it starts, e.g. to subscribe to its events
+	Prepare func(s *Streamer)
+
+	opts               []Option
+	configPath         string
+	mediaMTXConfigPath string
+	rtmpAddress        string
+
+	mu          sync.Mutex
+	ingest      *mtx.Core
+	stopMonitor context.CancelFunc
+	monitorDone chan struct{}
+	workDir     string
+	streamers   []*Streamer
+}
+
+// NewHost takes the same options as NewStreamer, they are applied to the Streamer of every channel
+func NewHost(opts ...Option) *Host {
+	defaults := NewStreamer(opts...)
+
+	return &Host{
+		opts:               opts,
+		configPath:         defaults.configPath,
+		mediaMTXConfigPath: defaults.mediaMTXConfigPath,
+		rtmpAddress:        defaults.rtmpAddress,
+	}
+}
+
+func (h *Host) Start() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.streamers) > 0 {
+		return errors.New("host already started")
+	}
+
+	cfg, err := NewConfig(h.configPath)
+	if err != nil {
+		return err
+	}
+
+	if len(cfg.Channels) == 0 {
+		s := NewStreamer(h.opts...)
+		h.streamers = []*Streamer{s}
+		if h.Prepare != nil {
+			h.Prepare(s)
+		}
+		return s.Start()
+	}
+
+	mtxConfigPath := h.mediaMTXConfigPath
+	if mtxConfigPath == "" {
+		mtxConfigPath = "mediamtx.yml"
+	}
+	base, err := os.ReadFile(mtxConfigPath)
+	if err != nil {
+		return fmt.Errorf("error reading MediaMTX config: %w", err)
+	}
+
+	rtmpAddress := rtmpListenAddress(h.rtmpAddress, mtxConfigPath)
+	ingestAddress, err := loopbackAddress(rtmpAddress)
+	if err != nil {
+		return err
+	}
+
+	h.workDir, err = os.MkdirTemp("", "go-novon-")
+	if err != nil {
+		return err
+	}
+
+	channels := cfg.ChannelConfigs()
+
+	//The front ingest only accepts publishers on channel paths and does not produce segments itself
+	ingestPaths := make(map[string]map[string]string, len(channels))
+	for _, ch := range channels {
+		ingestPaths[ch.Path] = map[string]string{}
+	}
+	ingestConfig := overrideMediaMTXConfig(string(base), map[string]string{
+		"rtmp":        "yes",
+		"rtmpAddress": rtmpAddress,
+		"hls":         "no",
+	}, ingestPaths)
+
+	ingestConfigPath := filepath.Join(h.workDir, "ingest.yml")
+	if err := writeMediaMTXConfig(ingestConfigPath, ingestConfig); err != nil {
+		h.cleanup()
+		return err
+	}
+
+	apiSettings := map[string]string{}
+	apiAddress, err := mtxAPIAddress(ingestConfigPath, apiSettings)
+	if err != nil {
+		h.cleanup()
+		return err
+	}
+
+	var ok bool
+	h.ingest, ok = newMediaMTX(ingestConfigPath, apiSettings, func([]byte) {})
+	if !ok {
+		h.cleanup()
+		return errors.New("error starting RTMP ingest")
+	}
+	log.Println("RTMP ingest listening on", rtmpAddress, "for", len(channels), "channels")
+
+	_, rtmpPort, _ := net.SplitHostPort(rtmpAddress)
+
+	for i, ch := range channels {
+		channelConfig := overrideMediaMTXConfig(string(base), map[string]string{
+			"rtmp":           "no",
+			"rtsp":           "no",
+			"webrtc":         "no",
+			"srt":            "no",
+			"metrics":        "no",
+			"pprof":          "no",
+			"playback":       "no",
+			"hls":            "yes",
+			"hlsAlwaysRemux": "yes",
+			"hlsAddress":     "127.0.0.1:0",
+		}, map[string]map[string]string{
+			ch.Path: {"source": "rtmp://" + ingestAddress + "/" + ch.Path},
+		})
+
+		channelConfigPath := filepath.Join(h.workDir, fmt.Sprintf("channel%d.yml", i))
+		if err := writeMediaMTXConfig(channelConfigPath, channelConfig); err != nil {
+			h.stop()
+			return err
+		}
+
+		opts := append(append([]Option{}, h.opts...),
+			WithChannel(ch),
+			WithMediaMTXConfigPath(channelConfigPath),
+			WithRtmpAddress(""),
+		)
+		s := NewStreamer(opts...)
+		h.streamers = append(h.streamers, s)
+		if h.Prepare != nil {
+			h.Prepare(s)
+		}
+
+		log.Printf("starting channel %q", ch.Path)
+		if err := s.Start(); err != nil {
+			h.stop()
+			return fmt.Errorf("channel %q: %w", ch.Path, err)
+		}
+		s.Events.Emit(RtmpPortEvent{Port: rtmpPort})
+	}
+
+	//Publishers connect to the ingest, report them to the streamer of their path.
+	//The monitor starts once all streamers exist and is stopped before they are, it reads them without locking.
+	ctx, cancel := context.WithCancel(context.Background())
+	h.stopMonitor = cancel
+	h.monitorDone = make(chan struct{})
+	monitor := newMTXMonitor(apiAddress, true, mtxHooks{
+		onPublisherConnected: func(publisher PublisherInfo) {
+			if s := h.streamer(publisher.Path); s != nil {
+				s.publisherConnected(publisher)
+			}
+		},
+		onPublisherDisconnected: func(publisher PublisherInfo) {
+			if s := h.streamer(publisher.Path); s != nil {
+				s.publisherDisconnected(publisher)
+			}
+		},
+		onError: func(err error) {
+			log.Println("RTMP ingest error:", err)
+		},
+	})
+	go func() {
+		defer close(h.monitorDone)
+		monitor.run(ctx)
+	}()
+
+	return nil
+}
+
+func (h *Host) Stop() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stop()
+}
+
+func (h *Host) stop() {
+	//Publishers still connected are reported as disconnected while the streamers can still tell their viewers
+	if h.stopMonitor != nil {
+		h.stopMonitor()
+		<-h.monitorDone
+		h.stopMonitor = nil
+	}
+
+	for _, s := range h.streamers {
+		s.Stop()
+	}
+	h.streamers = nil
+
+	if h.ingest != nil {
+		h.ingest.Close()
+		h.ingest = nil
+	}
+
+	h.cleanup()
+}
+
+func (h *Host) cleanup() {
+	if h.workDir != "" {
+		os.RemoveAll(h.workDir)
+		h.workDir = ""
+	}
+}
+
+// streamer finds the streamer of a channel path
+func (h *Host) streamer(path string) *Streamer {
+	for _, s := range h.streamers {
+		if s.Path() == path {
+			return s
+		}
+	}
+	return nil
+}
+
+// Streamers returns the streamer of every channel in config order
+func (h *Host) Streamers() []*Streamer {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]*Streamer(nil), h.streamers...)
+}
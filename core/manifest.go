@@ -0,0 +1,134 @@
+package core
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+)
+
+// Manifest is the rolling live playlist of the most recent segments, like an HLS media playlist with the master
+// playlist of quality levels included. Viewers use it to schedule playback, prefetch and switch levels.
+type Manifest struct {
+	//Id of the first listed segment, segments are listed in order without gaps
+	Sequence int `json:"sequence"`
+	//Duration of the longest listed segment in milliseconds
+	TargetDurationMs int               `json:"targetDurationMs"`
+	Levels           []ManifestLevel   `json:"levels"`
+	Segments         []ManifestSegment `json:"segments"`
+}
+
+// ManifestLevel is a quality level, level 0 is the source quality
+type ManifestLevel struct {
+	Level      int    `json:"level"`
+	Codec      string `json:"codec"`
+	Resolution int    `json:"resolution"`
+	Framerate  int    `json:"framerate"`
+	//Average bitrate over the listed segments in bits per second
+	Bandwidth int `json:"bandwidth"`
+}
+
+// ManifestSegment describes a segment sent to viewers
+type ManifestSegment struct {
+	Id         int   `json:"id"`
+	DurationMs int   `json:"durationMs"`
+	PTS        int64 `json:"pts"`
+	Wallclock  int64 `json:"wallclock"`
+	Keyframe   bool  `json:"keyframe"`
+	//Timestamps do not continue from the previous segment, like EXT-X-DISCONTINUITY
+	Discontinuity bool `json:"discontinuity,omitempty"`
+	//Size in bytes of every quality level, 0 when the level is not available for this segment
+	Sizes []int `json:"sizes"`
+}
+
+// liveManifest keeps the manifest of the last MANIFEST_SEGMENTS segments
+type liveManifest struct {
+	mu       sync.RWMutex
+	levels   []ManifestLevel
+	segments []ManifestSegment
+}
+
+func newLiveManifest() *liveManifest {
+	return &liveManifest{}
+}
+
+// add lists a sent segment, the oldest one drops out when the window is full
+func (m *liveManifest) add(job *segmentJob) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	//A gap in ids restarts the playlist, viewers can not schedule around missing segments
+	if n := len(m.segments); n > 0 && m.segments[n-1].Id+1 != job.id {
+		m.segments = nil
+	}
+
+	m.segments = append(m.segments, ManifestSegment{
+		Id:            job.id,
+		DurationMs:    int(job.timing.duration.Milliseconds()),
+		PTS:           job.timing.pts,
+		Wallclock:     job.wallclock,
+		Keyframe:      job.timing.keyframe,
+		Discontinuity: job.discontinuity,
+		Sizes:         job.sizes,
+	})
+	if len(m.segments) > MANIFEST_SEGMENTS {
+		m.segments = m.segments[len(m.segments)-MANIFEST_SEGMENTS:]
+	}
+
+	//The ladder is that of the current ingest
+	levels := []ManifestLevel{{Level: 0, Codec: job.source.codec, Resolution: job.source.resolution, Framerate: job.source.framerate}}
+	for i, t := range job.source.transcoders {
+		levels = append(levels, ManifestLevel{Level: i + 1, Codec: t.Codec, Resolution: t.Resolution, Framerate: t.Framerate})
+	}
+	for i := range levels {
+		levels[i].Bandwidth = m.bandwidth(i)
+	}
+	m.levels = levels
+}
+
+// bandwidth averages the bitrate of a level over the listed segments with a known duration that have the level,
+// the lock must be held
+func (m *liveManifest) bandwidth(level int) int {
+	bytes, durationMs := 0, 0
+	for _, segment := range m.segments {
+		if level < len(segment.Sizes) && segment.Sizes[level] > 0 && segment.DurationMs > 0 {
+			bytes += segment.Sizes[level]
+			durationMs += segment.DurationMs
+		}
+	}
+	if durationMs == 0 {
+		return 0
+	}
+	return bytes * 8 * 1000 / durationMs
+}
+
+func (m *liveManifest) snapshot() Manifest {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	manifest := Manifest{
+		Levels:   append([]ManifestLevel{}, m.levels...),
+		Segments: append([]ManifestSegment{}, m.segments...),
+	}
+	if len(m.segments) > 0 {
+		manifest.Sequence = m.segments[0].Id
+	}
+	for _, segment := range m.segments {
+		manifest.TargetDurationMs = max(manifest.TargetDurationMs, segment.DurationMs)
+	}
+	return manifest
+}
+
+// publishManifest sends the manifest to all viewers of the versioned protocol, legacy viewers do not know the message
+func (s *Streamer) publishManifest() {
+	body, err := json.Marshal(s.manifest.snapshot())
+	if err != nil {
+		log.Println("error on creating manifest", err.Error())
+		return
+	}
+	envelope, err := json.Marshal(Envelope{V: ProtocolVersion, Type: RequestManifest, Body: body})
+	if err != nil {
+		log.Println("error on creating manifest", err.Error())
+		return
+	}
+	s.publishTextTo(ChunkHeaderV2, string(envelope))
+}
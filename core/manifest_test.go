@@ -0,0 +1,34 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestManifestLevelCodecs(t *testing.T) {
+	//The source keeps its codec, transcoded levels have that of the transcoder
+	transcoder := NewFakeTranscoder()
+	transcoder.OutputCodec = "vp9"
+	s := NewStreamer(WithTranscoder(transcoder))
+	config := &ChannelConfig{Transcoders: []string{"720p30", "480p30"}}
+	source := &sourceInfo{codec: "hevc", resolution: 1080, framerate: 30}
+	source.transcoders = s.getTranscoders(config, source.resolution, source.framerate)
+
+	m := newLiveManifest()
+	m.add(&segmentJob{id: 0, source: source, sizes: []int{4000, 2000, 1000}, timing: segmentTiming{duration: 2 * time.Second}})
+
+	levels := m.snapshot().Levels
+	want := []ManifestLevel{
+		{Level: 0, Codec: "hevc", Resolution: 1080, Framerate: 30, Bandwidth: 16000},
+		{Level: 1, Codec: "vp9", Resolution: 720, Framerate: 30, Bandwidth: 8000},
+		{Level: 2, Codec: "vp9", Resolution: 480, Framerate: 30, Bandwidth: 4000},
+	}
+	if len(levels) != len(want) {
+		t.Fatalf("levels = %+v, want %+v", levels, want)
+	}
+	for i := range want {
+		if levels[i] != want[i] {
+			t.Fatalf("level %d = %+v, want %+v", i, levels[i], want[i])
+		}
+	}
+}
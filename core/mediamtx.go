@@ -0,0 +1,156 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	mtx "github.com/bluenviron/mediamtx/core"
+)
+
+// MediaMTX parses its arguments into a package global, creating cores must not happen concurrently
+var mtxNewMutex sync.Mutex
+
+// newMediaMTX creates a core, settings override the config file through MTX_ environment variables of this core only
+func newMediaMTX(configPath string, settings map[string]string, publishTSPart func([]byte)) (*mtx.Core, bool) {
+	mtxNewMutex.Lock()
+	defer mtxNewMutex.Unlock()
+
+	for key, value := range settings {
+		name := "MTX_" + strings.ToUpper(key)
+		previous, existed := os.LookupEnv(name)
+		os.Setenv(name, value)
+
+		defer func() {
+			if existed {
+				os.Setenv(name, previous)
+			} else {
+				os.Unsetenv(name)
+			}
+		}()
+	}
+
+	args := []string{}
+	if configPath != "" {
+		args = append(args, configPath)
+	}
+	return mtx.New(args, publishTSPart)
+}
+
+var pathsSectionRegex = regexp.MustCompile(`(?m)^paths:`)
+
+// topLevelKeyRegex matches the start of a top level key, indented lines and comments belong to the section above
+var topLevelKeyRegex = regexp.MustCompile(`(?m)^[^\s#]`)
+
+// removePathsSection removes the paths section and keeps the sections that follow it
+func removePathsSection(config string) string {
+	start := pathsSectionRegex.FindStringIndex(config)
+	if start == nil {
+		return config
+	}
+
+	end := len(config)
+	if next := topLevelKeyRegex.FindStringIndex(config[start[1]:]); next != nil {
+		end = start[1] + next[0]
+	}
+	return config[:start[0]] + config[end:]
+}
+
+// overrideMediaMTXConfig replaces top level settings of a MediaMTX config and, when paths is not nil,
+// replaces the paths section with the given path names and their settings.
+func overrideMediaMTXConfig(base string, settings map[string]string, paths map[string]map[string]string) string {
+	keys := make([]string, 0, len(settings))
+	for k := range settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	config := base
+	for _, key := range keys {
+		line := key + ": " + settings[key]
+		keyRegex := regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(key) + `:.*$`)
+		if keyRegex.MatchString(config) {
+			config = keyRegex.ReplaceAllLiteralString(config, line)
+		} else {
+			config = line + "\n" + config
+		}
+	}
+
+	if paths == nil {
+		return config
+	}
+
+	var section strings.Builder
+	section.WriteString("paths:\n")
+
+	names := make([]string, 0, len(paths))
+	for name := range paths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		section.WriteString("  " + strconv.Quote(name) + ":\n")
+
+		pathKeys := make([]string, 0, len(paths[name]))
+		for k := range paths[name] {
+			pathKeys = append(pathKeys, k)
+		}
+		sort.Strings(pathKeys)
+
+		for _, k := range pathKeys {
+			section.WriteString("    " + k + ": " + paths[name][k] + "\n")
+		}
+	}
+
+	config = removePathsSection(config)
+	return strings.TrimRight(config, "\n") + "\n\n" + section.String()
+}
+
+// mediaMTXSetting reads a top level setting from a MediaMTX config
+func mediaMTXSetting(config string, key string) (string, bool) {
+	keyRegex := regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(key) + `:[ \t]*(.*)$`)
+	match := keyRegex.FindStringSubmatch(config)
+	if match == nil {
+		return "", false
+	}
+	return strings.Trim(strings.TrimSpace(match[1]), `"'`), true
+}
+
+// rtmpListenAddress is the explicit address if set, otherwise the one from the MediaMTX config file
+func rtmpListenAddress(explicit string, configPath string) string {
+	if explicit != "" {
+		return explicit
+	}
+
+	if configPath == "" {
+		configPath = "mediamtx.yml"
+	}
+	if config, err := os.ReadFile(configPath); err == nil {
+		if address, ok := mediaMTXSetting(string(config), "rtmpAddress"); ok && address != "" {
+			return address
+		}
+	}
+	return ":1935"
+}
+
+// loopbackAddress turns a listen address like ":1935" into one that can be dialed locally
+func loopbackAddress(listenAddress string) (string, error) {
+	host, port, err := net.SplitHostPort(listenAddress)
+	if err != nil {
+		return "", fmt.Errorf("invalid address %q: %w", listenAddress, err)
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+func writeMediaMTXConfig(path string, config string) error {
+	return os.WriteFile(path, []byte(config), 0644)
+}
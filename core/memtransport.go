@@ -0,0 +1,244 @@
+package core
+
+import (
+	"encoding/hex"
+	"regexp"
+	"sync"
+
+	"github.com/nknorg/nkn-sdk-go"
+)
+
+// Matches the sub client identifier a multiclient address may be prefixed with
+var subClientPrefixRegex = regexp.MustCompile(`^__\d+__\.`)
+
+// Number of message ids an endpoint remembers to drop duplicates, like a multiclient does
+const memoryDedupSize = 4096
+
+// MemoryNetwork is an in-process network that delivers messages between MemoryTransports.
+// It allows hosts and viewers to run end-to-end without any network access.
+type MemoryNetwork struct {
+	mu          sync.RWMutex
+	endpoints   map[string]*MemoryTransport
+	subscribers map[string]map[string]string
+}
+
+// MemoryTransport is an endpoint on a MemoryNetwork
+type MemoryTransport struct {
+	network       *MemoryNetwork
+	address       string
+	numSubClients int
+	onConnect     chan struct{}
+	messages      chan *InboundMessage
+
+	mu               sync.Mutex
+	closed           bool
+	closedSubClients map[int]bool
+	seen             map[string]struct{}
+	seenOrder        []string
+}
+
+type memoryRecipients []string
+
+func (r memoryRecipients) Len() int {
+	return len(r)
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		endpoints:   make(map[string]*MemoryTransport),
+		subscribers: make(map[string]map[string]string),
+	}
+}
+
+// NewTransport joins the network with the public key of the account as address, it is a TransportFactory
+func (n *MemoryNetwork) NewTransport(account *nkn.Account, numSubClients int) (Transport, error) {
+	return n.Join(hex.EncodeToString(account.PubKey()), numSubClients), nil
+}
+
+// Join adds an endpoint with the given address to the network, all of its sub clients are connected immediately
+func (n *MemoryNetwork) Join(address string, numSubClients int) *MemoryTransport {
+	t := &MemoryTransport{
+		network:          n,
+		address:          address,
+		numSubClients:    numSubClients,
+		onConnect:        make(chan struct{}, numSubClients),
+		messages:         make(chan *InboundMessage, 1024),
+		closedSubClients: make(map[int]bool),
+		seen:             make(map[string]struct{}),
+	}
+
+	for i := 0; i < numSubClients; i++ {
+		t.onConnect <- struct{}{}
+	}
+
+	n.mu.Lock()
+	n.endpoints[address] = t
+	n.mu.Unlock()
+
+	return t
+}
+
+// Subscribers returns the addresses subscribed to a topic with their metadata
+func (n *MemoryNetwork) Subscribers(topic string) map[string]string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	subscribers := make(map[string]string, len(n.subscribers[topic]))
+	for address, meta := range n.subscribers[topic] {
+		subscribers[address] = meta
+	}
+	return subscribers
+}
+
+func (n *MemoryNetwork) deliver(src string, dest string, payload *Payload) {
+	n.mu.RLock()
+	endpoint, ok := n.endpoints[dest]
+	if !ok {
+		endpoint, ok = n.endpoints[subClientPrefixRegex.ReplaceAllString(dest, "")]
+	}
+	n.mu.RUnlock()
+
+	if ok {
+		endpoint.receive(src, payload)
+	}
+}
+
+func (t *MemoryTransport) receive(src string, payload *Payload) {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+
+	//Replies carry the id of the message they answer
+	id := string(payload.MessageID)
+	if len(payload.MessageID) == 0 {
+		id = "reply:" + string(payload.ReplyToID)
+	}
+	if _, dup := t.seen[id]; dup {
+		t.mu.Unlock()
+		return
+	}
+	t.seen[id] = struct{}{}
+	t.seenOrder = append(t.seenOrder, id)
+	if len(t.seenOrder) > memoryDedupSize {
+		delete(t.seen, t.seenOrder[0])
+		t.seenOrder = t.seenOrder[1:]
+	}
+	t.mu.Unlock()
+
+	msg := &InboundMessage{
+		Src:       src,
+		Data:      payload.Data,
+		MessageID: payload.MessageID,
+		ReplyToID: payload.ReplyToID,
+		//Like NKN, only replies may be acknowledged
+		NoReply: len(payload.ReplyToID) == 0,
+	}
+
+	//Like the real network, a receiver that does not keep up loses messages
+	select {
+	case t.messages <- msg:
+	default:
+	}
+}
+
+func (t *MemoryTransport) Address() string {
+	return t.address
+}
+
+func (t *MemoryTransport) NumSubClients() int {
+	return t.numSubClients
+}
+
+func (t *MemoryTransport) OnConnect() <-chan struct{} {
+	return t.onConnect
+}
+
+func (t *MemoryTransport) SubClientClosed(i int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closed || i < 0 || i >= t.numSubClients || t.closedSubClients[i]
+}
+
+// CloseSubClient simulates the failure of a single sub client
+func (t *MemoryTransport) CloseSubClient(i int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closedSubClients[i] = true
+}
+
+// Reconnect reopens a sub client closed with CloseSubClient
+func (t *MemoryTransport) Reconnect(i int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed || i < 0 || i >= t.numSubClients {
+		return ErrSubClientUnavailable
+	}
+	if t.closedSubClients[i] {
+		delete(t.closedSubClients, i)
+		select {
+		case t.onConnect <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (t *MemoryTransport) Recipients(addresses ...string) Recipients {
+	return memoryRecipients(append([]string(nil), addresses...))
+}
+
+func (t *MemoryTransport) Send(subClient int, to Recipients, payload *Payload) error {
+	if t.SubClientClosed(subClient) {
+		t.mu.Lock()
+		closed := t.closed
+		t.mu.Unlock()
+		if closed {
+			return ErrTransportClosed
+		}
+		return ErrSubClientUnavailable
+	}
+
+	for _, dest := range to.(memoryRecipients) {
+		t.network.deliver(t.address, dest, payload)
+	}
+	return nil
+}
+
+func (t *MemoryTransport) Messages() <-chan *InboundMessage {
+	return t.messages
+}
+
+func (t *MemoryTransport) Subscribe(topic string, duration int, meta string) error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+
+	if t.network.subscribers[topic] == nil {
+		t.network.subscribers[topic] = make(map[string]string)
+	}
+	t.network.subscribers[topic][t.address] = meta
+	return nil
+}
+
+func (t *MemoryTransport) Unsubscribe(topic string) error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+
+	delete(t.network.subscribers[topic], t.address)
+	return nil
+}
+
+func (t *MemoryTransport) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+
+	t.network.mu.Lock()
+	if t.network.endpoints[t.address] == t {
+		delete(t.network.endpoints, t.address)
+	}
+	t.network.mu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,195 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// testViewer is a viewer on a memory network speaking the v2 control protocol
+type testViewer struct {
+	t         *testing.T
+	transport *MemoryTransport
+	host      Recipients
+	chunks    map[int][][]byte
+}
+
+// joinTestViewer adds a viewer with a single client, messages to any of its sub clients reach it
+func joinTestViewer(t *testing.T, network *MemoryNetwork, address string, host string) *testViewer {
+	transport := network.Join(address, 1)
+	t.Cleanup(func() { transport.Close() })
+
+	return &testViewer{
+		t:         t,
+		transport: transport,
+		host:      transport.Recipients(host),
+		chunks:    make(map[int][][]byte),
+	}
+}
+
+func (v *testViewer) request(id string, requestType string) []byte {
+	v.t.Helper()
+
+	data, err := json.Marshal(Envelope{V: ProtocolVersion, ID: id, Type: requestType})
+	if err != nil {
+		v.t.Fatal(err)
+	}
+	return v.send(data)
+}
+
+// call sends a request with the body and waits for the reply envelope
+func (v *testViewer) call(requestType string, body any) Envelope {
+	v.t.Helper()
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		v.t.Fatal(err)
+	}
+	request, err := json.Marshal(Envelope{V: ProtocolVersion, ID: requestType, Type: requestType, Body: data})
+	if err != nil {
+		v.t.Fatal(err)
+	}
+
+	var response Envelope
+	if err := json.Unmarshal(v.reply(v.send(request)), &response); err != nil {
+		v.t.Fatalf("decoding reply to %s: %v", requestType, err)
+	}
+	return response
+}
+
+// send sends raw data to the host and returns the message id replies refer to
+func (v *testViewer) send(data []byte) []byte {
+	v.t.Helper()
+
+	payload := newPayload(PayloadText, data)
+	if err := v.transport.Send(0, v.host, payload); err != nil {
+		v.t.Fatalf("sending %q: %v", data, err)
+	}
+	return payload.MessageID
+}
+
+// reply waits for the reply to the message with the id
+func (v *testViewer) reply(messageId []byte) []byte {
+	v.t.Helper()
+
+	var data []byte
+	v.receive("a reply", func(msg *InboundMessage) bool {
+		data = msg.Data
+		return bytes.Equal(msg.ReplyToID, messageId)
+	})
+	return data
+}
+
+// receive handles messages until handle returns true, chunks are kept by segment id
+func (v *testViewer) receive(what string, handle func(msg *InboundMessage) bool) {
+	v.t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-v.transport.Messages():
+			if len(msg.Data) > 0 && msg.Data[0] == ChunkHeaderV2 {
+				if h, _, err := ParseChunkHeader(msg.Data); err == nil {
+					v.chunks[int(h.SegmentId)] = append(v.chunks[int(h.SegmentId)], msg.Data)
+				}
+			}
+			if handle(msg) {
+				return
+			}
+		case <-timeout:
+			v.t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// segment reassembles a segment once all of its chunks arrived
+func (v *testViewer) segment(id int) []byte {
+	segment, err := ReassembleSegment(v.chunks[id])
+	if err != nil {
+		return nil
+	}
+	return segment
+}
+
+func TestMemoryTransportNoReply(t *testing.T) {
+	network := NewMemoryNetwork()
+	host := network.Join("host", 1)
+	viewer := network.Join("viewer", 1)
+	defer host.Close()
+	defer viewer.Close()
+
+	//Like NKN, messages are fire and forget and only replies may be acknowledged
+	message := newPayload(PayloadText, []byte("message"))
+	if err := viewer.Send(0, viewer.Recipients("host"), message); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-host.Messages(); !msg.NoReply || msg.ReplyToID != nil {
+		t.Fatalf("message = %+v, want no reply", msg)
+	}
+
+	reply := newReplyPayload(PayloadText, []byte("reply"), message.MessageID)
+	if err := host.Send(0, host.Recipients("viewer"), reply); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-viewer.Messages(); msg.NoReply || !bytes.Equal(msg.ReplyToID, message.MessageID) {
+		t.Fatalf("reply = %+v, want a reply to %x", msg, message.MessageID)
+	}
+}
+
+func TestViewerOnMemoryNetwork(t *testing.T) {
+	network := NewMemoryNetwork()
+	s := newTestStreamer(t, network, NewFakeTranscoder())
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	//Viewers can only join a live stream
+	first := make([]byte, 3*CHUNK_SIZE/2)
+	rand.Read(first)
+	s.publishTSPart(first)
+	waitFor(t, 5*time.Second, "the stream to go live", func() bool { return s.State() == StateLive })
+
+	viewer := joinTestViewer(t, network, "viewer", s.ClientAddress())
+	viewer.request("", RequestPing)
+	waitFor(t, 5*time.Second, "the viewer to join", func() bool { return s.viewers.Count() == 1 })
+
+	//A new viewer gets the last segment right away
+	viewer.receive("the last segment", func(*InboundMessage) bool { return viewer.segment(0) != nil })
+	if !bytes.Equal(viewer.segment(0), first) {
+		t.Fatal("last segment differs from the published one")
+	}
+
+	next := make([]byte, 3*CHUNK_SIZE/2)
+	rand.Read(next)
+	s.publishTSPart(next)
+	viewer.receive("the next segment", func(*InboundMessage) bool { return viewer.segment(1) != nil })
+	if !bytes.Equal(viewer.segment(1), next) {
+		t.Fatal("next segment differs from the published one")
+	}
+
+	requestId := viewer.request("1", RequestViewCount)
+	viewer.receive("the view count", func(msg *InboundMessage) bool {
+		if !bytes.Equal(msg.ReplyToID, requestId) {
+			return false
+		}
+
+		var response Envelope
+		if err := json.Unmarshal(msg.Data, &response); err != nil {
+			t.Fatalf("decoding reply: %v", err)
+		}
+		if response.ID != "1" || response.Type != RequestViewCount || response.Error != nil {
+			t.Fatalf("reply = %+v, want the view count", response)
+		}
+
+		var viewCount ViewCountResponse
+		if err := json.Unmarshal(response.Body, &viewCount); err != nil {
+			t.Fatalf("decoding view count: %v", err)
+		}
+		if viewCount.Viewers != 1 {
+			t.Fatalf("viewers = %d, want 1", viewCount.Viewers)
+		}
+		return true
+	})
+}
@@ -0,0 +1,258 @@
+package core
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+	"sync"
+)
+
+// Consecutive incomplete segments reported by the targets of a forwarder before it stops forwarding
+const MESH_MAX_FAILURES = 3
+
+// meshMember is a viewer that opted in to receive chunks from other viewers, and possibly to forward them
+type meshMember struct {
+	forward  bool
+	capacity int
+	failures int
+	//Demoted forwarders do not forward again until they rejoin the stream
+	demoted bool
+	//Quality group of the last route
+	level int
+
+	//Current assignment, a forwarder has targets and a target has a forwarder
+	forwarder string
+	targets   []string
+}
+
+// meshState assigns forwarding viewers to other viewers of the same quality level. The host sends a chunk to a
+// forwarder once and the forwarder sends it on to its targets, the targets report whether segments arrived complete.
+type meshState struct {
+	mu      sync.Mutex
+	config  MeshConfig
+	members map[string]*meshMember
+	dirty   bool
+}
+
+func newMeshState(config MeshConfig) *meshState {
+	if config.FanOut <= 0 {
+		config.FanOut = 4
+	}
+	return &meshState{
+		config:  config,
+		members: make(map[string]*meshMember),
+	}
+}
+
+// join adds a viewer to the mesh, forwarders serve up to capacity other viewers
+func (m *meshState) join(address string, forward bool, capacity int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	member, ok := m.members[address]
+	if !ok {
+		member = &meshMember{}
+		m.members[address] = member
+	}
+	forward = forward && capacity > 0 && !member.demoted
+	if member.forward != forward || member.capacity != capacity {
+		member.forward = forward
+		member.capacity = capacity
+		m.dirty = true
+	}
+}
+
+// report counts a segment a target received complete or not against its forwarder,
+// a forwarder that keeps failing its targets is demoted to a regular viewer
+func (m *meshState) report(address string, complete bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	target, ok := m.members[address]
+	if !ok || target.forwarder == "" {
+		return
+	}
+	forwarder, ok := m.members[target.forwarder]
+	if !ok {
+		return
+	}
+
+	if complete {
+		forwarder.failures = 0
+		return
+	}
+
+	forwarder.failures++
+	if forwarder.failures >= MESH_MAX_FAILURES && forwarder.forward {
+		log.Println("mesh: forwarder failing its viewers, reassigning:", target.forwarder)
+		forwarder.forward = false
+		forwarder.demoted = true
+		m.dirty = true
+	}
+}
+
+// route assigns forwarders within every quality group and removes the viewers a forwarder serves from the groups,
+// it returns the groups the host sends to and the members whose assignment changed
+func (m *meshState) route(groups [][]string) ([][]string, map[string]MeshAssignment) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	//Members that left, or moved to another level, are reassigned
+	level := make(map[string]int)
+	total := 0
+	for l, group := range groups {
+		for _, address := range group {
+			level[address] = l
+		}
+		total += len(group)
+	}
+	for address := range m.members {
+		if _, ok := level[address]; !ok {
+			delete(m.members, address)
+			m.dirty = true
+		}
+	}
+	for address, member := range m.members {
+		if member.level != level[address] || (member.forwarder != "" && m.members[member.forwarder] == nil) {
+			member.level = level[address]
+			m.dirty = true
+		}
+	}
+
+	var changes map[string]MeshAssignment
+	if m.dirty {
+		changes = m.assign(groups, total >= m.config.MinViewers)
+		m.dirty = false
+	}
+
+	routed := make([][]string, len(groups))
+	for l, group := range groups {
+		routed[l] = make([]string, 0, len(group))
+		for _, address := range group {
+			if member, ok := m.members[address]; !ok || member.forwarder == "" {
+				routed[l] = append(routed[l], address)
+			}
+		}
+	}
+	return routed, changes
+}
+
+// assign rebuilds all assignments, keeping existing ones where possible, the lock must be held
+func (m *meshState) assign(groups [][]string, active bool) map[string]MeshAssignment {
+	previous := make(map[string]MeshAssignment, len(m.members))
+	for address, member := range m.members {
+		previous[address] = MeshAssignment{Forwarder: member.forwarder, Targets: member.targets}
+		member.targets = nil
+	}
+
+	for _, group := range groups {
+		var forwarders, targets []string
+		for _, address := range group {
+			member, ok := m.members[address]
+			if !ok {
+				continue
+			}
+			if member.forward {
+				forwarders = append(forwarders, address)
+			} else {
+				targets = append(targets, address)
+			}
+		}
+		slices.Sort(forwarders)
+		slices.Sort(targets)
+
+		capacity := func(address string) int {
+			return min(m.members[address].capacity, m.config.FanOut)
+		}
+
+		//Keep targets with their forwarder, then fill the forwarders with the fewest targets
+		var unassigned []string
+		for _, address := range targets {
+			target := m.members[address]
+			forwarder := target.forwarder
+			target.forwarder = ""
+
+			if active && slices.Contains(forwarders, forwarder) && len(m.members[forwarder].targets) < capacity(forwarder) {
+				target.forwarder = forwarder
+				m.members[forwarder].targets = append(m.members[forwarder].targets, address)
+			} else {
+				unassigned = append(unassigned, address)
+			}
+		}
+
+		for _, address := range unassigned {
+			if !active {
+				break
+			}
+
+			best := ""
+			for _, forwarder := range forwarders {
+				if len(m.members[forwarder].targets) >= capacity(forwarder) {
+					continue
+				}
+				if best == "" || len(m.members[forwarder].targets) < len(m.members[best].targets) {
+					best = forwarder
+				}
+			}
+			if best == "" {
+				break
+			}
+
+			m.members[address].forwarder = best
+			m.members[best].targets = append(m.members[best].targets, address)
+		}
+
+		for _, forwarder := range forwarders {
+			m.members[forwarder].forwarder = ""
+		}
+	}
+
+	changes := make(map[string]MeshAssignment)
+	for address, member := range m.members {
+		assignment := MeshAssignment{Forwarder: member.forwarder, Targets: member.targets}
+		if was := previous[address]; was.Forwarder != assignment.Forwarder || !slices.Equal(was.Targets, assignment.Targets) {
+			changes[address] = assignment
+		}
+	}
+	return changes
+}
+
+// pending reports whether assignments changed since the last route
+func (m *meshState) pending() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.dirty
+}
+
+// forwarded is the number of viewers that currently receive chunks from a forwarder
+func (m *meshState) forwarded() int {
+	if m == nil {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := 0
+	for _, member := range m.members {
+		if member.forwarder != "" {
+			count++
+		}
+	}
+	return count
+}
+
+// meshRoute leaves viewers served by a forwarder out of the quality groups and tells members about new assignments
+func (s *Streamer) meshRoute(groups [][]string) [][]string {
+	routed, changes := s.mesh.route(groups)
+
+	for address, assignment := range changes {
+		body, _ := json.Marshal(assignment)
+		envelope, err := json.Marshal(Envelope{V: ProtocolVersion, Type: RequestMeshAssign, Body: body})
+		if err != nil {
+			log.Println("error on creating mesh assignment", err.Error())
+			continue
+		}
+		s.sendToClient(address, envelope)
+	}
+	return routed
+}
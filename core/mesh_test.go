@@ -0,0 +1,119 @@
+package core
+
+import (
+	"slices"
+	"testing"
+)
+
+// routeTestMesh joins the forwarders with their capacity and the viewers, and routes them as a single quality group
+func routeTestMesh(m *meshState, forwarders map[string]int, viewers []string) ([]string, map[string]MeshAssignment) {
+	group := slices.Clone(viewers)
+	for address, capacity := range forwarders {
+		m.join(address, true, capacity)
+		group = append(group, address)
+	}
+	for _, address := range viewers {
+		m.join(address, false, 0)
+	}
+	slices.Sort(group)
+
+	routed, changes := m.route([][]string{group})
+	return routed[0], changes
+}
+
+func TestMeshForwarderCapacity(t *testing.T) {
+	m := newMeshState(MeshConfig{FanOut: 3})
+	viewers := []string{"v1", "v2", "v3", "v4", "v5", "v6"}
+	routed, changes := routeTestMesh(m, map[string]int{"f1": 1, "f2": 10}, viewers)
+
+	//f2 is limited by the fan out, the viewers no forwarder has room for are served by the host
+	if targets := len(changes["f1"].Targets); targets != 1 {
+		t.Fatalf("f1 forwards to %d viewers, want its capacity 1", targets)
+	}
+	if targets := len(changes["f2"].Targets); targets != 3 {
+		t.Fatalf("f2 forwards to %d viewers, want the fan out 3", targets)
+	}
+	if want := []string{"f1", "f2", "v5", "v6"}; !slices.Equal(routed, want) {
+		t.Fatalf("host sends to %v, want %v", routed, want)
+	}
+	for _, forwarder := range []string{"f1", "f2"} {
+		for _, target := range changes[forwarder].Targets {
+			if changes[target].Forwarder != forwarder {
+				t.Fatalf("%s is a target of %s, but was assigned %q", target, forwarder, changes[target].Forwarder)
+			}
+		}
+	}
+	if m.forwarded() != 4 {
+		t.Fatalf("forwarded = %d, want 4", m.forwarded())
+	}
+}
+
+func TestMeshFallsBackToHost(t *testing.T) {
+	//Below the minimum number of viewers no forwarders are assigned
+	m := newMeshState(MeshConfig{MinViewers: 10})
+	viewers := []string{"v1", "v2"}
+	routed, _ := routeTestMesh(m, map[string]int{"f1": 4}, viewers)
+	if want := []string{"f1", "v1", "v2"}; !slices.Equal(routed, want) {
+		t.Fatalf("host sends to %v, want %v", routed, want)
+	}
+
+	//Forwarders only serve viewers of their own quality level
+	m = newMeshState(MeshConfig{})
+	m.join("f1", true, 4)
+	m.join("v1", false, 0)
+	routed2, changes := m.route([][]string{{"f1"}, {"v1"}})
+	if !slices.Equal(routed2[1], []string{"v1"}) || len(changes["f1"].Targets) != 0 {
+		t.Fatalf("host sends to %v, f1 forwards to %v, want v1 served by the host", routed2, changes["f1"].Targets)
+	}
+
+	//A viewer whose forwarder left receives from the host again
+	routed2, _ = m.route([][]string{{"f1", "v1"}})
+	if !slices.Equal(routed2[0], []string{"f1"}) {
+		t.Fatalf("host sends to %v, want v1 served by f1", routed2[0])
+	}
+	routed2, changes = m.route([][]string{{"v1"}})
+	if !slices.Equal(routed2[0], []string{"v1"}) || changes["v1"].Forwarder != "" {
+		t.Fatalf("host sends to %v, v1 assigned %+v, want v1 served by the host", routed2[0], changes["v1"])
+	}
+}
+
+func TestMeshReportMovesViewer(t *testing.T) {
+	m := newMeshState(MeshConfig{})
+	viewers := []string{"v1", "v2"}
+	_, changes := routeTestMesh(m, map[string]int{"f1": 1, "f2": 3}, viewers)
+	target := changes["f1"].Targets[0]
+
+	//A complete segment resets the failures of the forwarder
+	for i := 0; i < MESH_MAX_FAILURES-1; i++ {
+		m.report(target, false)
+	}
+	m.report(target, true)
+	for i := 0; i < MESH_MAX_FAILURES-1; i++ {
+		m.report(target, false)
+	}
+	if m.pending() {
+		t.Fatal("forwarder demoted without failing in a row")
+	}
+
+	m.report(target, false)
+	if !m.pending() {
+		t.Fatalf("forwarder not demoted after %d incomplete segments", MESH_MAX_FAILURES)
+	}
+	routed, changes := m.route([][]string{{"f1", "f2", "v1", "v2"}})
+	if changes[target].Forwarder != "f2" {
+		t.Fatalf("%s assigned %+v, want it moved to f2", target, changes[target])
+	}
+	if changes["f1"].Targets != nil {
+		t.Fatalf("demoted f1 forwards to %v", changes["f1"].Targets)
+	}
+	//The demoted forwarder is a regular viewer now, served by f2 as well
+	if !slices.Equal(routed[0], []string{"f2"}) || changes["f1"].Forwarder != "f2" {
+		t.Fatalf("host sends to %v, f1 assigned %+v, want everyone served by f2", routed[0], changes["f1"])
+	}
+
+	//Demoted forwarders do not forward again by rejoining
+	m.join("f1", true, 1)
+	if m.members["f1"].forward {
+		t.Fatal("demoted forwarder forwards again")
+	}
+}
@@ -1,14 +1,16 @@
 package core
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-
-	"github.com/nknorg/nkn-sdk-go"
+	"log"
+	"slices"
+	"sort"
+	"strconv"
 )
 
-var chatId uint64 = 0
-
 // Message struct represents a generic message with a type and content
 type Message struct {
 	Type    string          `json:"type"`
@@ -27,65 +29,383 @@ type DeleteChatMessage struct {
 	MsgId uint64 `json:"msgId,string"`
 }
 
-func (s *Streamer) DecodeMessage(receivedMessage *nkn.Message) {
-	// Unmarshal the JSON into a Message struct
-	var msg Message
-	if err := json.Unmarshal(receivedMessage.Data, &msg); err != nil {
-		fmt.Println("Error deserializing JSON:", err)
+// handleMessage answers a request of a viewer, see protocol.go for the message formats
+func (s *Streamer) handleMessage(ctx context.Context, msg *InboundMessage) {
+	req, err := decodeRequest(msg)
+	if err != nil {
+		var protocolErr *ProtocolError
+		if errors.As(err, &protocolErr) {
+			s.respondError(&controlRequest{msg: msg}, protocolErr.Code, protocolErr.Message)
+		} else {
+			fmt.Println("Unknown message:", err, "content:", string(msg.Data))
+		}
+		return
+	}
+
+	if req.legacy && !s.legacyProtocol {
+		fmt.Println("Ignoring legacy request:", req.typ)
+		return
+	}
+
+	if req.version > ProtocolVersion {
+		s.respondError(req, ErrorUnsupportedVersion, fmt.Sprintf("protocol version %d is not supported, newest is %d", req.version, ProtocolVersion))
+		return
+	}
+
+	switch req.typ {
+	case RequestHello:
+		s.handleHello(req)
+		return
+	//Always reply to panel, this can be displayed when we are not broadcasting.
+	case RequestPanels:
+		s.respond(req, PanelsResponse{Panels: s.getPanels()})
+		return
+	//Always reply to channel info, this can be displayed when we are not broadcasting.
+	case RequestChannelInfo:
+		s.respond(req, s.channelInfo(msg.Src))
 		return
 	}
 
-	// Handle the message based on its type
-	switch msg.Type {
-	case "chat-message":
-		chatMsg := &ChatMessage{
-			Src: receivedMessage.Src,
+	//If we're not broadcasting don't reply to anything else.
+	if !s.isBroadcasting() {
+		s.respondError(req, ErrorNotLive, "stream is not live")
+		return
+	}
+
+	//Chat and donations belong to the origin, a relay only passes them on
+	if s.isRelay() && (req.typ == RequestChat || req.typ == RequestDeleteChat || req.typ == RequestDonationId) {
+		s.respondError(req, ErrorForbidden, "send chat messages to the origin "+s.relay.origin)
+		return
+	}
+
+	switch req.typ {
+	case RequestPing:
+		//Private streams only send segments to viewers that can decrypt them
+		if !s.canWatch(msg.Src) {
+			s.respondError(req, ErrorForbidden, "no access to this private stream")
+			return
 		}
-		if err := json.Unmarshal(msg.Content, &chatMsg); err != nil {
-			fmt.Println("Error unmarshalling message content:", err)
+		var ping PingRequest
+		if err := req.decodeBody(&ping); err != nil {
+			s.respondError(req, ErrorBadRequest, err.Error())
 			return
 		}
-		s.HandleChatMessage(chatMsg, receivedMessage)
-	case "delete-chat-message":
-		{
-			if receivedMessage.Src == s.config.Owner {
-				var deleteMsg DeleteChatMessage
-				if err := json.Unmarshal(msg.Content, &deleteMsg); err != nil {
-					fmt.Println("Error unmarshalling message content:", err)
-					return
-				}
-
-				s.publishText(string(receivedMessage.Data))
+		chunkHeader := chunkHeaderFor(req.version)
+		isNew := s.viewers.AddOrUpdateAddress(msg.Src, chunkHeader)
+		if ping.SubClients != nil {
+			s.viewers.SetSubClients(msg.Src, min(max(*ping.SubClients, 0), MAX_VIEWER_SUB_CLIENTS))
+		}
+		if ping.Received > 0 || ping.Lost > 0 {
+			s.viewers.ReportDelivery(msg.Src, max(ping.Received, 0), max(ping.Lost, 0), max(ping.Late, 0))
+		}
+		//Send last segment to newly joined
+		if isNew {
+			log.Println("viewer joined: ", msg.Src)
+			for _, chunk := range s.getLastSegment(chunkHeader) {
+				s.sendToClient(msg.Src, chunk)
 			}
 		}
+	case RequestDisconnect:
+		s.viewers.Remove(msg.Src)
+	case RequestThumbnail:
+		//Thumbnails of private streams would show what is streamed
+		if !s.canWatch(msg.Src) {
+			s.respondError(req, ErrorForbidden, "private stream")
+			return
+		}
+		s.respond(req, ThumbnailResponse{Image: s.getThumbnail()})
+	case RequestViewCount:
+		s.respond(req, ViewCountResponse{Viewers: s.viewers.Count()})
+	case RequestDonationId:
+		s.respond(req, DonationIdResponse{DonationId: s.donations.generate()})
+	case RequestQuality:
+		var quality QualityRequest
+		if err := req.decodeBody(&quality); err != nil {
+			s.respondError(req, ErrorBadRequest, err.Error())
+			return
+		}
+		s.viewers.SetQuality(msg.Src, quality.Level)
+		s.respond(req, QualityResponse{SegmentId: s.getNextSegmentId()})
+	case RequestMissing:
+		s.handleMissingChunks(req)
+	case RequestRelay:
+		if !matchesAddress(s.config.Relays, msg.Src) || s.isPrivate() {
+			s.respondError(req, ErrorForbidden, "not a relay of this channel")
+			return
+		}
+		if s.viewers.AddOrUpdateAddress(msg.Src, ChunkHeaderV2) {
+			log.Println("relay joined: ", msg.Src)
+		}
+		s.viewers.SetRelay(msg.Src)
+		s.respond(req, RelayResponse{})
+	case RequestManifest:
+		s.respond(req, s.manifest.snapshot())
+	case RequestMesh, RequestMeshReport:
+		s.handleMesh(req)
+	case RequestContentKey:
+		s.handleContentKey(req)
+	case RequestGrant, RequestRevoke:
+		s.handleAccess(req)
+	case RequestChat:
+		chatMsg := &ChatMessage{}
+		if err := req.decodeBody(chatMsg); err != nil {
+			fmt.Println("Error unmarshalling message content:", err)
+			s.respondError(req, ErrorBadRequest, err.Error())
+			return
+		}
+		chatMsg.Src = msg.Src
+		s.handleChatMessage(ctx, chatMsg, req)
+	case RequestDeleteChat:
+		if msg.Src != s.config.Owner {
+			s.respondError(req, ErrorForbidden, "only the owner can delete chat messages")
+			return
+		}
+
+		var deleteMsg DeleteChatMessage
+		if err := req.decodeBody(&deleteMsg); err != nil {
+			fmt.Println("Error unmarshalling message content:", err)
+			s.respondError(req, ErrorBadRequest, err.Error())
+			return
+		}
+
+		//Viewers receive deletions in the chat message format
+		content, _ := json.Marshal(deleteMsg)
+		broadcast, _ := json.Marshal(Message{Type: RequestDeleteChat, Content: content})
+		s.publishText(string(broadcast))
 	default:
-		fmt.Println("Unknown message type:", msg.Type, "content:", string(msg.Content))
+		fmt.Println("Unknown message type:", req.typ, "content:", string(req.body))
+		s.respondError(req, ErrorUnknownType, "unknown request type "+strconv.Quote(req.typ))
+	}
+}
+
+func (s *Streamer) handleHello(req *controlRequest) {
+	var hello HelloRequest
+	if err := req.decodeBody(&hello); err != nil {
+		s.respondError(req, ErrorBadRequest, err.Error())
+		return
 	}
+
+	version, ok := negotiateVersion(hello.Versions)
+	if !ok {
+		s.respondError(req, ErrorUnsupportedVersion, fmt.Sprintf("no common protocol version, newest is %d", ProtocolVersion))
+		return
+	}
+	s.respond(req, HelloResponse{Version: version})
 }
 
-func (s *Streamer) HandleChatMessage(msg *ChatMessage, nknMessage *nkn.Message) {
-	go func() {
-		fmt.Println("Message:", msg.Text)
+// handleMissingChunks sends the requested chunks of a recent segment to the viewer again
+func (s *Streamer) handleMissingChunks(req *controlRequest) {
+	var missing MissingChunksRequest
+	if err := req.decodeBody(&missing); err != nil {
+		s.respondError(req, ErrorBadRequest, err.Error())
+		return
+	}
+
+	chunks := s.getSegmentChunks(missing.SegmentId, chunkHeaderFor(req.version), missing.Quality)
+	if chunks == nil {
+		s.respondError(req, ErrorUnavailable, fmt.Sprintf("segment %d is no longer available", missing.SegmentId))
+		return
+	}
 
-		err := ValidateDonation(s, msg, true)
+	//Only chunks that exist count against the limit, each of them once
+	requested := make([]int, 0, len(missing.Chunks))
+	seen := make(map[int]bool, len(missing.Chunks))
+	for _, chunkId := range missing.Chunks {
+		if chunkId < 0 || chunkId >= len(chunks) || seen[chunkId] {
+			continue
+		}
+		seen[chunkId] = true
+		requested = append(requested, chunkId)
+	}
+	if len(requested) == 0 {
+		s.respond(req, MissingChunksResponse{Chunks: 0})
+		return
+	}
+
+	//Beyond the limit the first chunks are sent, the viewer asks for the rest again
+	allowed := s.viewers.AllowRetransmit(req.msg.Src, len(requested))
+	if allowed == 0 {
+		s.respondError(req, ErrorRateLimited, "too many chunks requested")
+		return
+	}
+	for _, chunkId := range requested[:allowed] {
+		s.sendToClient(req.msg.Src, chunks[chunkId])
+	}
+	s.respond(req, MissingChunksResponse{Chunks: allowed})
+}
+
+// handleMesh adds a viewer to the mesh of forwarding viewers, or takes its report on the delivery by its forwarder
+func (s *Streamer) handleMesh(req *controlRequest) {
+	if s.mesh == nil {
+		s.respondError(req, ErrorBadRequest, "mesh is not enabled on this channel")
+		return
+	}
+	if chunkHeaderFor(req.version) != ChunkHeaderV2 || !slices.Contains(s.viewers.Addresses(), req.msg.Src) ||
+		slices.Contains(s.viewers.Relays(), req.msg.Src) {
+		s.respondError(req, ErrorForbidden, "only viewers of the versioned protocol can join the mesh")
+		return
+	}
+
+	if req.typ == RequestMeshReport {
+		var report MeshReportRequest
+		if err := req.decodeBody(&report); err != nil {
+			s.respondError(req, ErrorBadRequest, err.Error())
+			return
+		}
+		s.mesh.report(req.msg.Src, report.Complete)
+		s.respond(req, MeshResponse{})
+		return
+	}
+
+	var mesh MeshRequest
+	if err := req.decodeBody(&mesh); err != nil {
+		s.respondError(req, ErrorBadRequest, err.Error())
+		return
+	}
+	s.mesh.join(req.msg.Src, mesh.Forward, mesh.Capacity)
+	s.respond(req, MeshResponse{})
+}
+
+// handleContentKey sends the content key of a private stream to an authorized viewer
+func (s *Streamer) handleContentKey(req *controlRequest) {
+	if !s.isPrivate() {
+		s.respondError(req, ErrorBadRequest, "stream is not private")
+		return
+	}
+	if !s.canWatch(req.msg.Src) {
+		s.respondError(req, ErrorForbidden, "no access to this private stream")
+		return
+	}
+
+	var keyReq ContentKeyRequest
+	if err := req.decodeBody(&keyReq); err != nil {
+		s.respondError(req, ErrorBadRequest, err.Error())
+		return
+	}
+
+	key := s.keys.currentKey()
+	if keyReq.KeyId != nil {
+		key = s.keys.lookup(*keyReq.KeyId)
+		if key == nil {
+			s.respondError(req, ErrorUnavailable, fmt.Sprintf("content key %d is no longer available", *keyReq.KeyId))
+			return
+		}
+	}
+	s.respondEncrypted(req, contentKeyResponse(key))
+}
+
+// handleAccess grants or revokes access to a private stream on behalf of the owner,
+// revoking replaces the content key so the viewer can not decrypt any further segments
+func (s *Streamer) handleAccess(req *controlRequest) {
+	if req.msg.Src != s.config.Owner {
+		s.respondError(req, ErrorForbidden, "only the owner can grant access")
+		return
+	}
+	if !s.isPrivate() {
+		s.respondError(req, ErrorBadRequest, "stream is not private")
+		return
+	}
+
+	var access AccessRequest
+	if err := req.decodeBody(&access); err != nil || access.Address == "" {
+		s.respondError(req, ErrorBadRequest, "address is required")
+		return
+	}
+
+	if req.typ == RequestGrant {
+		s.access.grant(access.Address)
+		s.sendContentKey(access.Address)
+		log.Println("access granted:", access.Address)
+	} else {
+		s.access.revoke(access.Address)
+		s.viewers.Remove(access.Address)
+		s.rotateContentKey()
+		log.Println("access revoked:", access.Address)
+	}
+	s.respond(req, AccessResponse{})
+}
+
+func (s *Streamer) channelInfo(src string) ChannelInfo {
+	role := ""
+	if src == s.config.Owner {
+		role = "owner"
+	}
+
+	source := s.source.Load()
+	if source == nil {
+		source = &sourceInfo{}
+	}
+
+	qualityLevels := make([]Transcode, 0)
+	qualityLevels = append(qualityLevels, Transcode{
+		Resolution: source.resolution,
+		Framerate:  source.framerate,
+		Codec:      source.codec,
+	})
+
+	qualityLevels = append(qualityLevels, source.transcoders...)
+
+	info := ChannelInfo{
+		Panels:        s.getPanels(),
+		Viewers:       s.viewers.Count(),
+		Role:          role,
+		QualityLevels: qualityLevels,
+		Private:       s.isPrivate(),
+		Network: ChannelNetwork{
+			ViewerSubClients:    *s.network.ViewerSubClients,
+			MaxViewerSubClients: MAX_VIEWER_SUB_CLIENTS,
+			ChunkSize:           s.network.ChunkSize,
+		},
+	}
+	if s.isRelay() {
+		info.Origin = s.relay.origin
+	}
+
+	//Overflow viewers watch from a relay, private streams are never relayed
+	maxViewers := s.config.MaxViewers
+	if maxViewers > 0 && !s.isPrivate() && info.Viewers >= maxViewers && role != "owner" {
+		if relays := s.viewers.Relays(); len(relays) > 0 {
+			sort.Strings(relays)
+			info.Redirect = relays[s.redirectIndex.Add(1)%uint64(len(relays))]
+		}
+	}
+	return info
+}
+
+// handleChatMessage validates the donation of a chat message in the background, it gives up when the streamer stops
+func (s *Streamer) handleChatMessage(ctx context.Context, msg *ChatMessage, req *controlRequest) {
+	s.goroutine(func() {
+		log.Println("Message:", msg.Text)
+
+		err := ValidateDonation(ctx, s, msg, true)
+		if ctx.Err() != nil {
+			return
+		}
 		if err != nil {
-			fmt.Println("donation validation error", err.Error())
-			nknMessage.Reply([]byte("error: donation validation error - " + err.Error()))
+			log.Println("donation validation error", err.Error())
+			s.respondError(req, ErrorDonation, "donation validation error - "+err.Error())
 			return
 		} else {
-			nknMessage.Reply([]byte("success"))
+			s.respond(req, ChatResponse{})
 		}
 
-		msg.Id = chatId
+		//Paying the price of a private stream grants access
+		if s.isPrivate() && s.config.Private.Price > 0 && donationAmount(msg.Text) >= s.config.Private.Price && !s.canWatch(msg.Src) {
+			s.access.grant(msg.Src)
+			s.sendContentKey(msg.Src)
+			log.Println("access paid:", msg.Src)
+		}
+
+		msg.Id = s.chatId.Add(1) - 1
 		if msg.Src == s.config.Owner {
 			msg.Role = "owner"
 		}
-		chatId++
 
 		binary, err := json.Marshal(msg)
 		if err != nil {
-			panic(err)
+			log.Println("Error marshalling chat message:", err)
+			return
 		}
 		s.publish(binary)
-	}()
+	})
 }
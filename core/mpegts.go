@@ -0,0 +1,97 @@
+package core
+
+import (
+	"time"
+)
+
+const tsPacketSize = 188
+
+// segmentTiming is read from the video stream of an MPEG-TS segment
+type segmentTiming struct {
+	// Presentation timestamp of the first video frame in 90kHz units
+	pts int64
+	// Time between the first and last video frame plus one frame
+	duration time.Duration
+	// The first video packet is a random access point
+	keyframe bool
+}
+
+// parseSegmentTiming reads the video timestamps of a segment, missing information is left zero
+func parseSegmentTiming(segment []byte) segmentTiming {
+	var timing segmentTiming
+
+	videoPid := -1
+	var first, last int64
+	frames := 0
+
+	for offset := 0; offset+tsPacketSize <= len(segment); offset += tsPacketSize {
+		packet := segment[offset : offset+tsPacketSize]
+		if packet[0] != 0x47 {
+			continue
+		}
+
+		payloadStart := packet[1]&0x40 != 0
+		pid := int(packet[1]&0x1F)<<8 | int(packet[2])
+		adaptation := packet[3]&0x20 != 0
+		hasPayload := packet[3]&0x10 != 0
+
+		pos := 4
+		randomAccess := false
+		if adaptation {
+			length := int(packet[4])
+			if length > 0 && pos+1 < len(packet) {
+				randomAccess = packet[5]&0x40 != 0
+			}
+			pos += 1 + length
+		}
+		if !hasPayload || !payloadStart || pos+14 > len(packet) {
+			continue
+		}
+
+		//PES header of a video stream with a PTS
+		pes := packet[pos:]
+		if pes[0] != 0 || pes[1] != 0 || pes[2] != 1 || pes[3]&0xF0 != 0xE0 {
+			continue
+		}
+		if videoPid == -1 {
+			videoPid = pid
+			timing.keyframe = randomAccess
+		} else if pid != videoPid {
+			continue
+		}
+		if pes[7]&0x80 == 0 {
+			continue
+		}
+
+		pts := readPTS(pes[9:14])
+		if frames == 0 || pts < first {
+			first = pts
+		}
+		if frames == 0 || pts > last {
+			last = pts
+		}
+		frames++
+	}
+
+	if frames == 0 {
+		return timing
+	}
+
+	timing.pts = first
+	if frames > 1 {
+		span := last - first
+		//Add one frame so back to back segments add up to the stream duration
+		span += span / int64(frames-1)
+		timing.duration = time.Duration(span) * time.Second / 90000
+	}
+	return timing
+}
+
+// readPTS decodes the 33 bit timestamp spread over 5 bytes with marker bits
+func readPTS(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 |
+		int64(b[1])<<22 |
+		int64(b[2]>>1)<<15 |
+		int64(b[3])<<7 |
+		int64(b[4]>>1)
+}
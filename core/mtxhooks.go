@@ -0,0 +1,245 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// How often the MediaMTX control API is polled for changes
+const mtxPollInterval = 500 * time.Millisecond
+
+// PublisherInfo describes a publisher connected to a MediaMTX path
+type PublisherInfo struct {
+	ID         string
+	Path       string
+	RemoteAddr string
+}
+
+// ReaderInfo describes a reader of a MediaMTX path, e.g. the HLS muxer producing segments
+type ReaderInfo struct {
+	Path string
+	Type string
+	ID   string
+}
+
+// mtxHooks are typed callbacks on the lifecycle of an embedded MediaMTX core, nil hooks are skipped
+type mtxHooks struct {
+	onPublisherConnected    func(PublisherInfo)
+	onPublisherDisconnected func(PublisherInfo)
+	onReaderAdded           func(ReaderInfo)
+	onPathReady             func(path string)
+	onPathNotReady          func(path string)
+	onError                 func(error)
+}
+
+// mtxMonitor diffs the state reported by the MediaMTX control API and calls the hooks on every change.
+// The embedded core does not offer callbacks itself, so the API is polled every mtxPollInterval. Changes that are
+// undone within one interval are not seen, e.g. a publisher that connects and drops again in between two polls.
+type mtxMonitor struct {
+	apiAddress string
+	rtmp       bool
+	hooks      mtxHooks
+	client     *http.Client
+
+	publishers map[string]PublisherInfo
+	readyPaths map[string]bool
+	readers    map[ReaderInfo]bool
+	failing    bool
+}
+
+// newMTXMonitor watches the API on apiAddress, RTMP connections are only watched when rtmp is enabled in the core
+func newMTXMonitor(apiAddress string, rtmp bool, hooks mtxHooks) *mtxMonitor {
+	return &mtxMonitor{
+		apiAddress: apiAddress,
+		rtmp:       rtmp,
+		hooks:      hooks,
+		client:     &http.Client{Timeout: 2 * time.Second},
+		publishers: make(map[string]PublisherInfo),
+		readyPaths: make(map[string]bool),
+		readers:    make(map[ReaderInfo]bool),
+	}
+}
+
+// run polls until the context is done, publishers still connected are reported as disconnected on return
+func (m *mtxMonitor) run(ctx context.Context) {
+	ticker := time.NewTicker(mtxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("mtxMonitor: stopping")
+			for id, publisher := range m.publishers {
+				delete(m.publishers, id)
+				m.publisherDisconnected(publisher)
+			}
+			return
+		case <-ticker.C:
+			err := m.poll(ctx)
+			if err != nil && ctx.Err() == nil {
+				//Only report the first of a series of failures
+				if !m.failing && m.hooks.onError != nil {
+					m.hooks.onError(err)
+				}
+				m.failing = true
+			} else {
+				m.failing = false
+			}
+		}
+	}
+}
+
+func (m *mtxMonitor) poll(ctx context.Context) error {
+	var paths struct {
+		Items []struct {
+			Name    string `json:"name"`
+			Ready   bool   `json:"ready"`
+			Readers []struct {
+				Type string `json:"type"`
+				ID   string `json:"id"`
+			} `json:"readers"`
+		} `json:"items"`
+	}
+	if err := m.get(ctx, "/v3/paths/list", &paths); err != nil {
+		return err
+	}
+
+	readyPaths := make(map[string]bool)
+	readers := make(map[ReaderInfo]bool)
+	for _, path := range paths.Items {
+		if path.Ready {
+			readyPaths[path.Name] = true
+		}
+		for _, reader := range path.Readers {
+			readers[ReaderInfo{Path: path.Name, Type: reader.Type, ID: reader.ID}] = true
+		}
+	}
+
+	for path := range readyPaths {
+		if !m.readyPaths[path] && m.hooks.onPathReady != nil {
+			m.hooks.onPathReady(path)
+		}
+	}
+	for path := range m.readyPaths {
+		if !readyPaths[path] && m.hooks.onPathNotReady != nil {
+			m.hooks.onPathNotReady(path)
+		}
+	}
+	for reader := range readers {
+		if !m.readers[reader] && m.hooks.onReaderAdded != nil {
+			m.hooks.onReaderAdded(reader)
+		}
+	}
+	m.readyPaths = readyPaths
+	m.readers = readers
+
+	if !m.rtmp {
+		return nil
+	}
+
+	var conns struct {
+		Items []struct {
+			ID         string `json:"id"`
+			RemoteAddr string `json:"remoteAddr"`
+			State      string `json:"state"`
+			Path       string `json:"path"`
+		} `json:"items"`
+	}
+	if err := m.get(ctx, "/v3/rtmpconns/list", &conns); err != nil {
+		return err
+	}
+
+	publishers := make(map[string]PublisherInfo)
+	for _, conn := range conns.Items {
+		if conn.State == "publish" {
+			publishers[conn.ID] = PublisherInfo{ID: conn.ID, Path: conn.Path, RemoteAddr: conn.RemoteAddr}
+		}
+	}
+
+	for id, publisher := range publishers {
+		if _, ok := m.publishers[id]; !ok && m.hooks.onPublisherConnected != nil {
+			m.hooks.onPublisherConnected(publisher)
+		}
+	}
+	for id, publisher := range m.publishers {
+		if _, ok := publishers[id]; !ok {
+			m.publisherDisconnected(publisher)
+		}
+	}
+	m.publishers = publishers
+
+	return nil
+}
+
+func (m *mtxMonitor) publisherDisconnected(publisher PublisherInfo) {
+	if m.hooks.onPublisherDisconnected != nil {
+		m.hooks.onPublisherDisconnected(publisher)
+	}
+}
+
+func (m *mtxMonitor) get(ctx context.Context, endpoint string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+m.apiAddress+endpoint, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := m.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("MediaMTX API: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("MediaMTX API: %s returned %s", endpoint, res.Status)
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("MediaMTX API: error decoding %s: %w", endpoint, err)
+	}
+	return nil
+}
+
+// mtxAPIAddress returns the address of the control API of the MediaMTX config to monitor. An API the user enabled is
+// kept as configured, otherwise it is enabled on a private loopback address through settings.
+func mtxAPIAddress(configPath string, settings map[string]string) (string, error) {
+	if configPath == "" {
+		configPath = "mediamtx.yml"
+	}
+	if config, err := os.ReadFile(configPath); err == nil {
+		if api, _ := mediaMTXSetting(string(config), "api"); api == "yes" || api == "true" {
+			address, ok := mediaMTXSetting(string(config), "apiAddress")
+			if !ok || address == "" {
+				address = ":9997"
+			}
+			return loopbackAddress(address)
+		}
+	}
+	return privateMTXAPI(settings)
+}
+
+// privateMTXAPI enables the control API on a private loopback address through settings
+func privateMTXAPI(settings map[string]string) (string, error) {
+	apiAddress, err := freeLoopbackAddress()
+	if err != nil {
+		return "", fmt.Errorf("error reserving MediaMTX API address: %w", err)
+	}
+	settings["api"] = "yes"
+	settings["apiAddress"] = apiAddress
+	return apiAddress, nil
+}
+
+// freeLoopbackAddress picks an unused local port for the private control API
+func freeLoopbackAddress() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
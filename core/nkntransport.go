@@ -0,0 +1,192 @@
+package core
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/nknorg/nkn-sdk-go/payloads"
+	"github.com/nknorg/nkngomobile"
+)
+
+var nknSendConfig = &nkn.MessageConfig{
+	Unencrypted: true,
+	NoReply:     true,
+}
+
+var nknEncryptedSendConfig = &nkn.MessageConfig{
+	NoReply: true,
+}
+
+// NknTransport sends and receives over the NKN network with a multiclient
+type NknTransport struct {
+	client        *nkn.MultiClient
+	numSubClients int
+	onConnect     chan struct{}
+	messages      chan *InboundMessage
+	done          chan struct{}
+}
+
+type nknRecipients struct {
+	addresses *nkngomobile.StringArray
+}
+
+func (r nknRecipients) Len() int {
+	return r.addresses.Len()
+}
+
+// NewNknTransport creates a multiclient for the account, it connects in the background.
+func NewNknTransport(account *nkn.Account, numSubClients int) (Transport, error) {
+	client, err := nkn.NewMultiClient(account, "", numSubClients, false, &nkn.ClientConfig{
+		ConnectRetries:   10,
+		AllowUnencrypted: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	t := &NknTransport{
+		client:        client,
+		numSubClients: numSubClients,
+		onConnect:     make(chan struct{}, numSubClients),
+		messages:      make(chan *InboundMessage, 64),
+		done:          make(chan struct{}),
+	}
+
+	go t.forwardConnects()
+	go t.forwardMessages()
+
+	return t, nil
+}
+
+func (t *NknTransport) forwardConnects() {
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-t.client.OnConnect.C:
+			select {
+			case t.onConnect <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (t *NknTransport) forwardMessages() {
+	for {
+		select {
+		case <-t.done:
+			return
+		case msg := <-t.client.OnMessage.C:
+			if msg == nil {
+				continue
+			}
+			//nkn.Message does not expose the id of the message it replies to, ReplyToID stays empty
+			select {
+			case t.messages <- &InboundMessage{
+				Src:       msg.Src,
+				Data:      msg.Data,
+				MessageID: msg.MessageID,
+				NoReply:   msg.NoReply,
+			}:
+			case <-t.done:
+				return
+			}
+		}
+	}
+}
+
+func (t *NknTransport) Address() string {
+	return t.client.Address()
+}
+
+func (t *NknTransport) NumSubClients() int {
+	return t.numSubClients
+}
+
+func (t *NknTransport) OnConnect() <-chan struct{} {
+	return t.onConnect
+}
+
+func (t *NknTransport) SubClientClosed(i int) bool {
+	client := t.client.GetClient(i)
+	return client == nil || client.IsClosed()
+}
+
+// Reconnect moves an open sub client to another node, closed sub clients of a multiclient can not be reopened
+func (t *NknTransport) Reconnect(i int) error {
+	client := t.client.GetClient(i)
+	if client == nil || client.IsClosed() {
+		return ErrSubClientUnavailable
+	}
+	client.Reconnect(nil)
+	return nil
+}
+
+func (t *NknTransport) Recipients(addresses ...string) Recipients {
+	return nknRecipients{addresses: nkn.NewStringArray(addresses...)}
+}
+
+func (t *NknTransport) Send(subClient int, to Recipients, payload *Payload) error {
+	client := t.client.GetClient(subClient)
+	if client == nil {
+		return ErrSubClientUnavailable
+	}
+
+	nknPayload, err := toNknPayload(payload)
+	if err != nil {
+		return err
+	}
+
+	config := nknSendConfig
+	if payload.Encrypted {
+		config = nknEncryptedSendConfig
+	}
+	_, err = client.SendPayload(to.(nknRecipients).addresses, nknPayload, config)
+	return err
+}
+
+func (t *NknTransport) Messages() <-chan *InboundMessage {
+	return t.messages
+}
+
+func (t *NknTransport) Subscribe(topic string, duration int, meta string) error {
+	_, err := t.client.Subscribe("", topic, duration, meta, nil)
+	return err
+}
+
+func (t *NknTransport) Unsubscribe(topic string) error {
+	_, err := t.client.Unsubscribe("", topic, nil)
+	return err
+}
+
+func (t *NknTransport) Close() error {
+	select {
+	case <-t.done:
+		return nil
+	default:
+		close(t.done)
+	}
+	return t.client.Close()
+}
+
+func toNknPayload(payload *Payload) (*payloads.Payload, error) {
+	nknPayload := &payloads.Payload{
+		Type:      payloads.PayloadType_BINARY,
+		MessageId: payload.MessageID,
+		ReplyToId: payload.ReplyToID,
+		//Replies may be acknowledged, everything else is fire and forget
+		NoReply: len(payload.ReplyToID) == 0,
+		Data:    payload.Data,
+	}
+
+	if payload.Type == PayloadText {
+		data, err := proto.Marshal(&payloads.TextData{Text: string(payload.Data)})
+		if err != nil {
+			return nil, err
+		}
+		nknPayload.Type = payloads.PayloadType_TEXT
+		nknPayload.Data = data
+	}
+
+	return nknPayload, nil
+}
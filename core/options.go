@@ -0,0 +1,76 @@
+package core
+
+import "time"
+
+// Option configures a Streamer on creation
+type Option func(*Streamer)
+
+// WithConfigPath sets the location of the go-novon config file, defaults to ./config.json
+func WithConfigPath(path string) Option {
+	return func(s *Streamer) {
+		s.configPath = path
+	}
+}
+
+// WithMediaMTXConfigPath sets the location of the MediaMTX config file, defaults to mediamtx.yml
+func WithMediaMTXConfigPath(path string) Option {
+	return func(s *Streamer) {
+		s.mediaMTXConfigPath = path
+	}
+}
+
+// WithRtmpAddress overrides the RTMP listen address of the MediaMTX config, e.g. ":1935"
+func WithRtmpAddress(address string) Option {
+	return func(s *Streamer) {
+		s.rtmpAddress = address
+	}
+}
+
+// WithTransport replaces the NKN network with another transport, e.g. MemoryNetwork.NewTransport
+func WithTransport(factory TransportFactory) Option {
+	return func(s *Streamer) {
+		s.newTransport = factory
+	}
+}
+
+// WithTranscoder replaces ffmpeg with another transcoder, e.g. a FakeTranscoder
+func WithTranscoder(transcoder Transcoder) Option {
+	return func(s *Streamer) {
+		s.transcoder = transcoder
+	}
+}
+
+// WithChannel hosts the given channel instead of the one from the config file
+func WithChannel(channel ChannelConfig) Option {
+	return func(s *Streamer) {
+		s.channel = &channel
+	}
+}
+
+// WithLegacyProtocol sets whether requests of clients from before the versioned control protocol are answered, defaults to true
+func WithLegacyProtocol(enabled bool) Option {
+	return func(s *Streamer) {
+		s.legacyProtocol = enabled
+	}
+}
+
+// WithRelay republishes the stream of the origin host address instead of ingesting RTMP
+func WithRelay(origin string) Option {
+	return func(s *Streamer) {
+		s.upstream = origin
+	}
+}
+
+// WithStallTimeout sets how long without segments a live stream is considered stalled, defaults to 5s
+func WithStallTimeout(timeout time.Duration) Option {
+	return func(s *Streamer) {
+		s.stallTimeout = timeout
+	}
+}
+
+// WithEndTimeout sets how long without segments a stream ends and viewers are told it went offline, defaults to 30s
+func WithEndTimeout(timeout time.Duration) Option {
+	return func(s *Streamer) {
+		s.endTimeout = timeout
+	}
+}
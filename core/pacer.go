@@ -0,0 +1,132 @@
+package core
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+)
+
+// pacedSend is a single send of a segment chunk, index is the position of the chunk in its quality level
+type pacedSend struct {
+	index    int
+	priority egressPriority
+	to       Recipients
+	payload  *Payload
+}
+
+// pacedSegment holds the sends of a segment, spread evenly over the window
+type pacedSegment struct {
+	sends  []pacedSend
+	window time.Duration
+}
+
+// sendPacer spreads the chunk sends of every segment over a fraction of the segment duration instead of sending them
+// all at once, smoothing the upload of the host. Segments are paced one after another, a segment that arrives while
+// the previous one is still paced sends the rest of the previous one right away.
+type sendPacer struct {
+	fraction float64
+	segments chan pacedSegment
+	//Signals a queued segment, the segment being paced stops waiting
+	queued   chan struct{}
+	dispatch func(priority egressPriority, to Recipients, payload *Payload)
+}
+
+func newSendPacer(fraction float64, dispatch func(priority egressPriority, to Recipients, payload *Payload)) *sendPacer {
+	return &sendPacer{
+		fraction: fraction,
+		segments: make(chan pacedSegment, PIPELINE_QUEUE_SIZE),
+		queued:   make(chan struct{}, 1),
+		dispatch: dispatch,
+	}
+}
+
+// pace queues the sends of a segment of the given duration, segments of unknown duration are sent at once
+func (p *sendPacer) pace(sends []pacedSend, duration time.Duration) {
+	window := p.window(duration)
+	if window <= 0 || len(sends) == 0 {
+		p.flush(sends)
+		return
+	}
+
+	select {
+	case p.segments <- pacedSegment{sends: sends, window: window}:
+		select {
+		case p.queued <- struct{}{}:
+		default:
+		}
+	default:
+		p.flush(sends)
+	}
+}
+
+// window is the time the sends of a segment of the given duration are spread over
+func (p *sendPacer) window(duration time.Duration) time.Duration {
+	return time.Duration(float64(duration) * p.fraction)
+}
+
+func (p *sendPacer) flush(sends []pacedSend) {
+	for _, send := range sends {
+		p.dispatch(send.priority, send.to, send.payload)
+	}
+}
+
+// run paces queued segments until the context is done
+func (p *sendPacer) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("sendPacer: stopping")
+			return
+		case segment := <-p.segments:
+			p.send(ctx, segment)
+		}
+	}
+}
+
+// send dispatches the sends of a segment at even intervals over its window
+func (p *sendPacer) send(ctx context.Context, segment pacedSegment) {
+	interval := segment.window / time.Duration(len(segment.sends))
+	start := time.Now()
+
+	for i, send := range segment.sends {
+		due := start.Add(interval * time.Duration(i))
+		//The signal may be that of this segment, so the queue is checked again
+		for wait := time.Until(due); wait > 0 && len(p.segments) == 0; wait = time.Until(due) {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			case <-p.queued:
+			}
+		}
+		p.dispatch(send.priority, send.to, send.payload)
+	}
+}
+
+// paceSends sends the chunk sends of a segment, paced over the segment duration when pacing is configured.
+// Chunks are interleaved so every quality level progresses evenly, the lowest quality first.
+func (s *Streamer) paceSends(sends []pacedSend, duration time.Duration) {
+	sort.SliceStable(sends, func(i, j int) bool {
+		if sends[i].index != sends[j].index {
+			return sends[i].index < sends[j].index
+		}
+		return sends[i].priority < sends[j].priority
+	})
+
+	if s.pacer == nil {
+		for _, send := range sends {
+			s.dispatch(send.priority, send.to, send.payload)
+		}
+		return
+	}
+	s.pacer.pace(sends, duration)
+}
+
+// pacingWindow is the time the sends of a segment of the given duration are spread over
+func (s *Streamer) pacingWindow(duration time.Duration) time.Duration {
+	if s.pacer == nil {
+		return 0
+	}
+	return s.pacer.window(duration)
+}
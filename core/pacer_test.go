@@ -0,0 +1,100 @@
+package core
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPacer runs a send pacer that records when every send was dispatched
+type testPacer struct {
+	*sendPacer
+
+	mu   sync.Mutex
+	sent map[string]time.Time
+}
+
+func newTestPacer(t *testing.T, fraction float64) *testPacer {
+	tp := &testPacer{sent: make(map[string]time.Time)}
+	tp.sendPacer = newSendPacer(fraction, func(priority egressPriority, to Recipients, payload *Payload) {
+		tp.mu.Lock()
+		defer tp.mu.Unlock()
+		tp.sent[string(payload.Data)] = time.Now()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		tp.run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return tp
+}
+
+func (tp *testPacer) sentAt(name string) (time.Time, bool) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	at, ok := tp.sent[name]
+	return at, ok
+}
+
+func testSends(names ...string) []pacedSend {
+	sends := make([]pacedSend, len(names))
+	for i, name := range names {
+		sends[i] = pacedSend{index: i, priority: priorityVideo, to: memoryRecipients{"viewer"}, payload: newPayload(PayloadBinary, []byte(name))}
+	}
+	return sends
+}
+
+func TestPacerSpreadsSends(t *testing.T) {
+	//Half of a 400ms segment, a send every 50ms
+	p := newTestPacer(t, 0.5)
+	start := time.Now()
+	p.pace(testSends("0", "1", "2", "3"), 400*time.Millisecond)
+
+	waitFor(t, time.Second, "the sends", func() bool { _, ok := p.sentAt("3"); return ok })
+	for i, name := range []string{"0", "1", "2", "3"} {
+		at, _ := p.sentAt(name)
+		if due := time.Duration(i) * 50 * time.Millisecond; at.Sub(start) < due-5*time.Millisecond {
+			t.Fatalf("send %s after %v, want it spread to %v", name, at.Sub(start), due)
+		}
+	}
+	if at, _ := p.sentAt("3"); at.Sub(start) > 200*time.Millisecond {
+		t.Fatalf("last send after %v, want it within the 200ms window", at.Sub(start))
+	}
+
+	//Segments of unknown duration are not paced
+	p.pace(testSends("unpaced"), 0)
+	if _, ok := p.sentAt("unpaced"); !ok {
+		t.Fatal("segment without duration was not sent right away")
+	}
+}
+
+func TestPacerNeverDelaysPastNextSegment(t *testing.T) {
+	//The first segment would take a second, a send every 250ms
+	p := newTestPacer(t, 0.5)
+	p.pace(testSends("a0", "a1", "a2", "a3"), 2*time.Second)
+	waitFor(t, time.Second, "the first send", func() bool { _, ok := p.sentAt("a0"); return ok })
+
+	time.Sleep(20 * time.Millisecond)
+	next := time.Now()
+	p.pace(testSends("b0", "b1"), 2*time.Second)
+
+	//The rest of the first segment goes out once the next one arrives, before the next one starts
+	waitFor(t, time.Second, "the next segment", func() bool { _, ok := p.sentAt("b0"); return ok })
+	b0, _ := p.sentAt("b0")
+	for _, name := range []string{"a1", "a2", "a3"} {
+		at, ok := p.sentAt(name)
+		if !ok || at.After(b0) {
+			t.Fatalf("send %s of the first segment not sent before the next segment", name)
+		}
+	}
+	if wait := b0.Sub(next); wait > 100*time.Millisecond {
+		t.Fatalf("next segment started %v after it was queued", wait)
+	}
+}
@@ -4,11 +4,21 @@ import (
 	"os"
 )
 
-var panels string = "[]"
+const defaultPanels = "[]"
 
-func loadPanels() {
-	bin, err := os.ReadFile("panels.json")
+func (s *Streamer) loadPanels() {
+	panels := defaultPanels
+	bin, err := os.ReadFile(s.config.Panels)
 	if err == nil {
 		panels = string(bin)
 	}
+	s.panels.Store(&panels)
+}
+
+func (s *Streamer) getPanels() string {
+	panels := s.panels.Load()
+	if panels == nil {
+		return defaultPanels
+	}
+	return *panels
 }
@@ -0,0 +1,249 @@
+package core
+
+import (
+	"context"
+	"crypto/ed25519"
+	"log"
+	"sync"
+	"time"
+)
+
+// sourceInfo describes the ingested stream, it is replaced as a whole when a new ingest is probed
+type sourceInfo struct {
+	codec       string
+	resolution  int
+	framerate   int
+	transcoders []Transcode
+}
+
+// segmentJob is a single segment on its way through the publish pipeline
+type segmentJob struct {
+	id      int
+	segment []byte
+	source  *sourceInfo
+
+	//Unix milliseconds of ingest and whether the segment starts a new ingest
+	wallclock     int64
+	discontinuity bool
+
+	//Chunks of every quality level by chunk header version, the source quality first
+	qualityChunks map[int][][][]byte
+
+	//The lowest quality segment, used for thumbnails
+	lowest []byte
+
+	//Timing of the source quality and the size of every quality level, for the manifest
+	timing segmentTiming
+	sizes  []int
+
+	//Private streams encrypt every quality level of a segment with the same content key
+	contentKey *contentKey
+}
+
+// publishPipeline runs segments through ordered stages: probe and numbering happen in publishTSPart,
+// a bounded pool of workers transcodes and chunks, and a single sender restores the segment order before sending.
+type publishPipeline struct {
+	ctx context.Context
+	s   *Streamer
+
+	//Key of the host account the v2 chunks are signed with
+	signingKey ed25519.PrivateKey
+
+	//Serializes numbering and queueing so segment ids enter the queue in order
+	enqueueMu sync.Mutex
+	nextId    int
+
+	transcodeQueue chan *segmentJob
+	sendQueue      chan *segmentJob
+
+	//send publishes a finished segment, sendSegment of the streamer
+	send func(job *segmentJob)
+}
+
+// newPublishPipeline numbers segments from firstId, so ids keep increasing when a streamer is restarted
+func newPublishPipeline(ctx context.Context, s *Streamer, firstId int, signingKey ed25519.PrivateKey) *publishPipeline {
+	return &publishPipeline{
+		ctx:            ctx,
+		s:              s,
+		signingKey:     signingKey,
+		nextId:         firstId,
+		transcodeQueue: make(chan *segmentJob, PIPELINE_QUEUE_SIZE),
+		sendQueue:      make(chan *segmentJob, PIPELINE_QUEUE_SIZE),
+		send:           s.sendSegment,
+	}
+}
+
+// start runs the workers and the sender until the context is done
+func (p *publishPipeline) start() {
+	first := p.nextSegmentId()
+	for i := 0; i < TRANSCODE_WORKERS; i++ {
+		p.s.goroutine(func() { p.transcodeWorker(p.ctx) })
+	}
+	p.s.goroutine(func() { p.sender(p.ctx, first) })
+}
+
+// nextSegmentId is the id the next queued segment gets
+func (p *publishPipeline) nextSegmentId() int {
+	p.enqueueMu.Lock()
+	defer p.enqueueMu.Unlock()
+	return p.nextId
+}
+
+// enqueue numbers the segment and queues it for transcoding, segments are dropped without an id when the workers fall behind
+func (p *publishPipeline) enqueue(segment []byte, source *sourceInfo, discontinuity bool) {
+	p.enqueueMu.Lock()
+	defer p.enqueueMu.Unlock()
+
+	job := &segmentJob{
+		id:            p.nextId,
+		segment:       segment,
+		source:        source,
+		wallclock:     time.Now().UnixMilli(),
+		discontinuity: discontinuity,
+	}
+
+	select {
+	case <-p.ctx.Done():
+	case p.transcodeQueue <- job:
+		p.nextId++
+	default:
+		log.Println("WARNING: transcoding falls behind, dropping segment")
+	}
+}
+
+func (p *publishPipeline) transcodeWorker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-p.transcodeQueue:
+			p.transcode(job)
+
+			select {
+			case <-ctx.Done():
+				return
+			case p.sendQueue <- job:
+			}
+		}
+	}
+}
+
+// transcode chunks the source and every quality level, each level is transcoded from the one above it
+func (p *publishPipeline) transcode(job *segmentJob) {
+	segment := job.segment
+	job.qualityChunks = make(map[int][][][]byte)
+	if p.s.isPrivate() {
+		job.contentKey = p.s.keys.currentKey()
+	}
+	p.chunk(job, 0, segment)
+
+	if len(job.source.transcoders) > 0 {
+		startTranscoderTime := time.Now()
+
+		for i, t := range job.source.transcoders {
+			beginTime := time.Now()
+			resized, err := p.s.transcoder.Transcode(segment, t)
+			timeSpent := time.Since(beginTime).Milliseconds()
+			if err != nil {
+				//The level above is not sent in its place, the next level is transcoded from it instead
+				log.Printf("Error transcoding -%v@%v, skipping quality level: %v\n", t.Resolution, t.Framerate, err)
+				p.skipLevel(job)
+				continue
+			}
+			segment = resized
+
+			tChunks := p.chunk(job, i+1, segment)
+			log.Printf("Transcoded -%v@%v size: %v, chunks: %v, timeSpent: %v\n", t.Resolution, t.Framerate, len(segment), tChunks, timeSpent)
+		}
+
+		totalTranscodingMs := time.Since(startTranscoderTime).Milliseconds()
+		if totalTranscodingMs > 1000 && totalTranscodingMs < 2000 {
+			log.Printf("WARNING: Total transcoding time '%vms' approaching segment duration, consider less transcoding configurations.", totalTranscodingMs)
+		} else if totalTranscodingMs > 2000 {
+			log.Printf("DANGER: Total transcoding time '%vms' exceeds segment duration, stream will suffer interrupts, reduce or remove transcoding configurations.", totalTranscodingMs)
+		}
+	}
+
+	job.lowest = segment
+}
+
+// chunk splits a quality level in chunks for every chunk header version and returns the number of v2 chunks.
+// Segments of private streams are encrypted and only chunked with the v2 header, legacy viewers can not decrypt them.
+// A level that can not be chunked is skipped.
+func (p *publishPipeline) chunk(job *segmentJob, quality int, segment []byte) int {
+	chunkSize := int(p.s.chunkSize.Load())
+	meta := segmentMeta{
+		id:         job.id,
+		quality:    quality,
+		timing:     parseSegmentTiming(segment),
+		wallclock:  job.wallclock,
+		fec:        p.s.config.FEC,
+		signingKey: p.signingKey,
+	}
+	if job.discontinuity {
+		meta.flags |= ChunkFlagDiscontinuity
+	}
+	if quality == 0 {
+		job.timing = meta.timing
+	}
+	size := len(segment)
+
+	var legacy [][]byte
+	if job.contentKey != nil {
+		segment = job.contentKey.encrypt(segment, job.id, quality)
+		meta.flags |= ChunkFlagEncrypted
+		meta.keyId = job.contentKey.id
+	} else {
+		legacy = p.s.ChunkByByteSizeWithMetadata(segment, chunkSize, job.id)
+	}
+
+	v2, err := chunkSegmentV2(segment, chunkSize, meta)
+	if err != nil {
+		log.Println("Error chunking segment, skipping quality level", quality, ":", err)
+		p.skipLevel(job)
+		return 0
+	}
+
+	if job.contentKey == nil {
+		job.qualityChunks[ChunkHeaderLegacy] = append(job.qualityChunks[ChunkHeaderLegacy], legacy)
+	}
+	job.qualityChunks[ChunkHeaderV2] = append(job.qualityChunks[ChunkHeaderV2], v2)
+	job.sizes = append(job.sizes, size)
+
+	return len(v2)
+}
+
+// skipLevel keeps the place of a quality level that is not available for this segment, so later levels keep their
+// index. Nothing is sent for it and its size in the manifest is 0.
+func (p *publishPipeline) skipLevel(job *segmentJob) {
+	if job.contentKey == nil {
+		job.qualityChunks[ChunkHeaderLegacy] = append(job.qualityChunks[ChunkHeaderLegacy], nil)
+	}
+	job.qualityChunks[ChunkHeaderV2] = append(job.qualityChunks[ChunkHeaderV2], nil)
+	job.sizes = append(job.sizes, 0)
+}
+
+// sender publishes segments strictly in id order, segments finished early wait for the ones before them
+func (p *publishPipeline) sender(ctx context.Context, next int) {
+	pending := make(map[int]*segmentJob)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-p.sendQueue:
+			pending[job.id] = job
+
+			for {
+				job, ok := pending[next]
+				if !ok {
+					break
+				}
+				delete(pending, next)
+				next++
+
+				p.send(job)
+			}
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package core
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPipeline runs a publish pipeline without a network, it records the ids of the segments it sends
+type testPipeline struct {
+	*publishPipeline
+	cancel context.CancelFunc
+
+	mu   sync.Mutex
+	sent []*segmentJob
+}
+
+func newTestPipeline(t *testing.T, transcoder *FakeTranscoder) *testPipeline {
+	s := NewStreamer(WithTranscoder(transcoder))
+	s.config = &ChannelConfig{}
+	s.chunkSize.Store(CHUNK_SIZE)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tp := &testPipeline{
+		publishPipeline: newPublishPipeline(ctx, s, 0, ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))),
+		cancel:          cancel,
+	}
+	tp.send = func(job *segmentJob) {
+		tp.mu.Lock()
+		defer tp.mu.Unlock()
+		tp.sent = append(tp.sent, job)
+	}
+	tp.start()
+
+	t.Cleanup(tp.stop)
+	return tp
+}
+
+// stop cancels the pipeline and waits for its workers, like Streamer.Stop
+func (tp *testPipeline) stop() {
+	tp.cancel()
+	tp.s.wg.Wait()
+}
+
+func (tp *testPipeline) sentIds() []int {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	ids := make([]int, len(tp.sent))
+	for i, job := range tp.sent {
+		ids[i] = job.id
+	}
+	return ids
+}
+
+func (tp *testPipeline) sentJobs() []*segmentJob {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	return append([]*segmentJob(nil), tp.sent...)
+}
+
+// testSource is a 1080p source transcoded to 720p, so every segment goes through the transcoder
+var testSource = &sourceInfo{
+	codec:       "h264",
+	resolution:  1080,
+	framerate:   30,
+	transcoders: []Transcode{{Resolution: 720, Framerate: 30}},
+}
+
+// testSegment is a segment whose first byte is its index
+func testSegment(i int) []byte {
+	segment := make([]byte, 1024)
+	segment[0] = byte(i)
+	return segment
+}
+
+func TestPipelineSendsInOrder(t *testing.T) {
+	//Even segments take longer, so the worker of every odd segment finishes first
+	transcoder := NewFakeTranscoder()
+	transcoder.TranscodeDelay = func(segment []byte, level Transcode) time.Duration {
+		if segment[0]%2 == 0 {
+			return 50 * time.Millisecond
+		}
+		return 0
+	}
+	p := newTestPipeline(t, transcoder)
+
+	const segments = 6
+	for i := 0; i < segments; i++ {
+		p.enqueue(testSegment(i), testSource, false)
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	waitFor(t, 5*time.Second, "all segments to be sent", func() bool { return len(p.sentIds()) == segments })
+	for i, id := range p.sentIds() {
+		if id != i {
+			t.Fatalf("sent %v, want the segments in order", p.sentIds())
+		}
+	}
+}
+
+func TestPipelineDropsWhenFull(t *testing.T) {
+	//Transcodes block until released, so every worker holds a segment and the queue fills up
+	started := make(chan struct{}, TRANSCODE_WORKERS+PIPELINE_QUEUE_SIZE+1)
+	release := make(chan struct{})
+	transcoder := NewFakeTranscoder()
+	transcoder.TranscodeDelay = func(segment []byte, level Transcode) time.Duration {
+		started <- struct{}{}
+		<-release
+		return 0
+	}
+	p := newTestPipeline(t, transcoder)
+	//Cleanups run last in first out, a failing test releases the workers before waiting for them
+	t.Cleanup(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	})
+
+	for i := 0; i < TRANSCODE_WORKERS; i++ {
+		p.enqueue(testSegment(i), testSource, false)
+	}
+	for i := 0; i < TRANSCODE_WORKERS; i++ {
+		<-started
+	}
+
+	for i := 0; i < PIPELINE_QUEUE_SIZE+1; i++ {
+		p.enqueue(testSegment(TRANSCODE_WORKERS+i), testSource, false)
+	}
+
+	//The dropped segment got no id, the next segment takes its place
+	queued := TRANSCODE_WORKERS + PIPELINE_QUEUE_SIZE
+	if id := p.nextSegmentId(); id != queued {
+		t.Fatalf("next segment id = %d, want %d", id, queued)
+	}
+
+	close(release)
+	waitFor(t, 5*time.Second, "the queued segments to be sent", func() bool { return len(p.sentIds()) == queued })
+	for i, id := range p.sentIds() {
+		if id != i {
+			t.Fatalf("sent %v, want the queued segments in order", p.sentIds())
+		}
+	}
+}
+
+func TestPipelineStopDrainsWorkers(t *testing.T) {
+	transcoder := NewFakeTranscoder()
+	transcoder.TranscodeDelay = func(segment []byte, level Transcode) time.Duration {
+		return 20 * time.Millisecond
+	}
+	p := newTestPipeline(t, transcoder)
+
+	for i := 0; i < PIPELINE_QUEUE_SIZE; i++ {
+		p.enqueue(testSegment(i), testSource, false)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		p.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the workers to stop")
+	}
+
+	//Nothing is sent once the workers are done
+	sent := len(p.sentIds())
+	time.Sleep(100 * time.Millisecond)
+	if len(p.sentIds()) != sent {
+		t.Fatalf("sent %d segments after Stop", len(p.sentIds())-sent)
+	}
+
+	//Segments queued after Stop are not transcoded
+	transcodes := len(transcoder.Transcodes())
+	p.enqueue(testSegment(PIPELINE_QUEUE_SIZE), testSource, false)
+	time.Sleep(50 * time.Millisecond)
+	if len(transcoder.Transcodes()) != transcodes {
+		t.Fatal("segment transcoded after Stop")
+	}
+}
+
+func TestPipelineSkipsFailedLevels(t *testing.T) {
+	transcoder := NewFakeTranscoder()
+	transcoder.TranscodeErrs = map[int]error{720: errors.New("transcode failed")}
+	p := newTestPipeline(t, transcoder)
+
+	source := &sourceInfo{
+		codec:       "h264",
+		resolution:  1080,
+		framerate:   30,
+		transcoders: []Transcode{{Resolution: 720, Framerate: 30}, {Resolution: 480, Framerate: 30}},
+	}
+	p.enqueue(testSegment(0), source, false)
+	waitFor(t, 5*time.Second, "the segment to be sent", func() bool { return len(p.sentIds()) == 1 })
+	job := p.sentJobs()[0]
+
+	//The failed level keeps its place, the level below it is not shifted up
+	for chunkHeader, qualityChunks := range job.qualityChunks {
+		if len(qualityChunks) != 3 || qualityChunks[0] == nil || qualityChunks[1] != nil || qualityChunks[2] == nil {
+			t.Fatalf("chunk header %d: levels %v, want level 1 skipped", chunkHeader, qualityChunks)
+		}
+	}
+	if want := []int{1024, 0, 1024 * 480 / 1080}; !slices.Equal(job.sizes, want) {
+		t.Fatalf("sizes = %v, want %v", job.sizes, want)
+	}
+	h, _, err := ParseChunkHeader(job.qualityChunks[ChunkHeaderV2][2][0])
+	if err != nil || h.Quality != 2 {
+		t.Fatalf("lowest level has quality %d (%v), want 2", h.Quality, err)
+	}
+
+	//The fake segments have no timestamps to take the duration from
+	job.timing.duration = 2 * time.Second
+	manifest := newLiveManifest()
+	manifest.add(job)
+	if levels := manifest.snapshot().Levels; levels[0].Bandwidth == 0 || levels[1].Bandwidth != 0 {
+		t.Fatalf("bandwidths %d and %d, want the skipped level left out", levels[0].Bandwidth, levels[1].Bandwidth)
+	}
+}
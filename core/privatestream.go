@@ -0,0 +1,237 @@
+package core
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSegmentNotEncrypted = errors.New("segment is not encrypted")
+	ErrContentKey          = errors.New("wrong content key")
+)
+
+// contentKey is the AES-256-GCM key segments of a private stream are encrypted with
+type contentKey struct {
+	id      uint32
+	key     []byte
+	aead    cipher.AEAD
+	expires time.Time
+}
+
+func newContentKey(id uint32, lifetime time.Duration) (*contentKey, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	aead, err := newSegmentCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &contentKey{id: id, key: key, aead: aead, expires: time.Now().Add(lifetime)}, nil
+}
+
+func newSegmentCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt seals the segment as nonce followed by the ciphertext, segment id and quality level are authenticated
+func (k *contentKey) encrypt(segment []byte, segmentId int, quality int) []byte {
+	nonce := make([]byte, k.aead.NonceSize(), k.aead.NonceSize()+len(segment)+k.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return k.aead.Seal(nonce, nonce, segment, segmentAdditionalData(uint32(segmentId), uint8(quality)))
+}
+
+func segmentAdditionalData(segmentId uint32, quality uint8) []byte {
+	return append(binary.LittleEndian.AppendUint32(nil, segmentId), quality)
+}
+
+// DecryptSegment decrypts a private segment, as rebuilt by ReassembleSegment, with the content key of the key id in its header
+func DecryptSegment(segment []byte, header ChunkHeader, key []byte) ([]byte, error) {
+	if !header.IsEncrypted() {
+		return nil, ErrSegmentNotEncrypted
+	}
+
+	aead, err := newSegmentCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(segment) < aead.NonceSize() {
+		return nil, ErrChunkTooShort
+	}
+
+	nonce, ciphertext := segment[:aead.NonceSize()], segment[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, segmentAdditionalData(header.SegmentId, header.Quality))
+	if err != nil {
+		return nil, ErrContentKey
+	}
+	return plaintext, nil
+}
+
+// contentKeyring holds the current content key and the one before it, for viewers still receiving older segments
+type contentKeyring struct {
+	mu       sync.RWMutex
+	current  *contentKey
+	previous *contentKey
+	lifetime time.Duration
+}
+
+func newContentKeyring(lifetime time.Duration) (*contentKeyring, error) {
+	k := &contentKeyring{lifetime: lifetime}
+	if _, err := k.rotate(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// rotate replaces the current key with a new one
+func (k *contentKeyring) rotate() (*contentKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var id uint32
+	if k.current != nil {
+		id = k.current.id + 1
+	}
+
+	key, err := newContentKey(id, k.lifetime)
+	if err != nil {
+		return nil, err
+	}
+
+	k.previous = k.current
+	k.current = key
+	return key, nil
+}
+
+func (k *contentKeyring) currentKey() *contentKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current
+}
+
+// lookup returns the current or previous key with the id
+func (k *contentKeyring) lookup(id uint32) *contentKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, key := range []*contentKey{k.current, k.previous} {
+		if key != nil && key.id == id {
+			return key
+		}
+	}
+	return nil
+}
+
+// accessList decides which viewers of a private stream receive the content keys
+type accessList struct {
+	mu        sync.RWMutex
+	allowlist map[string]bool
+	//Granted by the owner or paid for, until the streamer is restarted
+	granted map[string]bool
+}
+
+// newAccessList allows the addresses, either full client addresses or public keys
+func newAccessList(allowlist []string) *accessList {
+	a := &accessList{
+		allowlist: make(map[string]bool),
+		granted:   make(map[string]bool),
+	}
+	for _, address := range allowlist {
+		a.allowlist[address] = true
+	}
+	return a
+}
+
+func (a *accessList) allowed(address string) bool {
+	pubKey := address[strings.LastIndex(address, ".")+1:]
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.allowlist[address] || a.allowlist[pubKey] || a.granted[address]
+}
+
+func (a *accessList) grant(address string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.granted[address] = true
+}
+
+func (a *accessList) revoke(address string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.granted, address)
+}
+
+// isPrivate reports whether segments are encrypted and only authorized viewers receive the content keys
+func (s *Streamer) isPrivate() bool {
+	return s.keys != nil
+}
+
+// canWatch reports whether a viewer may receive the content keys, everyone can watch a public stream
+func (s *Streamer) canWatch(address string) bool {
+	if !s.isPrivate() || address == s.config.Owner {
+		return true
+	}
+	return s.access.allowed(address)
+}
+
+// contentKeyResponse is the content key with its id, a viewer may use it until the expiry
+func contentKeyResponse(key *contentKey) ContentKeyResponse {
+	return ContentKeyResponse{KeyId: key.id, Key: key.key, Expires: key.expires.UnixMilli()}
+}
+
+// sendContentKey pushes the current content key to a viewer, encrypted end-to-end by the network
+func (s *Streamer) sendContentKey(address string) {
+	body, _ := json.Marshal(contentKeyResponse(s.keys.currentKey()))
+	envelope, err := json.Marshal(Envelope{V: ProtocolVersion, Type: RequestContentKey, Body: body})
+	if err != nil {
+		log.Println("error on creating content key message", err.Error())
+		return
+	}
+	s.sendToClientEncrypted(address, string(envelope))
+}
+
+// rotateContentKey replaces the content key and pushes the new one to every authorized viewer
+func (s *Streamer) rotateContentKey() {
+	if _, err := s.keys.rotate(); err != nil {
+		log.Println("Error rotating content key:", err)
+		return
+	}
+
+	for _, address := range s.viewers.Addresses() {
+		if s.canWatch(address) {
+			s.sendContentKey(address)
+		}
+	}
+}
+
+// rotateContentKeys rotates the content key every key lifetime until the context is done
+func (s *Streamer) rotateContentKeys(ctx context.Context, lifetime time.Duration) {
+	ticker := time.NewTicker(lifetime)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.rotateContentKey()
+		}
+	}
+}
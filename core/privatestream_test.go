@@ -0,0 +1,137 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestContentKeyEncryption(t *testing.T) {
+	key, err := newContentKey(0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := newContentKey(1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	segment := make([]byte, 4096)
+	rand.Read(segment)
+	encrypted := key.encrypt(segment, 5, 1)
+	header := ChunkHeader{SegmentId: 5, Quality: 1, Flags: ChunkFlagEncrypted}
+
+	decrypted, err := DecryptSegment(encrypted, header, key.key)
+	if err != nil || !bytes.Equal(decrypted, segment) {
+		t.Fatalf("DecryptSegment = %v, want the segment", err)
+	}
+
+	//Segment id and quality are authenticated, a relay can not pass a segment off as another
+	tests := []struct {
+		name   string
+		header ChunkHeader
+		key    []byte
+		want   error
+	}{
+		{"wrong segment id", ChunkHeader{SegmentId: 6, Quality: 1, Flags: ChunkFlagEncrypted}, key.key, ErrContentKey},
+		{"wrong quality", ChunkHeader{SegmentId: 5, Quality: 0, Flags: ChunkFlagEncrypted}, key.key, ErrContentKey},
+		{"wrong key", header, other.key, ErrContentKey},
+		{"not encrypted", ChunkHeader{SegmentId: 5, Quality: 1}, key.key, ErrSegmentNotEncrypted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecryptSegment(encrypted, tt.header, tt.key); !errors.Is(err, tt.want) {
+				t.Fatalf("DecryptSegment = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestContentKeyringRotation(t *testing.T) {
+	keys, err := newContentKeyring(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := keys.currentKey()
+	segment := []byte("segment")
+	encrypted := first.encrypt(segment, 0, 0)
+
+	if _, err := keys.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if id := keys.currentKey().id; id != first.id+1 {
+		t.Fatalf("key id after rotation = %d, want %d", id, first.id+1)
+	}
+
+	//Viewers still receiving segments of the previous key can look it up
+	previous := keys.lookup(first.id)
+	if previous == nil {
+		t.Fatal("previous key is gone after one rotation")
+	}
+	decrypted, err := DecryptSegment(encrypted, ChunkHeader{Flags: ChunkFlagEncrypted}, previous.key)
+	if err != nil || !bytes.Equal(decrypted, segment) {
+		t.Fatalf("DecryptSegment with the previous key = %v", err)
+	}
+
+	if _, err := keys.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if keys.lookup(first.id) != nil {
+		t.Fatal("key still available after two rotations")
+	}
+}
+
+func TestPrivateStreamAccess(t *testing.T) {
+	network := NewMemoryNetwork()
+	s := startLiveStreamer(t, network, WithChannel(ChannelConfig{
+		Path:    "test",
+		Seed:    testSeed,
+		Owner:   "owner",
+		Private: &PrivateConfig{},
+		Network: &NetworkConfig{SubClients: 4},
+	}))
+	owner := joinTestViewer(t, network, "owner", s.ClientAddress())
+	viewer := joinTestViewer(t, network, "viewer", s.ClientAddress())
+
+	forbidden := func(response Envelope) bool {
+		return response.Error != nil && response.Error.Code == ErrorForbidden
+	}
+
+	//Thumbnails would show what is streamed
+	if response := viewer.call(RequestThumbnail, nil); !forbidden(response) {
+		t.Fatalf("thumbnail without access = %+v, want forbidden", response)
+	}
+	if response := owner.call(RequestThumbnail, nil); response.Error != nil {
+		t.Fatalf("thumbnail of the owner = %+v", response.Error)
+	}
+
+	if response := owner.call(RequestGrant, AccessRequest{Address: "viewer"}); response.Error != nil {
+		t.Fatalf("granting access: %+v", response.Error)
+	}
+	if response := viewer.call(RequestThumbnail, nil); response.Error != nil {
+		t.Fatalf("thumbnail after access was granted = %+v", response.Error)
+	}
+	response := viewer.call(RequestContentKey, ContentKeyRequest{})
+	var key ContentKeyResponse
+	if response.Error != nil || json.Unmarshal(response.Body, &key) != nil {
+		t.Fatalf("content key = %+v", response)
+	}
+
+	//Revoking replaces the key, the viewer can not get the new one
+	if response := owner.call(RequestRevoke, AccessRequest{Address: "viewer"}); response.Error != nil {
+		t.Fatalf("revoking access: %+v", response.Error)
+	}
+	newKeyId := s.keys.currentKey().id
+	if newKeyId == key.KeyId {
+		t.Fatal("content key not replaced after revoking access")
+	}
+	if response := viewer.call(RequestContentKey, ContentKeyRequest{KeyId: &newKeyId}); !forbidden(response) {
+		t.Fatalf("new content key after revoking = %+v, want forbidden", response)
+	}
+	if response := viewer.call(RequestThumbnail, nil); !forbidden(response) {
+		t.Fatalf("thumbnail after revoking = %+v, want forbidden", response)
+	}
+}
@@ -0,0 +1,358 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// ProtocolVersion is the newest version of the control protocol this host speaks.
+// Version 2 viewers receive segment chunks with the ChunkHeaderV2 header.
+const ProtocolVersion = 2
+
+// Request types of the control protocol, legacy clients send the same names as raw strings
+const (
+	RequestHello       = "hello"
+	RequestPing        = "ping"
+	RequestDisconnect  = "disconnect"
+	RequestPanels      = "getpanels"
+	RequestChannelInfo = "channelinfo"
+	RequestThumbnail   = "thumbnail"
+	RequestViewCount   = "viewcount"
+	RequestDonationId  = "donationid"
+	RequestQuality     = "quality"
+	RequestChat        = "chat-message"
+	RequestDeleteChat  = "delete-chat-message"
+	RequestMissing     = "missing-chunks"
+	RequestContentKey  = "content-key"
+	RequestGrant       = "grant-access"
+	RequestRevoke      = "revoke-access"
+	RequestManifest    = "manifest"
+	RequestRelay       = "relay"
+	RequestMesh        = "mesh"
+	RequestMeshReport  = "mesh-report"
+	RequestMeshAssign  = "mesh-assign"
+)
+
+// Error codes of error replies
+const (
+	ErrorBadRequest         = "bad-request"
+	ErrorUnsupportedVersion = "unsupported-version"
+	ErrorUnknownType        = "unknown-type"
+	ErrorNotLive            = "not-live"
+	ErrorForbidden          = "forbidden"
+	ErrorDonation           = "donation-invalid"
+	ErrorUnavailable        = "segment-unavailable"
+	ErrorRateLimited        = "rate-limited"
+)
+
+// Envelope wraps every request and response of the control protocol.
+// A response carries the type and id of the request it answers and either a body or an error.
+type Envelope struct {
+	V     int             `json:"v"`
+	ID    string          `json:"id,omitempty"`
+	Type  string          `json:"type"`
+	Body  json.RawMessage `json:"body,omitempty"`
+	Error *ProtocolError  `json:"error,omitempty"`
+}
+
+// ProtocolError is the error of a failed request
+type ProtocolError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// HelloRequest lists the protocol versions a viewer speaks, the host answers with the newest one both speak
+type HelloRequest struct {
+	Versions []int `json:"versions"`
+}
+
+type HelloResponse struct {
+	Version int `json:"version"`
+}
+
+// PingRequest keeps a viewer joined, a viewer with another client setup than the host expects tells the number of
+// sub clients of its multiclient, 0 for a single client. The host uses at most MAX_VIEWER_SUB_CLIENTS of them.
+// Viewers report the chunks they received, lost and received too late to play since their previous ping,
+// the host adapts chunk size and the copies it sends to the viewer.
+type PingRequest struct {
+	SubClients *int `json:"subClients,omitempty"`
+	Received   int  `json:"received,omitempty"`
+	Lost       int  `json:"lost,omitempty"`
+	Late       int  `json:"late,omitempty"`
+}
+
+type QualityRequest struct {
+	Level int `json:"level"`
+}
+
+// QualityResponse tells from which segment on the viewer receives the requested quality
+type QualityResponse struct {
+	SegmentId int `json:"segmentId"`
+}
+
+// MissingChunksRequest asks for the retransmission of chunks of a recent segment, chunk ids are those of the chunk headers
+type MissingChunksRequest struct {
+	SegmentId int   `json:"segmentId"`
+	Quality   int   `json:"quality"`
+	Chunks    []int `json:"chunks"`
+}
+
+// MissingChunksResponse tells how many of the requested chunks are sent again
+type MissingChunksResponse struct {
+	Chunks int `json:"chunks"`
+}
+
+// ContentKeyRequest asks for the content key of a private stream, the current one if no key id is given
+type ContentKeyRequest struct {
+	KeyId *uint32 `json:"keyId,omitempty"`
+}
+
+// ContentKeyResponse is the AES-256-GCM key of the key id, it is replaced after Expires in unix milliseconds.
+// The host also pushes it unrequested to every authorized viewer when the key is replaced.
+type ContentKeyResponse struct {
+	KeyId   uint32 `json:"keyId"`
+	Key     []byte `json:"key"`
+	Expires int64  `json:"expires"`
+}
+
+// AccessRequest grants or revokes access to a private stream for a viewer address, only the owner may send it
+type AccessRequest struct {
+	Address string `json:"address"`
+}
+
+type AccessResponse struct{}
+
+// RelayRequest registers the sender as relay, it receives every quality level and overflow viewers are redirected to it.
+// Only relays listed in the config of the host can register.
+type RelayRequest struct{}
+
+type RelayResponse struct{}
+
+// MeshRequest opts in to receive chunks from other viewers, a forwarder also sends them on to up to Capacity viewers
+type MeshRequest struct {
+	Forward  bool `json:"forward"`
+	Capacity int  `json:"capacity"`
+}
+
+type MeshResponse struct{}
+
+// MeshReportRequest tells whether a segment arrived complete from the forwarder of the viewer
+type MeshReportRequest struct {
+	SegmentId int  `json:"segmentId"`
+	Complete  bool `json:"complete"`
+}
+
+// MeshAssignment is pushed to mesh members when their assignment changes: a forwarder receives the viewers it sends
+// chunks on to, a viewer the forwarder it receives chunks from. A viewer without forwarder receives from the host.
+type MeshAssignment struct {
+	Forwarder string   `json:"forwarder,omitempty"`
+	Targets   []string `json:"targets,omitempty"`
+}
+
+type PanelsResponse struct {
+	Panels string `json:"panels"`
+}
+
+type ThumbnailResponse struct {
+	Image []byte `json:"image"`
+}
+
+type ViewCountResponse struct {
+	Viewers int `json:"viewers"`
+}
+
+type DonationIdResponse struct {
+	DonationId string `json:"donationId"`
+}
+
+type ChatResponse struct{}
+
+// legacyResponse is implemented by responses that novon.tv clients from before the versioned protocol understand
+type legacyResponse interface {
+	legacyPayload() (PayloadType, []byte)
+}
+
+func (r PanelsResponse) legacyPayload() (PayloadType, []byte) {
+	return PayloadText, []byte(r.Panels)
+}
+
+func (r ChannelInfo) legacyPayload() (PayloadType, []byte) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		log.Println("error on creating channel info response", err.Error())
+	}
+	return PayloadText, data
+}
+
+func (r ThumbnailResponse) legacyPayload() (PayloadType, []byte) {
+	return PayloadBinary, r.Image
+}
+
+func (r ViewCountResponse) legacyPayload() (PayloadType, []byte) {
+	return PayloadText, []byte(strconv.Itoa(r.Viewers))
+}
+
+func (r DonationIdResponse) legacyPayload() (PayloadType, []byte) {
+	return PayloadText, []byte(r.DonationId)
+}
+
+func (r QualityResponse) legacyPayload() (PayloadType, []byte) {
+	return PayloadText, []byte(strconv.Itoa(r.SegmentId))
+}
+
+func (r ChatResponse) legacyPayload() (PayloadType, []byte) {
+	return PayloadBinary, []byte("success")
+}
+
+// controlRequest is a decoded request of either the versioned or the legacy protocol
+type controlRequest struct {
+	msg     *InboundMessage
+	version int
+	id      string
+	typ     string
+	body    json.RawMessage
+	legacy  bool
+}
+
+var errUnknownLegacyRequest = errors.New("unknown legacy request")
+
+// decodeRequest reads a versioned envelope, or a legacy raw string or {type, content} message
+func decodeRequest(msg *InboundMessage) (*controlRequest, error) {
+	if len(msg.Data) > 0 && msg.Data[0] == '{' {
+		var envelope Envelope
+		if err := json.Unmarshal(msg.Data, &envelope); err != nil {
+			return nil, &ProtocolError{Code: ErrorBadRequest, Message: err.Error()}
+		}
+
+		if envelope.V > 0 {
+			return &controlRequest{
+				msg:     msg,
+				version: envelope.V,
+				id:      envelope.ID,
+				typ:     envelope.Type,
+				body:    envelope.Body,
+			}, nil
+		}
+
+		//Chat messages of legacy clients
+		var legacy Message
+		if err := json.Unmarshal(msg.Data, &legacy); err != nil {
+			return nil, fmt.Errorf("%w: %v", errUnknownLegacyRequest, err)
+		}
+		return &controlRequest{msg: msg, typ: legacy.Type, body: legacy.Content, legacy: true}, nil
+	}
+
+	request := string(msg.Data)
+	switch request {
+	case RequestPing, RequestDisconnect, RequestPanels, RequestChannelInfo, RequestThumbnail, RequestViewCount, RequestDonationId:
+		return &controlRequest{msg: msg, typ: request, legacy: true}, nil
+	}
+
+	//"quality" followed by the level, e.g. "quality2"
+	if levelStr, ok := strings.CutPrefix(request, RequestQuality); ok {
+		level, err := strconv.Atoi(levelStr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid quality level %q", errUnknownLegacyRequest, levelStr)
+		}
+		body, _ := json.Marshal(QualityRequest{Level: level})
+		return &controlRequest{msg: msg, typ: RequestQuality, body: body, legacy: true}, nil
+	}
+
+	return nil, errUnknownLegacyRequest
+}
+
+// decodeBody unmarshals the request body, an empty body leaves v untouched
+func (r *controlRequest) decodeBody(v any) error {
+	if len(r.body) == 0 {
+		return nil
+	}
+	return json.Unmarshal(r.body, v)
+}
+
+// respond replies with the response body, legacy requests get the reply format they always had
+func (s *Streamer) respond(req *controlRequest, body any) {
+	if req.legacy {
+		response, ok := body.(legacyResponse)
+		if !ok {
+			return
+		}
+
+		payloadType, data := response.legacyPayload()
+		if payloadType == PayloadText {
+			s.replyText(string(data), req.msg)
+		} else {
+			s.reply(data, req.msg)
+		}
+		return
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		log.Println("error on creating response", req.typ, err.Error())
+		return
+	}
+	s.replyEnvelope(req, Envelope{V: ProtocolVersion, ID: req.id, Type: req.typ, Body: data})
+}
+
+// respondEncrypted replies with the response body encrypted end-to-end, there is no legacy format for secrets
+func (s *Streamer) respondEncrypted(req *controlRequest, body any) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		log.Println("error on creating response", req.typ, err.Error())
+		return
+	}
+	envelope, err := json.Marshal(Envelope{V: ProtocolVersion, ID: req.id, Type: req.typ, Body: data})
+	if err != nil {
+		log.Println("error on creating response envelope", err.Error())
+		return
+	}
+	s.replyTextEncrypted(string(envelope), req.msg)
+}
+
+// respondError replies with an error, legacy clients only ever received errors for chat messages
+func (s *Streamer) respondError(req *controlRequest, code string, message string) {
+	if req.legacy {
+		if req.typ == RequestChat {
+			s.reply([]byte("error: "+message), req.msg)
+		}
+		return
+	}
+
+	s.replyEnvelope(req, Envelope{V: ProtocolVersion, ID: req.id, Type: req.typ, Error: &ProtocolError{Code: code, Message: message}})
+}
+
+func (s *Streamer) replyEnvelope(req *controlRequest, envelope Envelope) {
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		log.Println("error on creating response envelope", err.Error())
+		return
+	}
+	s.replyText(string(data), req.msg)
+}
+
+// chunkHeaderFor is the chunk header version viewers of a protocol version receive
+func chunkHeaderFor(protocolVersion int) int {
+	if protocolVersion >= 2 {
+		return ChunkHeaderV2
+	}
+	return ChunkHeaderLegacy
+}
+
+// negotiateVersion picks the newest version both sides speak
+func negotiateVersion(versions []int) (int, bool) {
+	best := 0
+	for _, v := range versions {
+		if v <= ProtocolVersion && v > best {
+			best = v
+		}
+	}
+	return best, best > 0
+}
@@ -0,0 +1,187 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"testing"
+)
+
+func TestDecodeRequest(t *testing.T) {
+	tests := []struct {
+		data    string
+		typ     string
+		version int
+		id      string
+		body    string
+		legacy  bool
+		err     error
+		code    string
+	}{
+		{data: "ping", typ: RequestPing, legacy: true},
+		{data: "disconnect", typ: RequestDisconnect, legacy: true},
+		{data: "getpanels", typ: RequestPanels, legacy: true},
+		{data: "channelinfo", typ: RequestChannelInfo, legacy: true},
+		{data: "thumbnail", typ: RequestThumbnail, legacy: true},
+		{data: "viewcount", typ: RequestViewCount, legacy: true},
+		{data: "donationid", typ: RequestDonationId, legacy: true},
+		{data: "quality0", typ: RequestQuality, body: `{"level":0}`, legacy: true},
+		{data: "quality2", typ: RequestQuality, body: `{"level":2}`, legacy: true},
+		{data: "qualityX", err: errUnknownLegacyRequest},
+		{data: "quality", err: errUnknownLegacyRequest},
+		{data: "hello", err: errUnknownLegacyRequest},
+		{data: "", err: errUnknownLegacyRequest},
+		{
+			data:   `{"type":"chat-message","content":{"text":"hi","hash":""}}`,
+			typ:    RequestChat,
+			body:   `{"text":"hi","hash":""}`,
+			legacy: true,
+		},
+		{data: `{"v":2,"id":"7","type":"viewcount"}`, typ: RequestViewCount, version: 2, id: "7"},
+		{data: `{"v":2,"id":"8","type":"quality","body":{"level":1}}`, typ: RequestQuality, version: 2, id: "8", body: `{"level":1}`},
+		{data: `{"v":3,"id":"9","type":"ping"}`, typ: RequestPing, version: 3, id: "9"},
+		{data: `{"v":2,`, code: ErrorBadRequest},
+	}
+
+	for _, tt := range tests {
+		req, err := decodeRequest(&InboundMessage{Src: "viewer", Data: []byte(tt.data)})
+
+		var protocolErr *ProtocolError
+		switch {
+		case tt.err != nil:
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%q: error %v, want %v", tt.data, err, tt.err)
+			}
+			continue
+		case tt.code != "":
+			if !errors.As(err, &protocolErr) || protocolErr.Code != tt.code {
+				t.Errorf("%q: error %v, want %s", tt.data, err, tt.code)
+			}
+			continue
+		case err != nil:
+			t.Errorf("%q: %v", tt.data, err)
+			continue
+		}
+
+		if req.typ != tt.typ || req.version != tt.version || req.id != tt.id || req.legacy != tt.legacy || string(req.body) != tt.body {
+			t.Errorf("%q: decoded %+v, want type %s, version %d, id %q, legacy %v, body %s",
+				tt.data, req, tt.typ, tt.version, tt.id, tt.legacy, tt.body)
+		}
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		versions []int
+		version  int
+		ok       bool
+	}{
+		{versions: []int{1, 2}, version: 2, ok: true},
+		{versions: []int{2, ProtocolVersion + 1}, version: 2, ok: true},
+		{versions: []int{1}, version: 1, ok: true},
+		{versions: []int{ProtocolVersion + 1}, ok: false},
+		{versions: nil, ok: false},
+	}
+
+	for _, tt := range tests {
+		version, ok := negotiateVersion(tt.versions)
+		if version != tt.version || ok != tt.ok {
+			t.Errorf("negotiateVersion(%v) = %d, %v, want %d, %v", tt.versions, version, ok, tt.version, tt.ok)
+		}
+	}
+}
+
+func TestLegacyPayloads(t *testing.T) {
+	tests := []struct {
+		response    legacyResponse
+		payloadType PayloadType
+		data        string
+	}{
+		{PanelsResponse{Panels: "[panels]"}, PayloadText, "[panels]"},
+		{ThumbnailResponse{Image: []byte{0xff, 0xd8}}, PayloadBinary, "\xff\xd8"},
+		{ViewCountResponse{Viewers: 12}, PayloadText, "12"},
+		{DonationIdResponse{DonationId: "abc"}, PayloadText, "abc"},
+		{QualityResponse{SegmentId: 1337}, PayloadText, "1337"},
+		{ChatResponse{}, PayloadBinary, "success"},
+	}
+
+	for _, tt := range tests {
+		payloadType, data := tt.response.legacyPayload()
+		if payloadType != tt.payloadType || string(data) != tt.data {
+			t.Errorf("%T: %v %q, want %v %q", tt.response, payloadType, data, tt.payloadType, tt.data)
+		}
+	}
+
+	//Channel info is the JSON it always was
+	payloadType, data := ChannelInfo{Panels: "panels", Viewers: 3}.legacyPayload()
+	var info ChannelInfo
+	if payloadType != PayloadText || json.Unmarshal(data, &info) != nil || info.Panels != "panels" || info.Viewers != 3 {
+		t.Errorf("ChannelInfo: %v %q", payloadType, data)
+	}
+}
+
+func TestLegacyReplies(t *testing.T) {
+	network := NewMemoryNetwork()
+	s := startLiveStreamer(t, network)
+	viewer := joinTestViewer(t, network, "viewer", s.ClientAddress())
+
+	tests := []struct {
+		request string
+		reply   *regexp.Regexp
+	}{
+		{"viewcount", regexp.MustCompile(`^0$`)},
+		{"donationid", regexp.MustCompile(`^[0-9a-f]{64}$`)},
+		{"quality1", regexp.MustCompile(`^[0-9]+$`)},
+		{`{"type":"chat-message","content":{"text":"hello"}}`, regexp.MustCompile(`^success$`)},
+		{
+			`{"type":"chat-message","content":{"text":"donate5"}}`,
+			regexp.MustCompile(`^error: donation validation error - no tx hash$`),
+		},
+	}
+
+	for _, tt := range tests {
+		if reply := viewer.reply(viewer.send([]byte(tt.request))); !tt.reply.Match(reply) {
+			t.Errorf("%s: reply %q, want %v", tt.request, reply, tt.reply)
+		}
+	}
+}
+
+func TestVersionedReplies(t *testing.T) {
+	network := NewMemoryNetwork()
+	s := startLiveStreamer(t, network)
+	viewer := joinTestViewer(t, network, "viewer", s.ClientAddress())
+
+	tests := []struct {
+		request string
+		typ     string
+		code    string
+	}{
+		{`{"v":2,"id":"1","type":"viewcount"}`, RequestViewCount, ""},
+		{`{"v":2,"id":"2","type":"hello","body":{"versions":[1,2]}}`, RequestHello, ""},
+		{`{"v":2,"id":"3","type":"hello","body":{"versions":[9]}}`, RequestHello, ErrorUnsupportedVersion},
+		{`{"v":2,"id":"4","type":"no-such-request"}`, "no-such-request", ErrorUnknownType},
+		{`{"v":3,"id":"5","type":"viewcount"}`, RequestViewCount, ErrorUnsupportedVersion},
+	}
+
+	for _, tt := range tests {
+		var request, response Envelope
+		json.Unmarshal([]byte(tt.request), &request)
+
+		reply := viewer.reply(viewer.send([]byte(tt.request)))
+		if err := json.Unmarshal(reply, &response); err != nil {
+			t.Errorf("%s: reply %q: %v", tt.request, reply, err)
+			continue
+		}
+		if response.V != ProtocolVersion || response.ID != request.ID || response.Type != tt.typ {
+			t.Errorf("%s: reply %s, want version %d, id %q and type %s", tt.request, reply, ProtocolVersion, request.ID, tt.typ)
+		}
+
+		code := ""
+		if response.Error != nil {
+			code = response.Error.Code
+		}
+		if code != tt.code {
+			t.Errorf("%s: reply %s, want error %q", tt.request, reply, tt.code)
+		}
+	}
+}
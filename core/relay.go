@@ -0,0 +1,316 @@
+package core
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// How often a relay pings its origin, well within the viewer timeout of the origin
+const relayPingInterval = 10 * time.Second
+
+// Segments a relay waits for an incomplete segment before it skips it
+const relayMaxPending = 3
+
+// relayUpstream connects a relay to its origin host. The relay joins the origin as a version 2 viewer that
+// receives every quality level, reassembles and verifies the segments and republishes them to its own viewers.
+// Republished chunks are byte for byte those of the origin, so viewers verify them against the origin key.
+type relayUpstream struct {
+	s         *Streamer
+	origin    string
+	originKey ed25519.PublicKey
+
+	//Fed by receiveMessages, only the run goroutine touches the fields below
+	inbox   chan *InboundMessage
+	levels  []ManifestLevel
+	pending map[int]*relaySegment
+	nextId  int
+	//Wallclock of the last published segment, older segments are replays of an earlier broadcast
+	wallclock int64
+}
+
+// relaySegment collects the chunks of a segment by quality level and chunk id
+type relaySegment struct {
+	chunks map[int]map[uint16][]byte
+	header map[int]ChunkHeader
+}
+
+func newRelayUpstream(s *Streamer, origin string) (*relayUpstream, error) {
+	originKey, err := PublicKeyFromAddress(origin)
+	if err != nil {
+		return nil, fmt.Errorf("invalid origin address %q: %w", origin, err)
+	}
+
+	return &relayUpstream{
+		s:         s,
+		origin:    origin,
+		originKey: originKey,
+		inbox:     make(chan *InboundMessage, 1024),
+		pending:   make(map[int]*relaySegment),
+		nextId:    -1,
+	}, nil
+}
+
+// receive queues a message of the origin, like the network it drops messages when the relay falls behind
+func (r *relayUpstream) receive(msg *InboundMessage) {
+	select {
+	case r.inbox <- msg:
+	default:
+	}
+}
+
+// run keeps the relay registered with the origin and republishes its segments until the context is done
+func (r *relayUpstream) run(ctx context.Context) {
+	log.Println("Relaying origin", r.origin)
+
+	ticker := time.NewTicker(relayPingInterval)
+	defer ticker.Stop()
+
+	r.register()
+	for {
+		select {
+		case <-ctx.Done():
+			r.request(RequestDisconnect, nil)
+			log.Println("relay: stopping")
+			return
+		case <-ticker.C:
+			r.register()
+		case msg := <-r.inbox:
+			r.handle(msg)
+		}
+	}
+}
+
+// register pings the origin and registers as relay, repeated so the relay survives restarts of the origin
+func (r *relayUpstream) register() {
+	r.request(RequestPing, nil)
+	r.request(RequestRelay, RelayRequest{})
+}
+
+func (r *relayUpstream) request(typ string, body any) {
+	envelope := Envelope{V: ProtocolVersion, Type: typ}
+	if body != nil {
+		envelope.Body, _ = json.Marshal(body)
+	}
+
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		log.Println("error on creating relay request", err.Error())
+		return
+	}
+	r.s.sendToClient(r.origin, data)
+}
+
+func (r *relayUpstream) handle(msg *InboundMessage) {
+	if len(msg.Data) == 0 {
+		return
+	}
+
+	if msg.Data[0] == ChunkHeaderV2 {
+		if header, _, err := ParseChunkHeader(msg.Data); err == nil {
+			r.addChunk(header, msg.Data)
+			return
+		}
+	}
+
+	if msg.Data[0] != '{' {
+		return
+	}
+
+	var envelope Envelope
+	if err := json.Unmarshal(msg.Data, &envelope); err == nil && envelope.V > 0 {
+		if envelope.Type == RequestManifest && envelope.Error == nil {
+			var manifest Manifest
+			if err := json.Unmarshal(envelope.Body, &manifest); err == nil {
+				r.setLevels(manifest.Levels)
+			}
+		} else if envelope.Error != nil {
+			log.Println("relay: origin replied to", envelope.Type, "with", envelope.Error.Error())
+		}
+		return
+	}
+
+	//Everything the origin publishes to all viewers is passed on: chat messages, deletions and the end of the stream
+	var message Message
+	if err := json.Unmarshal(msg.Data, &message); err != nil {
+		return
+	}
+	switch message.Type {
+	case "stream-offline":
+		if r.s.state.end() {
+			r.s.endStream()
+		}
+	case "":
+		r.s.publish(msg.Data)
+	default:
+		r.s.publishText(string(msg.Data))
+	}
+}
+
+// setLevels takes over the quality ladder of the origin manifest
+func (r *relayUpstream) setLevels(levels []ManifestLevel) {
+	if len(levels) == 0 {
+		return
+	}
+	r.levels = levels
+
+	source := &sourceInfo{
+		codec:      levels[0].Codec,
+		resolution: levels[0].Resolution,
+		framerate:  levels[0].Framerate,
+	}
+	for _, level := range levels[1:] {
+		source.transcoders = append(source.transcoders, Transcode{Resolution: level.Resolution, Framerate: level.Framerate, Codec: level.Codec})
+	}
+	r.s.source.Store(source)
+	r.flush()
+}
+
+func (r *relayUpstream) addChunk(header ChunkHeader, chunk []byte) {
+	id := int(header.SegmentId)
+	if r.nextId == -1 {
+		r.nextId = id
+	}
+	if id < r.nextId {
+		return
+	}
+
+	segment, ok := r.pending[id]
+	if !ok {
+		segment = &relaySegment{
+			chunks: make(map[int]map[uint16][]byte),
+			header: make(map[int]ChunkHeader),
+		}
+		r.pending[id] = segment
+	}
+
+	quality := int(header.Quality)
+	if segment.chunks[quality] == nil {
+		segment.chunks[quality] = make(map[uint16][]byte)
+		segment.header[quality] = header
+	}
+	segment.chunks[quality][header.ChunkId] = chunk
+
+	r.flush()
+}
+
+// flush republishes complete segments in order, a segment still incomplete when later ones arrived is skipped
+func (r *relayUpstream) flush() {
+	for len(r.pending) > 0 && len(r.levels) > 0 {
+		segment, ok := r.pending[r.nextId]
+		if ok && r.complete(segment) {
+			delete(r.pending, r.nextId)
+			r.publish(r.nextId, segment)
+			r.nextId++
+			continue
+		}
+
+		newest := r.nextId
+		for id := range r.pending {
+			newest = max(newest, id)
+		}
+		if newest-r.nextId < relayMaxPending {
+			return
+		}
+
+		if ok {
+			log.Println("relay: skipping incomplete segment", r.nextId)
+			delete(r.pending, r.nextId)
+		}
+		r.nextId++
+	}
+}
+
+// complete reports whether every quality level has enough chunks to be rebuilt
+func (r *relayUpstream) complete(segment *relaySegment) bool {
+	for quality := range r.levels {
+		header, ok := segment.header[quality]
+		if !ok || len(segment.chunks[quality]) < int(header.TotalChunks) {
+			return false
+		}
+	}
+	return true
+}
+
+// publish rebuilds and verifies every quality level of a segment and sends it to the viewers of the relay
+func (r *relayUpstream) publish(id int, segment *relaySegment) {
+	job := &segmentJob{
+		id:            id,
+		source:        r.s.source.Load(),
+		qualityChunks: make(map[int][][][]byte),
+	}
+
+	for quality := range r.levels {
+		chunks := make([][]byte, 0, len(segment.chunks[quality]))
+		for _, chunk := range segment.chunks[quality] {
+			chunks = append(chunks, chunk)
+		}
+
+		data, err := ReassembleSegment(chunks)
+		if err != nil {
+			log.Println("relay: error rebuilding segment", id, "quality", quality, err)
+			return
+		}
+
+		header := segment.header[quality]
+		if err := VerifySegment(data, header, r.originKey); err != nil {
+			log.Println("relay: rejecting segment", id, "quality", quality, err)
+			return
+		}
+		if header.Wallclock < r.wallclock {
+			log.Println("relay: rejecting replayed segment", id, "quality", quality)
+			return
+		}
+
+		//The origin may use another chunk size, data chunk 0 is full unless it is the only one
+		v2, err := rechunkSegment(data, header, len(segment.chunks[quality][0])-header.Length())
+		if err != nil {
+			log.Println("relay: error chunking segment", id, err)
+			return
+		}
+		job.qualityChunks[ChunkHeaderV2] = append(job.qualityChunks[ChunkHeaderV2], v2)
+
+		//Legacy viewers can be served from the relay as well, unless the stream is private
+		if !header.IsEncrypted() {
+			legacy := r.s.ChunkByByteSizeWithMetadata(data, r.s.network.ChunkSize, id)
+			job.qualityChunks[ChunkHeaderLegacy] = append(job.qualityChunks[ChunkHeaderLegacy], legacy)
+			job.lowest = data
+		}
+
+		job.sizes = append(job.sizes, len(data))
+		if quality == 0 {
+			job.segment = data
+			job.wallclock = header.Wallclock
+			job.discontinuity = header.IsDiscontinuity()
+			job.timing = segmentTiming{
+				pts:      header.PTS,
+				duration: time.Duration(header.DurationMs) * time.Millisecond,
+				keyframe: header.IsKeyframe(),
+			}
+		}
+	}
+
+	r.wallclock = job.wallclock
+	r.s.state.ingest()
+	r.s.sendSegment(job)
+}
+
+// isRelay reports whether the streamer relays another host instead of ingesting RTMP
+func (s *Streamer) isRelay() bool {
+	return s.relay != nil
+}
+
+// matchesAddress reports whether the address is in the list, as full client address or public key
+func matchesAddress(list []string, address string) bool {
+	pubKey := address[strings.LastIndex(address, ".")+1:]
+	for _, entry := range list {
+		if entry == address || entry == pubKey {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package core
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+const testRelaySeed = "2222222222222222222222222222222222222222222222222222222222222222"
+
+// testRelayAddress is the address of the relay on the memory network, the public key of its seed
+func testRelayAddress(t *testing.T) string {
+	seed, err := hex.DecodeString(testRelaySeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey))
+}
+
+func TestRelayRepublishesSignedChunks(t *testing.T) {
+	network := NewMemoryNetwork()
+	origin := startLiveStreamer(t, network, WithChannel(ChannelConfig{
+		Path:    "test",
+		Seed:    testSeed,
+		Relays:  []string{testRelayAddress(t)},
+		Network: &NetworkConfig{SubClients: 4},
+	}))
+
+	relay := newTestStreamer(t, network, NewFakeTranscoder(), WithRelay(origin.ClientAddress()), WithChannel(ChannelConfig{
+		Path:    "test",
+		Seed:    testRelaySeed,
+		Network: &NetworkConfig{SubClients: 4},
+	}))
+	if err := relay.Start(); err != nil {
+		t.Fatalf("Start relay: %v", err)
+	}
+	waitFor(t, 5*time.Second, "the relay to register", func() bool { return len(origin.viewers.Relays()) == 1 })
+
+	//The relay goes live with the first segment it republishes
+	origin.publishTSPart(make([]byte, 4096))
+	waitFor(t, 5*time.Second, "the relay to go live", func() bool { return relay.State() == StateLive })
+
+	direct := joinTestViewer(t, network, "direct", origin.ClientAddress())
+	relayed := joinTestViewer(t, network, "relayed", relay.ClientAddress())
+	for _, viewer := range []*testViewer{direct, relayed} {
+		viewer.request("", RequestPing)
+	}
+	waitFor(t, 5*time.Second, "the viewers to join", func() bool { return origin.viewers.Count() == 2 && relay.viewers.Count() == 1 })
+
+	id := origin.getNextSegmentId()
+	segment := make([]byte, 5*CHUNK_SIZE/2)
+	rand.Read(segment)
+	origin.publishTSPart(segment)
+
+	for _, viewer := range []*testViewer{direct, relayed} {
+		viewer.receive("the segment", func(*InboundMessage) bool { return viewer.segment(id) != nil })
+	}
+	if !bytes.Equal(relayed.segment(id), segment) {
+		t.Fatal("relayed segment differs from the published one")
+	}
+
+	//Chunks of the relay are those of the origin, signed with the origin key
+	relayedChunks := make(map[string]bool)
+	for _, chunk := range relayed.chunks[id] {
+		relayedChunks[string(chunk)] = true
+	}
+	for _, chunk := range direct.chunks[id] {
+		if !relayedChunks[string(chunk)] {
+			t.Fatal("relayed chunks differ from those of the origin")
+		}
+	}
+
+	header, _, err := ParseChunkHeader(relayed.chunks[id][0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	originKey, err := PublicKeyFromAddress(origin.ClientAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifySegment(relayed.segment(id), header, originKey); err != nil {
+		t.Fatalf("VerifySegment = %v, want the segment signed by the origin", err)
+	}
+}
+
+func TestRelayNotConfigured(t *testing.T) {
+	network := NewMemoryNetwork()
+	origin := startLiveStreamer(t, network, WithChannel(ChannelConfig{
+		Path:    "test",
+		Seed:    testSeed,
+		Relays:  []string{testRelayAddress(t)},
+		Network: &NetworkConfig{SubClients: 4},
+	}))
+
+	stranger := joinTestViewer(t, network, "stranger", origin.ClientAddress())
+	response := stranger.call(RequestRelay, RelayRequest{})
+	if response.Error == nil || response.Error.Code != ErrorForbidden {
+		t.Fatalf("relay request = %+v, want forbidden", response)
+	}
+	if relays := origin.viewers.Relays(); len(relays) != 0 {
+		t.Fatalf("relays = %v, want none", relays)
+	}
+}
@@ -0,0 +1,62 @@
+package core
+
+// segmentBuffer keeps the chunks of the most recent segments for every chunk header version and quality level,
+// to send the last segment to joining viewers and to retransmit chunks viewers missed. It is not thread-safe.
+type segmentBuffer struct {
+	segments []*bufferedSegment
+	newest   int
+}
+
+type bufferedSegment struct {
+	id int
+	//Chunks of every quality level by chunk header version, the source quality first
+	qualityChunks map[int][][][]byte
+}
+
+func newSegmentBuffer(size int) *segmentBuffer {
+	return &segmentBuffer{
+		segments: make([]*bufferedSegment, size),
+		newest:   -1,
+	}
+}
+
+// add stores a segment, replacing the oldest one when the buffer is full
+func (b *segmentBuffer) add(id int, qualityChunks map[int][][][]byte) {
+	b.newest = (b.newest + 1) % len(b.segments)
+	b.segments[b.newest] = &bufferedSegment{id: id, qualityChunks: qualityChunks}
+}
+
+// get returns the chunks of a buffered segment, quality levels beyond the available ones get the lowest quality
+func (b *segmentBuffer) get(id int, chunkHeader int, quality int) [][]byte {
+	if b == nil {
+		return nil
+	}
+
+	for _, segment := range b.segments {
+		if segment == nil || segment.id != id {
+			continue
+		}
+
+		qualityChunks := segment.qualityChunks[chunkHeader]
+		if len(qualityChunks) == 0 {
+			return nil
+		}
+		return qualityChunks[min(max(quality, 0), len(qualityChunks)-1)]
+	}
+	return nil
+}
+
+// last returns the chunks of the newest segment in the lowest quality it is available in
+func (b *segmentBuffer) last(chunkHeader int) [][]byte {
+	if b == nil || b.newest < 0 {
+		return nil
+	}
+
+	qualityChunks := b.segments[b.newest].qualityChunks[chunkHeader]
+	for q := len(qualityChunks) - 1; q >= 0; q-- {
+		if qualityChunks[q] != nil {
+			return qualityChunks[q]
+		}
+	}
+	return nil
+}
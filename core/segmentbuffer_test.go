@@ -0,0 +1,124 @@
+package core
+
+import (
+	"encoding/json"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// bufferedTestSegment has a single chunk per quality level, holding the segment id and the level
+func bufferedTestSegment(id int, levels int) map[int][][][]byte {
+	qualityChunks := make([][][]byte, levels)
+	for q := range qualityChunks {
+		qualityChunks[q] = [][]byte{{byte(id), byte(q)}}
+	}
+	return map[int][][][]byte{ChunkHeaderV2: qualityChunks}
+}
+
+func TestSegmentBufferEviction(t *testing.T) {
+	b := newSegmentBuffer(3)
+	if b.last(ChunkHeaderV2) != nil {
+		t.Fatal("empty buffer has a last segment")
+	}
+
+	for id := 0; id < 5; id++ {
+		b.add(id, bufferedTestSegment(id, 2))
+	}
+	for id := 0; id < 2; id++ {
+		if b.get(id, ChunkHeaderV2, 0) != nil {
+			t.Fatalf("segment %d still buffered after 3 newer ones", id)
+		}
+	}
+	for id := 2; id < 5; id++ {
+		if chunks := b.get(id, ChunkHeaderV2, 0); len(chunks) != 1 || chunks[0][0] != byte(id) {
+			t.Fatalf("segment %d = %v, want it buffered", id, chunks)
+		}
+	}
+
+	//Levels beyond the available ones get the lowest quality, new viewers get the lowest quality too
+	if chunks := b.get(4, ChunkHeaderV2, 5); chunks[0][1] != 1 {
+		t.Fatalf("quality 5 = %v, want the lowest level", chunks)
+	}
+	if chunks := b.get(4, ChunkHeaderV2, -1); chunks[0][1] != 0 {
+		t.Fatalf("quality -1 = %v, want the source", chunks)
+	}
+	if chunks := b.last(ChunkHeaderV2); chunks[0][0] != 4 || chunks[0][1] != 1 {
+		t.Fatalf("last = %v, want the lowest level of segment 4", chunks)
+	}
+	if b.get(4, ChunkHeaderLegacy, 0) != nil {
+		t.Fatal("chunks of another chunk header version")
+	}
+
+	//A skipped lowest level is passed over
+	skipped := bufferedTestSegment(5, 2)
+	skipped[ChunkHeaderV2][1] = nil
+	b.add(5, skipped)
+	if chunks := b.last(ChunkHeaderV2); chunks[0][0] != 5 || chunks[0][1] != 0 {
+		t.Fatalf("last = %v, want the source of segment 5", chunks)
+	}
+}
+
+func TestAllowRetransmit(t *testing.T) {
+	viewers := NewViewers(time.Minute, NewMemoryNetwork().Join("host", 1), 1)
+	viewers.AddOrUpdateAddress("viewer", ChunkHeaderV2)
+
+	if allowed := viewers.AllowRetransmit("stranger", 1); allowed != 0 {
+		t.Fatalf("unknown viewer allowed %d chunks", allowed)
+	}
+	if allowed := viewers.AllowRetransmit("viewer", RETRANSMIT_BURST+10); allowed != RETRANSMIT_BURST {
+		t.Fatalf("allowed %d chunks, want the burst of %d", allowed, RETRANSMIT_BURST)
+	}
+	if allowed := viewers.AllowRetransmit("viewer", 1); allowed != 0 {
+		t.Fatalf("allowed %d chunks after the burst", allowed)
+	}
+
+	//The limit refills at RETRANSMIT_CHUNKS_PER_SECOND
+	time.Sleep(2 * time.Second / RETRANSMIT_CHUNKS_PER_SECOND)
+	if allowed := viewers.AllowRetransmit("viewer", RETRANSMIT_BURST); allowed < 1 || allowed >= RETRANSMIT_BURST {
+		t.Fatalf("allowed %d chunks after refilling, want about 2", allowed)
+	}
+}
+
+func TestMissingChunks(t *testing.T) {
+	network := NewMemoryNetwork()
+	s := startLiveStreamer(t, network)
+	viewer := joinTestViewer(t, network, "viewer", s.ClientAddress())
+	viewer.request("", RequestPing)
+	waitFor(t, 5*time.Second, "the viewer to join", func() bool { return s.viewers.Count() == 1 })
+
+	id := s.getNextSegmentId()
+	segment := make([]byte, 5*CHUNK_SIZE/2)
+	rand.Read(segment)
+	s.publishTSPart(segment)
+	viewer.receive("the segment", func(*InboundMessage) bool { return viewer.segment(id) != nil })
+	received := len(viewer.chunks[id])
+
+	missing := func(segmentId int, chunks ...int) Envelope {
+		return viewer.call(RequestMissing, MissingChunksRequest{SegmentId: segmentId, Chunks: chunks})
+	}
+
+	//Out of range and repeated chunk ids are left out
+	response := missing(id, 2, 2, -1, 3, 99)
+	var sent MissingChunksResponse
+	if response.Error != nil || json.Unmarshal(response.Body, &sent) != nil || sent.Chunks != 1 {
+		t.Fatalf("missing chunks = %+v, want 1 chunk sent", response)
+	}
+	//The chunk may arrive before the reply
+	if len(viewer.chunks[id]) == received {
+		viewer.receive("the chunk", func(*InboundMessage) bool { return len(viewer.chunks[id]) > received })
+	}
+	if len(viewer.chunks[id]) != received+1 {
+		t.Fatalf("%d chunks sent again, want 1", len(viewer.chunks[id])-received)
+	}
+
+	if response := missing(id+1, 0); response.Error == nil || response.Error.Code != ErrorUnavailable {
+		t.Fatalf("missing chunks of a future segment = %+v, want %s", response, ErrorUnavailable)
+	}
+
+	//Beyond the limit viewers are told to ask again later
+	s.viewers.AllowRetransmit("viewer", RETRANSMIT_BURST)
+	if response := missing(id, 0); response.Error == nil || response.Error.Code != ErrorRateLimited {
+		t.Fatalf("missing chunks beyond the limit = %+v, want %s", response, ErrorRateLimited)
+	}
+}
@@ -0,0 +1,67 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+var (
+	ErrSegmentUnsigned  = errors.New("segment is not signed")
+	ErrSegmentHash      = errors.New("segment hash mismatch")
+	ErrSegmentSignature = errors.New("invalid segment signature")
+	ErrInvalidPublicKey = errors.New("invalid public key")
+)
+
+// signSegment hashes the segment and signs it with the host key. The signature covers the segment id, quality level
+// and wallclock as well so a relay cannot replay an old segment in place of a new one. Segment ids start at 0 again
+// on every run of the host, the wallclock tells a segment of an earlier broadcast apart.
+func signSegment(key ed25519.PrivateKey, header *ChunkHeader, segment []byte) ([32]byte, []byte) {
+	hash := sha256.Sum256(segment)
+	return hash, ed25519.Sign(key, signedSegmentMessage(header, hash))
+}
+
+// signedSegmentMessage is the segment id as little endian uint32, the quality level, the wallclock as little endian
+// int64 and the SHA-256 hash of the segment
+func signedSegmentMessage(header *ChunkHeader, hash [32]byte) []byte {
+	message := make([]byte, 0, 4+1+8+sha256.Size)
+	message = binary.LittleEndian.AppendUint32(message, header.SegmentId)
+	message = append(message, header.Quality)
+	message = binary.LittleEndian.AppendUint64(message, uint64(header.Wallclock))
+	return append(message, hash[:]...)
+}
+
+// VerifySegment checks that a segment, as rebuilt by ReassembleSegment, is the one the host signed.
+// The header is that of any of its chunks and publicKey is the key of the host, see PublicKeyFromAddress.
+// A valid signature does not make a segment current: viewers reject segments whose wallclock is older than that of
+// the segments they already played, those are replays of an earlier broadcast.
+func VerifySegment(segment []byte, header ChunkHeader, publicKey ed25519.PublicKey) error {
+	if header.Signature == nil {
+		return ErrSegmentUnsigned
+	}
+	if len(publicKey) != ed25519.PublicKeySize {
+		return ErrInvalidPublicKey
+	}
+
+	if sha256.Sum256(segment) != header.SegmentHash {
+		return ErrSegmentHash
+	}
+	if !ed25519.Verify(publicKey, signedSegmentMessage(&header, header.SegmentHash), header.Signature) {
+		return ErrSegmentSignature
+	}
+	return nil
+}
+
+// PublicKeyFromAddress returns the public key of an NKN client address, with or without identifier
+func PublicKeyFromAddress(address string) (ed25519.PublicKey, error) {
+	pubKeyHex := address[strings.LastIndex(address, ".")+1:]
+
+	publicKey, err := hex.DecodeString(pubKeyHex)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return nil, ErrInvalidPublicKey
+	}
+	return publicKey, nil
+}
@@ -0,0 +1,96 @@
+package core
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// signedTestSegment chunks a random segment signed with the key and returns it with the header of its first chunk
+func signedTestSegment(t *testing.T, key ed25519.PrivateKey) ([]byte, ChunkHeader) {
+	t.Helper()
+
+	segment := make([]byte, 2*CHUNK_SIZE+17)
+	rand.Read(segment)
+
+	chunks, err := chunkSegmentV2(segment, CHUNK_SIZE, segmentMeta{id: 7, quality: 1, wallclock: 1700000000000, signingKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reassembled, err := ReassembleSegment(chunks)
+	if err != nil || !bytes.Equal(reassembled, segment) {
+		t.Fatalf("reassembling: %v", err)
+	}
+	header, _, err := ParseChunkHeader(chunks[len(chunks)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reassembled, header
+}
+
+func TestVerifySegment(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	other := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{2}, ed25519.SeedSize))
+	segment, header := signedTestSegment(t, key)
+
+	publicKey, err := PublicKeyFromAddress("novon." + hex.EncodeToString(key.Public().(ed25519.PublicKey)))
+	if err != nil {
+		t.Fatalf("PublicKeyFromAddress: %v", err)
+	}
+	if err := VerifySegment(segment, header, publicKey); err != nil {
+		t.Fatalf("VerifySegment = %v, want a valid segment", err)
+	}
+
+	flipped := bytes.Clone(segment)
+	flipped[len(flipped)/2] ^= 1
+
+	tests := []struct {
+		name    string
+		segment []byte
+		header  func(h *ChunkHeader)
+		key     ed25519.PrivateKey
+		want    error
+	}{
+		{"flipped byte", flipped, nil, key, ErrSegmentHash},
+		{"wrong quality", segment, func(h *ChunkHeader) { h.Quality++ }, key, ErrSegmentSignature},
+		{"wrong segment id", segment, func(h *ChunkHeader) { h.SegmentId++ }, key, ErrSegmentSignature},
+		{"earlier broadcast", segment, func(h *ChunkHeader) { h.Wallclock -= 3600000 }, key, ErrSegmentSignature},
+		{"other address", segment, nil, other, ErrSegmentSignature},
+		{"unsigned", segment, func(h *ChunkHeader) { h.Signature = nil }, key, ErrSegmentUnsigned},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := header
+			if tt.header != nil {
+				tt.header(&h)
+			}
+			publicKey, err := PublicKeyFromAddress(hex.EncodeToString(tt.key.Public().(ed25519.PublicKey)))
+			if err != nil {
+				t.Fatalf("PublicKeyFromAddress: %v", err)
+			}
+			if err := VerifySegment(tt.segment, h, publicKey); !errors.Is(err, tt.want) {
+				t.Fatalf("VerifySegment = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublicKeyFromAddress(t *testing.T) {
+	publicKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize)).Public().(ed25519.PublicKey)
+	pubKeyHex := hex.EncodeToString(publicKey)
+
+	for _, address := range []string{pubKeyHex, "novon." + pubKeyHex, "__0__.novon." + pubKeyHex} {
+		key, err := PublicKeyFromAddress(address)
+		if err != nil || !key.Equal(publicKey) {
+			t.Fatalf("PublicKeyFromAddress(%q) = %x, %v", address, key, err)
+		}
+	}
+	for _, address := range []string{"", "novon.", "novon." + pubKeyHex[2:], "novon." + pubKeyHex[:62] + "zz"} {
+		if _, err := PublicKeyFromAddress(address); !errors.Is(err, ErrInvalidPublicKey) {
+			t.Fatalf("PublicKeyFromAddress(%q) = %v, want %v", address, err, ErrInvalidPublicKey)
+		}
+	}
+}
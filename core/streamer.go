@@ -1,299 +1,497 @@
 package core
 
 import (
-	"bufio"
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"os"
-	"os/exec"
+	"net"
 	"runtime"
-	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	mtx "github.com/bluenviron/mediamtx/core"
 	"github.com/nknorg/nkn-sdk-go"
 )
 
-var segmentSendConfig = &nkn.MessageConfig{
-	Unencrypted: true,
-	NoReply:     true,
-}
+var (
+	ErrAlreadyActive         = errors.New("stream already active")
+	ErrTranscoderUnavailable = errors.New("transcoder unavailable, is ffmpeg installed?")
+)
 
 type Streamer struct {
-	isActive bool
-	quit     chan struct{}
+	//Serializes Start and Stop
+	lifecycle sync.Mutex
+	isActive  atomic.Bool
 
-	nknClient   *nkn.MultiClient
+	//Set while active, cancel stops all goroutines which are tracked by wg
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	mtxDone chan struct{}
+
+	transport   Transport
+	account     *nkn.Account
 	mtxCore     *mtx.Core
+	transcoder  Transcoder
 	transcoders []Transcode
 
-	EventHandler     Event
-	lastRtmpSegment  time.Time
-	sourceResolution int
-	sourceFramerate  int
-	sourceCodec      string
-	viewers          *Viewers
-	lastSegment      [][]byte
-	thumbnail        []byte
-	config           *Config
-	segmentId        int
+	Events   *EventBus
+	state    *streamStateMachine
+	viewers  *Viewers
+	config   *ChannelConfig
+	source   atomic.Pointer[sourceInfo]
+	pipeline *publishPipeline
+
+	//Guards the state the pipeline leaves for message handling
+	segmentMu     sync.RWMutex
+	segments      *segmentBuffer
+	manifest      *liveManifest
+	nextSegmentId int
+	thumbnail     []byte
+
+	//Set for private streams only
+	keys   *contentKeyring
+	access *accessList
+
+	//Set for relays only
+	relay *relayUpstream
+	//Round robin over the relays overflow viewers are redirected to
+	redirectIndex atomic.Uint64
+
+	//Network parameters of the current run, defaults applied
+	network NetworkConfig
+	//Chunk size adapted to the loss viewers report, at most network.ChunkSize
+	chunkSize atomic.Int64
+	//Set when the upload is limited
+	egress *egressLimiter
+	//Set when chunk sends are spread over the segment duration
+	pacer *sendPacer
+
+	//Set when viewers may forward chunks to each other
+	mesh *meshState
+
+	//Recipients of the quality levels, rebuilt when the viewers change
+	recipientsMu sync.Mutex
+	recipients   map[recipientsKey]cachedRecipients
+
+	panels    atomic.Pointer[string]
+	donations *donationRegistry
+	chatId    atomic.Uint64
+	balancer  *clientBalancer
+
+	configPath         string
+	channel            *ChannelConfig
+	mediaMTXConfigPath string
+	rtmpAddress        string
+	newTransport       TransportFactory
+	stallTimeout       time.Duration
+	endTimeout         time.Duration
+	legacyProtocol     bool
+	upstream           string
 }
 
-func NewStreamer() *Streamer {
-	return &Streamer{
-		quit: make(chan struct{}),
+func NewStreamer(opts ...Option) *Streamer {
+	s := &Streamer{
+		Events:         NewEventBus(),
+		donations:      newDonationRegistry(),
+		configPath:     "./config.json",
+		newTransport:   NewNknTransport,
+		transcoder:     NewFFmpegTranscoder(),
+		stallTimeout:   defaultStallTimeout,
+		endTimeout:     defaultEndTimeout,
+		legacyProtocol: true,
 	}
+	s.state = newStreamStateMachine(func(from, to StreamState) {
+		log.Printf("stream state: %v -> %v", from, to)
+		s.Events.Emit(StreamStateEvent{State: to, Previous: from})
+	})
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
+// Start connects to the network and starts ingesting, it returns once the stream host is running.
+// A stopped Streamer can be started again.
 func (s *Streamer) Start() error {
-	ffmpegInstalled := checkFfmpegInstalled()
-	ffmpegInstalledStr := "TRUE"
-	if !ffmpegInstalled {
-		ffmpegInstalledStr = "FALSE"
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+
+	if s.isActive.Load() {
+		return ErrAlreadyActive
 	}
 
-	payload := map[string]string{
-		"Type":        "FFMPEG_UPDATE",
-		"IsInstalled": ffmpegInstalledStr,
-		"OS":          runtime.GOOS,
+	transcoderErr := s.transcoder.Available()
+
+	//Other transcoders, such as the fake of tests, do not need ffmpeg
+	if _, ok := s.transcoder.(*FFmpegTranscoder); ok {
+		s.Events.Emit(FfmpegStatusEvent{
+			IsInstalled: transcoderErr == nil,
+			OS:          runtime.GOOS,
+		})
+		if transcoderErr != nil {
+			log.Println("Error: ffmpeg is not installed. Please install ffmpeg and try again.")
+		} else {
+			log.Println("ffmpeg is installed. Proceeding...")
+		}
 	}
-	s.EventHandler.Emit(payload)
 
-	if !ffmpegInstalled {
-		return nil
+	if transcoderErr != nil {
+		return fmt.Errorf("%w: %w", ErrTranscoderUnavailable, transcoderErr)
 	}
 
-	// Save original stdout/stderr
-	origStdout := os.Stdout
-	origStderr := os.Stderr
+	if s.channel != nil {
+		s.config = s.channel
+	} else {
+		cfg, err := NewConfig(s.configPath)
+		if err != nil {
+			return fmt.Errorf("error loading config: %w", err)
+		}
+		s.config = &cfg.ChannelConfigs()[0]
+	}
+	s.network = s.config.Network.withDefaults()
+	s.chunkSize.Store(int64(s.network.ChunkSize))
 
-	// Create a pipe
-	r, w, _ := os.Pipe()
+	s.Events.Emit(NknStatusEvent{
+		NumClients: 0,
+		Status:     "Starting",
+	})
+	s.state.transition(StateConnectingNetwork)
 
-	// Redirect stdout and stderr to the pipe
-	os.Stdout = w
-	os.Stderr = w
+	fmt.Println("Welcome to go-novon a golang client for RTMP streaming to novon")
+	fmt.Println("")
 
-	// Read from the pipe in a goroutine
-	watcher := NewLogWatcher()
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
 
-	// Register RTMP listener watcher
-	watcher.Register("[RTMP] listener opened on :", func(line string) bool {
-		const prefix = "[RTMP] listener opened on :"
-		idx := strings.Index(line, prefix)
-		if idx == -1 {
-			return false
-		}
+	transport, err := s.createClient(ctx)
+	if err != nil {
+		s.teardown()
+		return err
+	}
+	s.transport = transport
+	s.balancer = newClientBalancer(transport)
 
-		port := strings.TrimSpace(line[idx+len(prefix):])
-		fmt.Println("RTMP port detected:", port)
+	s.viewers = NewViewers(30*time.Second, s.transport, *s.network.ViewerSubClients)
+	s.goroutine(func() { s.viewers.RunCleanup(ctx, time.Second) })
 
-		payload := map[string]string{
-			"Type":  "RTMP_PORT",
-			"Value": port,
+	s.keys, s.access = nil, nil
+	if private := s.config.Private; private != nil {
+		keys, err := newContentKeyring(private.keyLifetime())
+		if err != nil {
+			s.teardown()
+			return fmt.Errorf("error creating content key: %w", err)
 		}
-		s.EventHandler.Emit(payload)
-
-		// Return true so it unregisters after this
-		return true
-	})
+		s.keys = keys
+		s.access = newAccessList(private.Allowlist)
+		s.goroutine(func() { s.rotateContentKeys(ctx, private.keyLifetime()) })
+		log.Println("Private stream, segments are encrypted")
+	}
 
-	// Register RTMP publishing watcher
-	watcher.Register("is publishing to path", func(line string) bool {
-		payload := map[string]string{
-			"Type": "RTMP_PUBLISH",
-		}
-		s.EventHandler.Emit(payload)
+	s.recipientsMu.Lock()
+	s.recipients = make(map[recipientsKey]cachedRecipients)
+	s.recipientsMu.Unlock()
 
-		// Return true so it unregisters after this
-		return true
-	})
+	s.egress = nil
+	if s.network.UploadKbps > 0 {
+		egress := newEgressLimiter(s.network.UploadKbps, s.network.ChunkSize+maxChunkHeaderSize, s.sendAsync)
+		s.egress = egress
+		s.goroutine(func() { egress.run(ctx) })
+	}
 
-	//Once we are running listen to exits;
-	watcher.Register("destroyed: terminated", func(line string) bool {
-		payload := map[string]string{
-			"Type": "RTMP_TERMINATED",
-		}
-		s.EventHandler.Emit(payload)
-		return false
-	})
+	s.pacer = nil
+	if s.network.Pacing > 0 {
+		pacer := newSendPacer(s.network.Pacing, s.dispatch)
+		s.pacer = pacer
+		s.goroutine(func() { pacer.run(ctx) })
+	}
 
-	go func() {
-		scanner := bufio.NewScanner(r)
-		for scanner.Scan() {
-			line := scanner.Text()
+	s.mesh = nil
+	if s.config.Mesh != nil {
+		s.mesh = newMeshState(*s.config.Mesh)
+	}
 
-			// 2. Echo to the original terminal (dev output)
-			watcher.Dispatch(line)
-			fmt.Fprintln(origStdout, "Captured: "+line)
+	//Segment ids keep counting up over restarts
+	firstSegmentId := 0
+	if s.pipeline != nil {
+		firstSegmentId = s.pipeline.nextSegmentId()
+	}
+	s.pipeline = newPublishPipeline(ctx, s, firstSegmentId, ed25519.NewKeyFromSeed(s.account.Seed()))
+	s.pipeline.start()
+
+	s.segmentMu.Lock()
+	s.segments = newSegmentBuffer(SEGMENT_BUFFER_SIZE)
+	s.manifest = newLiveManifest()
+	s.nextSegmentId = firstSegmentId
+	s.segmentMu.Unlock()
+
+	//Relays ingest the segments of their origin instead of an RTMP publisher
+	s.relay = nil
+	if s.upstream != "" {
+		relay, err := newRelayUpstream(s, s.upstream)
+		if err != nil {
+			s.teardown()
+			return err
 		}
-	}()
-
-	if s.isActive {
-		fmt.Fprintln(origStdout, "stream already active")
+		s.relay = relay
+		s.goroutine(func() { relay.run(ctx) })
+	} else if err := s.startMediaMTX(ctx, cancel); err != nil {
+		s.teardown()
+		return err
 	}
 
-	payload = map[string]string{
-		"Type":       "NKN_UPDATE",
-		"NumClients": "0",
-		"Status":     "Starting",
-	}
-	s.EventHandler.Emit(payload)
+	s.state.transition(StateWaitingForIngest)
 
-	s.isActive = true
+	s.loadPanels()
+	s.goroutine(func() { s.watchIngest(ctx) })
+	s.goroutine(func() { s.maintainStream(ctx) })
+	s.goroutine(func() { s.receiveMessages(ctx) })
+	s.goroutine(func() { s.reportNumClients(ctx) })
 
-	fmt.Println("Welcome to go-novon a golang client for RTMP streaming to novon")
-	fmt.Println("")
+	s.isActive.Store(true)
+	return nil
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
+// startMediaMTX runs the embedded MediaMTX that ingests RTMP and the monitor reporting its publishers
+func (s *Streamer) startMediaMTX(ctx context.Context, cancel context.CancelFunc) error {
+	settings := map[string]string{}
 
-	var err error
-	s.config, err = NewConfig("./config.json")
-	if err != nil {
-		panic(err)
+	//An explicit RTMP address overrides the one from the MediaMTX config file
+	if s.rtmpAddress != "" {
+		settings["rtmpAddress"] = s.rtmpAddress
 	}
 
-	s.viewers = NewViewers(30 * time.Second)
-	s.viewers.StartCleanup(ctx, time.Second)
-	defer s.viewers.Cleanup()
+	//Channels of a Host have no RTMP server of their own, the Host reports their publishers
+	acceptsRtmp := s.channel == nil
 
-	s.nknClient = s.createClient()
+	//The control API reports publishers and paths to the monitor. Channels of a Host share the config of the Host,
+	//only the Host keeps the API the user configured and channels use a private address.
+	var apiAddress string
+	var err error
+	if acceptsRtmp {
+		apiAddress, err = mtxAPIAddress(s.mediaMTXConfigPath, settings)
+	} else {
+		apiAddress, err = privateMTXAPI(settings)
+	}
+	if err != nil {
+		return err
+	}
 
-	var ok bool
-	s.mtxCore, ok = mtx.New(os.Args[1:], s.publishTSPart)
+	mtxCore, ok := newMediaMTX(s.mediaMTXConfigPath, settings, s.publishTSPart)
 	if !ok {
-		os.Exit(1)
+		return errors.New("error starting MediaMTX")
 	}
+	s.mtxCore = mtxCore
 
-	loadPanels()
-	s.maintainStream(ctx)
-	s.receiveMessages(ctx)
-	s.reportNumClients(ctx)
+	if acceptsRtmp {
+		_, port, _ := net.SplitHostPort(rtmpListenAddress(s.rtmpAddress, s.mediaMTXConfigPath))
+		log.Println("RTMP listening on port", port)
+		s.Events.Emit(RtmpPortEvent{Port: port})
+	}
+
+	monitor := newMTXMonitor(apiAddress, acceptsRtmp, s.mtxHooks())
+	s.goroutine(func() { monitor.run(ctx) })
 
+	//MediaMTX can exit on its own, e.g. on SIGINT, which stops all streaming goroutines
+	s.mtxDone = make(chan struct{})
 	go func() {
-		s.mtxCore.Wait()
+		defer close(s.mtxDone)
+		mtxCore.Wait()
 		log.Println("mtxCore awaited")
-
-		// Flush and restore
-		_ = w.Close()
-		os.Stdout = origStdout
-		os.Stderr = origStderr
-
 		cancel()
 	}()
 
 	return nil
 }
 
-func (s *Streamer) reportNumClients(ctx context.Context) {
+// goroutine runs fn in a goroutine that Stop waits for
+func (s *Streamer) goroutine(fn func()) {
+	s.wg.Add(1)
 	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				log.Println("maintainStream: stopping")
-				return
-			default:
-				time.Sleep(time.Second * 3)
-
-				connectedCount := NUM_SUB_CLIENTS
-				for _, v := range s.nknClient.GetClients() {
-					if v.IsClosed() {
-						connectedCount--
-					}
-				}
+		defer s.wg.Done()
+		fn()
+	}()
+}
 
-				payload := map[string]string{
-					"Type":       "NKN_UPDATE",
-					"NumClients": strconv.Itoa(connectedCount),
-					"Status":     "Connected",
-				}
+func (s *Streamer) reportNumClients(ctx context.Context) {
+	ticker := time.NewTicker(time.Second * 3)
+	defer ticker.Stop()
 
-				s.EventHandler.Emit(payload)
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("reportNumClients: stopping")
+			return
+		case <-ticker.C:
+			s.balancer.checkHealth()
+
+			subClients := s.balancer.stats()
+			connectedCount, healthyCount := 0, 0
+			for _, stats := range subClients {
+				if stats.Connected {
+					connectedCount++
+				}
+				if stats.Healthy {
+					healthyCount++
+				}
 			}
+
+			s.Events.Emit(NknStatusEvent{
+				NumClients: connectedCount,
+				NumHealthy: healthyCount,
+				Status:     "Connected",
+				SubClients: subClients,
+			})
 		}
-	}()
+	}
 }
 
+// Stop stops ingesting, waits for all goroutines to finish and disconnects from the network.
 func (s *Streamer) Stop() {
-	if !s.isActive {
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+
+	if !s.isActive.Load() {
 		log.Println("Stream not active.")
 		return
 	}
 
-	s.mtxCore.Close()
-	log.Println("mtxCore closed")
+	s.teardown()
+	s.isActive.Store(false)
+}
+
+// teardown releases everything Start acquired so far, in reverse order
+func (s *Streamer) teardown() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+
+	if s.mtxCore != nil {
+		s.mtxCore.Close()
+		<-s.mtxDone
+		s.mtxCore = nil
+		log.Println("mtxCore closed")
+	}
+
+	//Goroutines still use the transport on their way out, e.g. to unsubscribe
+	s.wg.Wait()
+
+	//Nothing else changes the state once all goroutines are done
+	if state := s.state.get(); state != StateConnectingNetwork {
+		s.state.transition(StateEnding)
+		if state.IsBroadcasting() {
+			s.broadcastOffline()
+		}
+	}
 
-	s.nknClient.Close()
-	log.Println("nkn client closed")
+	if s.transport != nil {
+		s.transport.Close()
+		log.Println("transport closed")
+	}
 
-	close(s.quit)
-	s.isActive = false
+	s.cancel = nil
+	s.segmentMu.Lock()
+	s.segments = nil
+	s.segmentMu.Unlock()
+	s.state.transition(StateIdle)
 }
 
 func (s *Streamer) IsActive() bool {
-	return s.isActive
+	return s.isActive.Load()
+}
+
+// State returns the current stream state
+func (s *Streamer) State() StreamState {
+	return s.state.get()
+}
+
+// Path is the RTMP path of the channel, empty when the streamer accepts any path
+func (s *Streamer) Path() string {
+	if s.channel != nil {
+		return s.channel.Path
+	}
+	return ""
 }
 
+// ClientAddress is the NKN address of the stream, empty before the first Start
 func (s *Streamer) ClientAddress() string {
-	return s.nknClient.Address()
+	if s.transport == nil {
+		return ""
+	}
+	return s.transport.Address()
 }
 
+// ClientWalletAddress is the wallet receiving donations, empty before the first Start
 func (s *Streamer) ClientWalletAddress() string {
-	return s.nknClient.Account().WalletAddress()
+	if s.account == nil {
+		return ""
+	}
+	return s.account.WalletAddress()
 }
 
-func (s *Streamer) createClient() *nkn.MultiClient {
+func (s *Streamer) createClient(ctx context.Context) (Transport, error) {
 	seed, _ := hex.DecodeString(s.config.Seed)
 	account, err := nkn.NewAccount(seed)
 	if err != nil {
-		log.Panic(err)
+		return nil, fmt.Errorf("error creating account: %w", err)
 	}
+	s.account = account
 
-	client, _ := nkn.NewMultiClient(account, "", NUM_SUB_CLIENTS, false, &nkn.ClientConfig{
-		ConnectRetries:   10,
-		AllowUnencrypted: true,
-	})
+	numSubClients := s.network.SubClients
+	client, err := s.newTransport(account, numSubClients)
+	if err != nil {
+		return nil, fmt.Errorf("error creating client: %w", err)
+	}
 
 	connectedClientsCount := 0
 
 	//5% startup connection leniency, improves startup time dramatically with minimal risk for service disruption.
-	for i := 0; i < NUM_SUB_CLIENTS-(NUM_SUB_CLIENTS/20); i++ {
-		<-client.OnConnect.C
+	for i := 0; i < numSubClients-(numSubClients/20); i++ {
+		<-client.OnConnect()
 		connectedClientsCount++
 
-		payload := map[string]string{
-			"Type":       "NKN_UPDATE",
-			"NumClients": strconv.Itoa(connectedClientsCount),
-			"Status":     "Starting",
-		}
-		s.EventHandler.Emit(payload)
+		s.Events.Emit(NknStatusEvent{
+			NumClients: connectedClientsCount,
+			Status:     "Starting",
+		})
 	}
 
 	//Then wait for the rest!
-	go func() {
-		for i := 0; i < NUM_SUB_CLIENTS/20; i++ {
-			<-client.OnConnect.C
+	s.goroutine(func() {
+		for i := 0; i < numSubClients/20; i++ {
+			select {
+			case <-ctx.Done():
+				return
+			case <-client.OnConnect():
+			}
 			connectedClientsCount++
 
-			payload := map[string]string{
-				"Type":       "NKN_UPDATE",
-				"NumClients": strconv.Itoa(connectedClientsCount),
-				"Status":     "Connected",
-			}
-			s.EventHandler.Emit(payload)
+			s.Events.Emit(NknStatusEvent{
+				NumClients: connectedClientsCount,
+				Status:     "Connected",
+			})
 		}
-	}()
+	})
 
-	log.Println("connected to NKN")
+	log.Println("connected to network")
 	log.Println("Your address", client.Address())
 
-	return client
+	return client, nil
+}
+
+// ChannelNetwork tells viewers how the host reaches them and how large chunks get
+type ChannelNetwork struct {
+	//Sub clients of a viewer the host sends to, unless the viewer pings with its own number
+	ViewerSubClients    int `json:"viewerSubClients"`
+	MaxViewerSubClients int `json:"maxViewerSubClients"`
+	//Maximum segment bytes in a chunk
+	ChunkSize int `json:"chunkSize"`
 }
 
 type ChannelInfo struct {
@@ -301,123 +499,149 @@ type ChannelInfo struct {
 	Viewers       int         `json:"viewers"`
 	Role          string      `json:"role"`
 	QualityLevels []Transcode `json:"qualityLevels"`
+	//Private streams only send encrypted segments, viewers request the key with content-key
+	Private bool `json:"private,omitempty"`
+	//Address of the host a relay republishes, segments are signed with its key
+	Origin string `json:"origin,omitempty"`
+	//Relay to watch from instead, when the host has reached its maximum number of viewers
+	Redirect string         `json:"redirect,omitempty"`
+	Network  ChannelNetwork `json:"network"`
 }
 
-func (s *Streamer) receiveMessages(ctx context.Context) {
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				log.Println("receiveMessages: stopping")
-				return
-			case msg := <-s.nknClient.OnMessage.C:
-				if msg == nil {
-					continue
-				}
+// watchIngest stalls and ends the stream when segments stop arriving
+func (s *Streamer) watchIngest(ctx context.Context) {
+	ticker := time.NewTicker(max(min(s.stallTimeout, s.endTimeout)/5, 10*time.Millisecond))
+	defer ticker.Stop()
 
-				//Always reply to panel, this can be displayed when we are not broadcasting.
-				if len(msg.Data) == 9 && string(msg.Data[:]) == "getpanels" {
-					go s.replyText(panels, msg)
-					continue
-				}
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("watchIngest: stopping")
+			return
+		case <-ticker.C:
+			if s.state.expire(s.stallTimeout, s.endTimeout) {
+				s.endStream()
+			}
+		}
+	}
+}
 
-				//Always reply to panel, this can be displayed when we are not broadcasting.
-				if len(msg.Data) == 11 && string(msg.Data[:]) == "channelinfo" {
+// endStream is called after the stream moved to StateEnding, it notifies viewers and waits for the next ingest
+func (s *Streamer) endStream() {
+	s.broadcastOffline()
+	s.state.transition(StateWaitingForIngest)
+}
 
-					role := ""
-					if msg.Src == s.config.Owner {
-						role = "owner"
-					}
+// mtxHooks turns MediaMTX lifecycle changes into events
+func (s *Streamer) mtxHooks() mtxHooks {
+	return mtxHooks{
+		onPublisherConnected:    s.publisherConnected,
+		onPublisherDisconnected: s.publisherDisconnected,
+		onReaderAdded: func(reader ReaderInfo) {
+			log.Println("MediaMTX reader added on path", reader.Path, "type", reader.Type)
+			s.Events.Emit(ReaderAddedEvent{Path: reader.Path, Reader: reader.Type})
+		},
+		onPathReady: func(path string) {
+			log.Println("MediaMTX path ready:", path)
+			s.Events.Emit(PathReadyEvent{Path: path, Ready: true})
+		},
+		onPathNotReady: func(path string) {
+			log.Println("MediaMTX path not ready:", path)
+			s.Events.Emit(PathReadyEvent{Path: path, Ready: false})
+		},
+		onError: func(err error) {
+			log.Println("MediaMTX error:", err)
+			s.Events.Emit(MediaMTXErrorEvent{Error: err.Error()})
+		},
+	}
+}
 
-					qualityLevels := make([]Transcode, 0)
-					qualityLevels = append(qualityLevels, Transcode{
-						Resolution: s.sourceResolution,
-						Framerate:  s.sourceFramerate,
-					})
+func (s *Streamer) publisherConnected(publisher PublisherInfo) {
+	log.Println("RTMP publisher", publisher.RemoteAddr, "connected to path", publisher.Path)
+	s.Events.Emit(RtmpPublishEvent{Path: publisher.Path, RemoteAddr: publisher.RemoteAddr})
+}
 
-					qualityLevels = append(qualityLevels, s.transcoders...)
+// publisherDisconnected ends the stream right away instead of waiting for the end timeout
+func (s *Streamer) publisherDisconnected(publisher PublisherInfo) {
+	log.Println("RTMP publisher", publisher.RemoteAddr, "disconnected from path", publisher.Path)
+	s.Events.Emit(RtmpTerminatedEvent{Path: publisher.Path, RemoteAddr: publisher.RemoteAddr})
 
-					response := ChannelInfo{
-						Panels:        panels,
-						Viewers:       len(viewerAddresses),
-						Role:          role,
-						QualityLevels: qualityLevels,
-					}
+	if s.state.end() {
+		s.endStream()
+	}
+}
 
-					json, err := json.Marshal(response)
-					if err != nil {
-						log.Println("error on creating channel info response", err.Error())
-					}
+// broadcastOffline tells all viewers the stream ended, so players stop gracefully instead of timing out
+func (s *Streamer) broadcastOffline() {
+	data, err := json.Marshal(Message{
+		Type:    "stream-offline",
+		Content: json.RawMessage("{}"),
+	})
+	if err != nil {
+		log.Println("error on creating offline message", err.Error())
+		return
+	}
 
-					go s.replyText(string(json), msg)
-					continue
-				}
+	payload := newPayload(PayloadText, data)
+	for _, recipients := range s.viewers.SubClientRecipients() {
+		s.send(recipients, payload)
+	}
+	log.Println("stream offline, notified", s.viewers.Count(), "viewers")
+}
 
-				//If we're not broadcasting don't reply to anything.
-				if !s.isBroadcasting() {
-					time.Sleep(time.Millisecond * 100)
-					continue
-				}
+func (s *Streamer) receiveMessages(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("receiveMessages: stopping")
+			return
+		case msg := <-s.transport.Messages():
+			if msg == nil {
+				continue
+			}
 
-				if len(msg.Data) == 4 && string(msg.Data[:]) == "ping" {
-					isNew := s.viewers.AddOrUpdateAddress(msg.Src)
-					if isNew {
-						log.Println("viewer joined: ", msg.Src)
-					}
-					//Send last segment to newly joined
-					if isNew {
-						for _, chunk := range s.lastSegment {
-							go s.sendToClient(msg.Src, chunk)
-						}
-					}
-				} else if len(msg.Data) == 9 && string(msg.Data[:]) == "thumbnail" {
-					go s.reply(s.thumbnail, msg)
-				} else if len(msg.Data) == 10 && string(msg.Data[:]) == "disconnect" {
-					s.viewers.Remove(msg.Src)
-				} else if len(msg.Data) == 9 && string(msg.Data[:]) == "viewcount" {
-					go s.replyText(strconv.Itoa(len(viewerAddresses)), msg)
-				} else if len(msg.Data) == 10 && string(msg.Data[:]) == "donationid" {
-					go s.replyText(generateDonationEntry(), msg)
-				} else if len(msg.Data) == 8 && strings.Contains(string(msg.Data[:]), "quality") {
-					qLevelStr, _ := strings.CutPrefix(string(msg.Data[:]), "quality")
-					qLevel, _ := strconv.Atoi(qLevelStr)
-					s.viewers.viewerQuality[msg.Src] = qLevel
-					go s.replyText(strconv.Itoa(s.segmentId), msg)
-				} else {
-					s.DecodeMessage(msg)
-				}
+			if s.isRelay() && msg.Src == s.relay.origin {
+				s.relay.receive(msg)
+				continue
 			}
+
+			s.handleMessage(ctx, msg)
 		}
-	}()
+	}
 }
 
 func (s *Streamer) maintainStream(ctx context.Context) {
-	go func() {
-		isSubscribed := false
-		lastSubscribe := time.Time{}
+	isSubscribed := false
+	lastSubscribe := time.Time{}
 
-		for {
-			select {
-			case <-ctx.Done():
-				log.Println("maintainStream: stopping")
-				return
-			default:
-				if s.isBroadcasting() {
-					if !isSubscribed || time.Since(lastSubscribe).Seconds() > 100*20 {
-						lastSubscribe = time.Now()
-						go s.nknClient.Subscribe("", "novon", 100, s.config.Title, nil)
-						isSubscribed = true
-					}
-				} else {
-					if isSubscribed {
-						go s.nknClient.Unsubscribe("", "novon", nil)
-						isSubscribed = false
-					}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("maintainStream: stopping")
+			//Leave the stream listing right away instead of waiting for the subscription to expire
+			if isSubscribed {
+				s.transport.Unsubscribe("novon")
+			}
+			return
+		case <-ticker.C:
+			//A stalled stream leaves the stream listing, as it did when ingest stopped for the stall timeout
+			if s.state.get() == StateLive {
+				if !isSubscribed || time.Since(lastSubscribe).Seconds() > 100*20 {
+					lastSubscribe = time.Now()
+					s.goroutine(func() { s.transport.Subscribe("novon", 100, s.config.Title) })
+					isSubscribed = true
+				}
+			} else {
+				if isSubscribed {
+					s.goroutine(func() { s.transport.Unsubscribe("novon") })
+					isSubscribed = false
 				}
-				time.Sleep(time.Second)
 			}
 		}
-	}()
+	}
 }
 
 func (s *Streamer) ChunkByByteSizeWithMetadata(data []byte, chunkSize int, segmentId int) [][]byte {
@@ -425,7 +649,7 @@ func (s *Streamer) ChunkByByteSizeWithMetadata(data []byte, chunkSize int, segme
 		panic("chunkSize must be positive")
 	}
 
-	totalChunks := (len(data) / chunkSize) + 1
+	totalChunks := (len(data) + chunkSize - 1) / chunkSize
 	chunks := make([][]byte, 0, totalChunks)
 
 	chunkId := 0
@@ -449,224 +673,129 @@ func (s *Streamer) ChunkByByteSizeWithMetadata(data []byte, chunkSize int, segme
 	return chunks
 }
 
-func (s *Streamer) EmitEvent(eventType string, data ...map[string]string) {
-	payload := map[string]string{
-		"Type": eventType,
-	}
-	if len(data) > 0 {
-		for k, v := range data[0] {
-			payload[k] = v
-		}
-	}
-	s.EventHandler.Emit(payload)
-}
-
 func (s *Streamer) publishTSPart(segment []byte) {
 
-	if !s.isBroadcasting() {
-		info, err := s.probeVideoInfo(segment)
+	//Probe the first segment of every ingest, the publisher may have changed its settings
+	if s.state.get() == StateWaitingForIngest {
+		info, err := s.transcoder.Probe(segment)
 		if err != nil {
-			panic(err)
+			log.Println("Error probing segment, skipping:", err)
+			return
 		}
 
-		s.sourceCodec = info["codec"]
-		s.sourceResolution, _ = strconv.Atoi(strings.Split(info["resolution"], "x")[1])
-		s.sourceFramerate, _ = strconv.Atoi(strings.Split(info["framerate"], "/")[0])
+		source := &sourceInfo{
+			codec:      info.Codec,
+			resolution: info.Height,
+			framerate:  info.FramesPerSecond(),
+		}
 
-		log.Println("Receiving codec:", s.sourceCodec, "resolution:", s.sourceResolution, "framerate:", s.sourceFramerate)
+		log.Println("Receiving codec:", source.codec, "resolution:", source.resolution, "framerate:", source.framerate)
 
-		s.EmitEvent("VIDEO_INFO", info)
+		s.Events.Emit(VideoInfoEvent{
+			Codec:      info.Codec,
+			Resolution: info.Resolution(),
+			Framerate:  info.Framerate,
+		})
 
-		s.transcoders = s.getTranscoders(s.config)
-		for _, v := range s.transcoders {
+		source.transcoders = s.getTranscoders(s.config, source.resolution, source.framerate)
+		for _, v := range source.transcoders {
 			log.Println("Stream will be transcoded in:", v.Resolution, "p", v.Framerate)
 		}
+		s.source.Store(source)
 	}
 
-	s.lastRtmpSegment = time.Now()
+	//The first segment of an ingest does not continue the timestamps of the segment before it
+	discontinuity := s.state.ingest() == StateWaitingForIngest
+	if !s.isBroadcasting() {
+		return
+	}
 	//os.WriteFile("test.ts", segment, os.FileMode(0644))
 
-	go func() {
-		sourceChunks := s.ChunkByByteSizeWithMetadata(segment, CHUNK_SIZE, s.segmentId)
-		transcodedChunksArray := make([][][]byte, 0)
-		transcodedChunksArray = append(transcodedChunksArray, sourceChunks)
-
-		s.EmitEvent("PUBLISH", map[string]string{
-			"numViewers":  strconv.Itoa(len(viewerAddresses)),
-			"segmentSize": strconv.Itoa(len(segment)),
-			"numChunks":   strconv.Itoa(len(sourceChunks)),
-		})
-
-		//No transcoding, publish to all viewers in source quality.
-		if len(s.transcoders) == 0 {
-			for i := 0; i < len(sourceChunks); i++ {
-				go s.publish(sourceChunks[i])
-			}
-			s.segmentId++
-		} else {
-			startTranscoderTime := time.Now()
-
-			for _, t := range s.transcoders {
-
-				beginTime := time.Now()
-				segment = s.resizeSegment(t, segment)
-				timeSpent := time.Since(beginTime).Milliseconds()
-
-				tChunks := s.ChunkByByteSizeWithMetadata(segment, CHUNK_SIZE, s.segmentId)
-				transcodedChunksArray = append(transcodedChunksArray, tChunks)
-				log.Printf("Transcoded -%v@%v size: %v, chunks: %v, timeSpent: %v\n", t.Resolution, t.Framerate, len(segment), len(tChunks), timeSpent)
-			}
-			s.segmentId++
+	s.pipeline.enqueue(segment, s.source.Load(), discontinuity)
+}
 
-			if len(viewerAddresses) > 0 {
-				s.publishQualityLevels(transcodedChunksArray...)
-			}
+// sendSegment is the last pipeline stage, it is called for every segment in id order
+func (s *Streamer) sendSegment(job *segmentJob) {
+	loss, _ := s.viewers.Loss()
+	s.Events.Emit(PublishEvent{
+		NumViewers:   s.viewers.Count(),
+		SegmentSize:  len(job.segment),
+		NumChunks:    len(job.qualityChunks[ChunkHeaderV2][0]),
+		NumForwarded: s.mesh.forwarded(),
+		ChunkSize:    int(s.chunkSize.Load()),
+		Loss:         loss,
+		Redundancy:   s.viewers.Redundancy(),
+		Egress:       s.EgressStats(),
+		PacingMs:     int(s.pacingWindow(job.timing.duration).Milliseconds()),
+	})
+	s.adaptChunkSize()
 
-			totalTranscodingMs := time.Since(startTranscoderTime).Milliseconds()
-			if totalTranscodingMs > 1000 && totalTranscodingMs < 2000 {
-				log.Printf("WARNING: Total transcoding time '%vms' approaching segment duration, consider less transcoding configurations.", totalTranscodingMs)
-			} else if totalTranscodingMs > 2000 {
-				log.Printf("DANGER: Total transcoding time '%vms' exceeds segment duration, stream will suffer interrupts, reduce or remove transcoding configurations.", totalTranscodingMs)
-			}
+	//Every viewer gets the chunk header of the protocol version it speaks
+	if s.viewers.Count() > 0 {
+		var sends []pacedSend
+		for chunkHeader, qualityChunks := range job.qualityChunks {
+			sends = append(sends, s.qualityLevelSends(chunkHeader, qualityChunks...)...)
 		}
+		s.paceSends(sends, job.timing.duration)
+	}
 
-		if (s.segmentId-1)%10 == 0 {
-			go s.screengrabSegment(segment)
-		}
+	//Relays of private streams can not decrypt segments for thumbnails
+	if job.id%10 == 0 && job.lowest != nil {
+		s.goroutine(func() { s.screengrabSegment(job.lowest) })
+	}
 
-		//For fastest join times we take the lowest quality level
-		s.lastSegment = transcodedChunksArray[len(transcodedChunksArray)-1]
-	}()
+	s.segmentMu.Lock()
+	s.segments.add(job.id, job.qualityChunks)
+	s.nextSegmentId = job.id + 1
+	s.segmentMu.Unlock()
+
+	s.manifest.add(job)
+	if s.viewers.Count() > 0 {
+		s.publishManifest()
+	}
 }
 
 func (s *Streamer) screengrabSegment(segment []byte) {
-	// Output image file
-	width := "256"
-	height := "144"
-
-	// Command arguments for ffmpeg
-	cmd := exec.Command("ffmpeg",
-		"-i", "-", // read from stdin (pipe)
-		"-vframes", "1",
-		"-vf", fmt.Sprintf("scale=%s:%s", width, height), // resize filter
-		"-f",
-		"image2pipe",
-		"-")
-
-	var stdinPipe, stderrPipe bytes.Buffer
-	cmd.Stdin = &stdinPipe
-	cmd.Stderr = &stderrPipe
-
-	// Write MPEG-TS data to stdin pipe
-	stdinPipe.Write(segment)
-
-	var err error
-	s.thumbnail, err = cmd.Output()
-
+	thumbnail, err := s.transcoder.Thumbnail(segment, 256, 144)
 	if err != nil {
 		log.Println("Error capturing screenshot:", err)
-		log.Println("FFmpeg stderr:", stderrPipe.String())
 		return
 	}
 
+	s.segmentMu.Lock()
+	s.thumbnail = thumbnail
+	s.segmentMu.Unlock()
 	log.Println("Screenshot captured successfully.")
 }
 
-func (s *Streamer) resizeSegment(transcode Transcode, segment []byte) []byte {
-	//ultrafast superfast veryfast faster fast medium (default) slow slower veryslow
-
-	// Command arguments for ffmpeg
-	cmd := exec.Command("ffmpeg",
-		"-hwaccel", "auto",
-		"-i", "-", // read from stdin (pipe)
-		"-c:v", "libx264", // specify video encoder (optional)
-		"-crf", "30", // set constant rate factor (quality)
-		"-preset", "ultrafast", // set encoding preset for faster processing
-		"-acodec", "copy",
-		"-filter:v", fmt.Sprintf("scale=-2:%d,fps=%d", transcode.Resolution, transcode.Framerate),
-		"-copyts",
-		"-f", "mpegts",
-		"-")
-
-	var stdinPipe, stderrPipe bytes.Buffer
-	cmd.Stdin = &stdinPipe
-	cmd.Stderr = &stderrPipe
-
-	// Write MPEG-TS data to stdin pipe
-	stdinPipe.Write(segment)
-
-	resizedSegment, err := cmd.Output()
-
-	if err != nil {
-		log.Println("Error capturing screenshot:", err)
-		log.Println("FFmpeg stderr:", stderrPipe.String())
-		return nil
-	}
-
-	return resizedSegment
+// getLastSegment returns the chunks of the last segment with the given chunk header,
+// for fastest join times this is the lowest quality level
+func (s *Streamer) getLastSegment(chunkHeader int) [][]byte {
+	s.segmentMu.RLock()
+	defer s.segmentMu.RUnlock()
+	return s.segments.last(chunkHeader)
 }
 
-func (s *Streamer) probeVideoInfo(segment []byte) (map[string]string, error) {
-	// Create ffprobe command with pipe input
-	cmd := exec.Command("ffprobe", "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", "-i", "-")
-
-	var stdinPipe bytes.Buffer
-	cmd.Stdin = &stdinPipe
-
-	// Write MPEG-TS data to stdin pipe
-	stdinPipe.Write(segment)
-
-	// Capture ffprobe output
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return nil, fmt.Errorf("error probing video info: %w", err)
-	}
-
-	// Parse ffprobe JSON output
-	var info map[string]interface{}
-	err = json.Unmarshal(out, &info)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing ffprobe output: %w", err)
-	}
-
-	// Extract relevant info (modify as needed)
-	result := map[string]string{}
-	if streams, ok := info["streams"].([]interface{}); ok {
-		for _, stream := range streams {
-			if streamMap, ok := stream.(map[string]interface{}); ok {
-				if codecType, ok := streamMap["codec_type"].(string); ok && codecType == "video" {
-					result["codec"] = streamMap["codec_name"].(string)
-					if width, ok := streamMap["width"].(float64); ok {
-						result["resolution"] = fmt.Sprintf("%.0fx%.0f", width, streamMap["height"].(float64))
-					}
-					if r_frame_rate, ok := streamMap["r_frame_rate"].(string); ok {
-						result["framerate"] = r_frame_rate
-					}
-					break // Extract info only from the first video stream
-				}
-			}
-		}
-	}
-
-	return result, nil
+// getSegmentChunks returns the chunks of a recent segment, nil once it left the segment buffer
+func (s *Streamer) getSegmentChunks(id int, chunkHeader int, quality int) [][]byte {
+	s.segmentMu.RLock()
+	defer s.segmentMu.RUnlock()
+	return s.segments.get(id, chunkHeader, quality)
 }
 
-func checkFfmpegInstalled() bool {
-	// Command to check for ffmpeg (replace with actual command if needed)
-	cmd := exec.Command("ffmpeg", "-version")
-
-	err := cmd.Run()
-	if err != nil {
-		// Handle ffmpeg not found error
-		log.Println("Error: ffmpeg is not installed. Please install ffmpeg and try again.")
-		return false
-	}
+func (s *Streamer) getThumbnail() []byte {
+	s.segmentMu.RLock()
+	defer s.segmentMu.RUnlock()
+	return s.thumbnail
+}
 
-	// ffmpeg is available, continue with your application logic
-	log.Println("ffmpeg is installed. Proceeding...")
-	return true
+// getNextSegmentId is the id of the next segment viewers will receive
+func (s *Streamer) getNextSegmentId() int {
+	s.segmentMu.RLock()
+	defer s.segmentMu.RUnlock()
+	return s.nextSegmentId
 }
 
 func (s *Streamer) isBroadcasting() bool {
-	return time.Since(s.lastRtmpSegment).Seconds() < 5
+	return s.state.get().IsBroadcasting()
 }
@@ -0,0 +1,117 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSeed = "1111111111111111111111111111111111111111111111111111111111111111"
+
+// testMediaMTXConfig runs MediaMTX without any server, tests publish segments themselves
+const testMediaMTXConfig = `logLevel: error
+rtmp: no
+rtsp: no
+hls: no
+webrtc: no
+srt: no
+paths:
+  all:
+`
+
+// newTestStreamer creates a channel streamer on the memory network, it is stopped when the test ends
+func newTestStreamer(t *testing.T, network *MemoryNetwork, transcoder Transcoder, opts ...Option) *Streamer {
+	t.Helper()
+
+	mtxConfigPath := filepath.Join(t.TempDir(), "mediamtx.yml")
+	if err := os.WriteFile(mtxConfigPath, []byte(testMediaMTXConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts = append([]Option{
+		WithTransport(network.NewTransport),
+		WithTranscoder(transcoder),
+		WithChannel(ChannelConfig{Path: "test", Seed: testSeed, Title: "test", Network: &NetworkConfig{SubClients: 4}}),
+		WithMediaMTXConfigPath(mtxConfigPath),
+	}, opts...)
+	s := NewStreamer(opts...)
+	t.Cleanup(s.Stop)
+	return s
+}
+
+// startLiveStreamer starts a test streamer with the fake transcoder and publishes a first segment, so it is live
+func startLiveStreamer(t *testing.T, network *MemoryNetwork, opts ...Option) *Streamer {
+	t.Helper()
+
+	s := newTestStreamer(t, network, NewFakeTranscoder(), opts...)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	s.publishTSPart(make([]byte, 4096))
+	waitFor(t, 5*time.Second, "the stream to go live", func() bool { return s.State() == StateLive })
+	return s
+}
+
+// waitFor polls the condition until it holds or fails the test after the timeout
+func waitFor(t *testing.T, timeout time.Duration, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStartWithFakeTranscoder(t *testing.T) {
+	transcoder := NewFakeTranscoder()
+	s := newTestStreamer(t, NewMemoryNetwork(), transcoder)
+
+	//Events of a subscription arrive in order, every event before the stream went live is seen
+	events := make(chan Event, eventQueueSize)
+	sub := s.Events.Subscribe(func(e Event) { events <- e }, EventFfmpegStatus, EventStreamState)
+	defer sub.Unsubscribe()
+
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	s.publishTSPart(make([]byte, 4096))
+
+	timeout := time.After(5 * time.Second)
+	for live := false; !live; {
+		select {
+		case e := <-events:
+			switch e := e.(type) {
+			case FfmpegStatusEvent:
+				t.Fatalf("ffmpeg status reported for the fake transcoder: %+v", e)
+			case StreamStateEvent:
+				live = e.State == StateLive
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for the stream to go live")
+		}
+	}
+
+	if transcoder.Probes() != 1 {
+		t.Fatalf("probes = %d, want 1", transcoder.Probes())
+	}
+}
+
+func TestStartTranscoderUnavailable(t *testing.T) {
+	transcoder := NewFakeTranscoder()
+	transcoder.AvailableErr = errors.New("no transcoder")
+	s := newTestStreamer(t, NewMemoryNetwork(), transcoder)
+
+	err := s.Start()
+	if !errors.Is(err, ErrTranscoderUnavailable) || !strings.Contains(err.Error(), "no transcoder") {
+		t.Fatalf("Start = %v, want %v", err, ErrTranscoderUnavailable)
+	}
+	if s.IsActive() {
+		t.Fatal("streamer is active after a failed Start")
+	}
+}
@@ -0,0 +1,156 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// StreamState is the lifecycle state of a Streamer
+type StreamState int
+
+const (
+	// StateIdle is a streamer that is not started
+	StateIdle StreamState = iota
+	// StateConnectingNetwork waits for the sub clients to connect
+	StateConnectingNetwork
+	// StateWaitingForIngest is connected and waits for a publisher to send segments
+	StateWaitingForIngest
+	// StateLive receives segments and delivers them to viewers
+	StateLive
+	// StateStalled has not received a segment within the stall timeout, viewers are kept
+	StateStalled
+	// StateEnding tells viewers the stream went offline before waiting for ingest again or stopping
+	StateEnding
+)
+
+var streamStateNames = [...]string{
+	StateIdle:              "idle",
+	StateConnectingNetwork: "connecting-network",
+	StateWaitingForIngest:  "waiting-for-ingest",
+	StateLive:              "live",
+	StateStalled:           "stalled",
+	StateEnding:            "ending",
+}
+
+// streamStateTransitions lists the states every state may move to
+var streamStateTransitions = map[StreamState][]StreamState{
+	StateIdle:              {StateConnectingNetwork},
+	StateConnectingNetwork: {StateWaitingForIngest, StateIdle},
+	StateWaitingForIngest:  {StateLive, StateEnding},
+	StateLive:              {StateStalled, StateEnding},
+	StateStalled:           {StateLive, StateEnding},
+	StateEnding:            {StateWaitingForIngest, StateIdle},
+}
+
+const (
+	defaultStallTimeout = 5 * time.Second
+	defaultEndTimeout   = 30 * time.Second
+)
+
+func (s StreamState) String() string {
+	if s < 0 || int(s) >= len(streamStateNames) {
+		return fmt.Sprintf("StreamState(%d)", int(s))
+	}
+	return streamStateNames[s]
+}
+
+func (s StreamState) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// IsBroadcasting is true while segments are delivered to viewers, including short stalls
+func (s StreamState) IsBroadcasting() bool {
+	return s == StateLive || s == StateStalled
+}
+
+// streamStateMachine guards the state of a Streamer and the time of the last ingested segment
+type streamStateMachine struct {
+	mu         sync.Mutex
+	state      StreamState
+	lastIngest time.Time
+	onChange   func(from, to StreamState)
+}
+
+func newStreamStateMachine(onChange func(from, to StreamState)) *streamStateMachine {
+	return &streamStateMachine{onChange: onChange}
+}
+
+func (m *streamStateMachine) get() StreamState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// transition moves to the given state, transitions that are not defined are refused
+func (m *streamStateMachine) transition(to StreamState) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.transitionLocked(to)
+}
+
+func (m *streamStateMachine) transitionLocked(to StreamState) bool {
+	from := m.state
+	if from == to {
+		return true
+	}
+
+	for _, allowed := range streamStateTransitions[from] {
+		if allowed == to {
+			m.state = to
+			if m.onChange != nil {
+				m.onChange(from, to)
+			}
+			return true
+		}
+	}
+
+	log.Printf("stream state: refusing transition from %v to %v", from, to)
+	return false
+}
+
+// ingest records a received segment and returns the state before it, a waiting or stalled stream goes live
+func (m *streamStateMachine) ingest() StreamState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	from := m.state
+	m.lastIngest = time.Now()
+
+	if from == StateWaitingForIngest || from == StateStalled {
+		m.transitionLocked(StateLive)
+	}
+	return from
+}
+
+// end ends a broadcasting stream right away, it returns false when the stream was not broadcasting
+func (m *streamStateMachine) end() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.state.IsBroadcasting() {
+		return false
+	}
+	return m.transitionLocked(StateEnding)
+}
+
+// expire stalls or ends the stream when no segment arrived within the timeouts, it returns true when the stream ends
+func (m *streamStateMachine) expire(stallTimeout, endTimeout time.Duration) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.state.IsBroadcasting() {
+		return false
+	}
+
+	sinceIngest := time.Since(m.lastIngest)
+	if sinceIngest >= endTimeout {
+		return m.transitionLocked(StateEnding)
+	}
+	if sinceIngest >= stallTimeout && m.state == StateLive {
+		m.transitionLocked(StateStalled)
+	}
+	return false
+}
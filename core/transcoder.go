@@ -0,0 +1,60 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Transcoder probes, resizes and screengrabs MPEG-TS segments
+type Transcoder interface {
+	// Available returns an error when the transcoder cannot run on this machine
+	Available() error
+
+	// Probe describes the first video stream of the segment
+	Probe(segment []byte) (VideoInfo, error)
+
+	// Transcode resizes the segment to the resolution and framerate of the quality level
+	Transcode(segment []byte, level Transcode) ([]byte, error)
+
+	// Codec is the video codec of transcoded segments, named like Probe names codecs
+	Codec() string
+
+	// Thumbnail grabs the first frame of the segment as an image
+	Thumbnail(segment []byte, width, height int) ([]byte, error)
+}
+
+// VideoInfo describes the video stream of a segment
+type VideoInfo struct {
+	Codec  string
+	Width  int
+	Height int
+
+	// Framerate as reported by the prober, e.g. "30/1" or "30000/1001"
+	Framerate string
+}
+
+// Resolution formats the dimensions like "1920x1080"
+func (v VideoInfo) Resolution() string {
+	return fmt.Sprintf("%dx%d", v.Width, v.Height)
+}
+
+// FramesPerSecond returns the framerate rounded to whole frames
+func (v VideoInfo) FramesPerSecond() int {
+	num, den, found := strings.Cut(v.Framerate, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+
+	if found {
+		d, err := strconv.ParseFloat(den, 64)
+		if err != nil || d == 0 {
+			return 0
+		}
+		n /= d
+	}
+
+	return int(math.Round(n))
+}
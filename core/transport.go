@@ -0,0 +1,96 @@
+package core
+
+import (
+	"errors"
+
+	"github.com/nknorg/nkn-sdk-go"
+)
+
+var ErrSubClientUnavailable = errors.New("sub client unavailable")
+var ErrTransportClosed = errors.New("transport closed")
+
+// PayloadType tells the receiver how to interpret the payload data
+type PayloadType int
+
+const (
+	PayloadBinary PayloadType = iota
+	PayloadText
+)
+
+// Payload is a single message handed to a Transport
+type Payload struct {
+	Type      PayloadType
+	MessageID []byte
+	ReplyToID []byte
+	Data      []byte
+	//Encrypted end-to-end by the network, everything else is sent unencrypted
+	Encrypted bool
+}
+
+// InboundMessage is a message received from the network
+type InboundMessage struct {
+	Src       string
+	Data      []byte
+	MessageID []byte
+	//Only set by the memory transport, NKN does not pass it on
+	ReplyToID []byte
+	NoReply   bool
+}
+
+// Recipients is a prebuilt set of destination addresses, only valid for the Transport that created it
+type Recipients interface {
+	Len() int
+}
+
+// Transport is the network the Streamer sends and receives messages over
+type Transport interface {
+	// Address is the address viewers send their messages to
+	Address() string
+
+	// NumSubClients is the number of sub clients messages can be sent with
+	NumSubClients() int
+
+	// OnConnect yields once every time a sub client connects
+	OnConnect() <-chan struct{}
+
+	// SubClientClosed reports whether a sub client is closed or does not exist
+	SubClientClosed(i int) bool
+
+	// Reconnect starts connecting a sub client again without waiting for it, ErrSubClientUnavailable if it can not
+	// be reconnected
+	Reconnect(i int) error
+
+	// Recipients prebuilds a set of destination addresses
+	Recipients(addresses ...string) Recipients
+
+	// Send sends the payload to all recipients through the given sub client
+	Send(subClient int, to Recipients, payload *Payload) error
+
+	// Messages yields all messages received by any sub client
+	Messages() <-chan *InboundMessage
+
+	Subscribe(topic string, duration int, meta string) error
+	Unsubscribe(topic string) error
+
+	Close() error
+}
+
+// TransportFactory creates the Transport for a host account
+type TransportFactory func(account *nkn.Account, numSubClients int) (Transport, error)
+
+func newPayload(payloadType PayloadType, data []byte) *Payload {
+	msgId, _ := nkn.RandomBytes(nkn.MessageIDSize)
+	return &Payload{
+		Type:      payloadType,
+		MessageID: msgId,
+		Data:      data,
+	}
+}
+
+func newReplyPayload(payloadType PayloadType, data []byte, replyTo []byte) *Payload {
+	return &Payload{
+		Type:      payloadType,
+		ReplyToID: replyTo,
+		Data:      data,
+	}
+}
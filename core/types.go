@@ -1,5 +1,44 @@
 package core
 
+import "time"
+
+// Defaults of NetworkConfig
 const NUM_SUB_CLIENTS = 96
 const VIEWER_SUB_CLIENTS = 3
 const CHUNK_SIZE = 64000
+
+// Most recipients of a single message, larger audiences are sent in batches spread over the sub clients
+const RECIPIENT_BATCH_SIZE = 256
+
+// Seconds of the upload budget sends may wait for before they are dropped
+const EGRESS_QUEUE_SECONDS = 2
+
+// Limits of NetworkConfig and of the sub clients a viewer can negotiate
+const MAX_SUB_CLIENTS = 256
+const MAX_VIEWER_SUB_CLIENTS = 16
+const MIN_CHUNK_SIZE = 1024
+const MAX_CHUNK_SIZE = 1000000
+
+// Consecutive send errors after which a sub client is skipped and reconnected, and how long it is skipped
+const SUB_CLIENT_MAX_ERRORS = 3
+const SUB_CLIENT_BACKOFF = 10 * time.Second
+
+// Segments transcoded in parallel and segments buffered between pipeline stages
+const TRANSCODE_WORKERS = 2
+const PIPELINE_QUEUE_SIZE = 8
+
+// Recent segments kept for chunk retransmission and the retransmissions a single viewer may request
+const SEGMENT_BUFFER_SIZE = 10
+const RETRANSMIT_CHUNKS_PER_SECOND = 32
+const RETRANSMIT_BURST = 64
+
+// Viewer loss below which delivery is healthy and above which it is lossy, and the weight of a new loss report
+const DELIVERY_LOSS_LOW = 0.01
+const DELIVERY_LOSS_HIGH = 0.05
+const DELIVERY_SMOOTHING = 0.3
+
+// Smallest chunk size adaptive chunking goes down to while viewers lose chunks
+const MIN_ADAPTIVE_CHUNK_SIZE = 16000
+
+// Segments listed in the live manifest, all of them can still be retransmitted
+const MANIFEST_SEGMENTS = SEGMENT_BUFFER_SIZE
@@ -7,19 +7,30 @@ import (
 	"sync"
 	"time"
 
-	"github.com/nknorg/nkn-sdk-go"
-	"github.com/nknorg/nkngomobile"
+	"golang.org/x/time/rate"
 )
 
-var viewerAddresses []string
-var viewerSubClientAddresses [VIEWER_SUB_CLIENTS]*nkngomobile.StringArray
-
 // Viewers is a thread-safe collection of message addresses with last receive timestamps.
 type Viewers struct {
 	messages      map[string]*messageData
 	viewerQuality map[string]int
+	chunkHeader   map[string]int
+	retransmits   map[string]*rate.Limiter
+	relays        map[string]bool
+	subClients    map[string]int
+	delivery      map[string]*deliveryStats
 	mutex         sync.RWMutex
 	timeout       time.Duration
+	transport     Transport
+
+	//Sub clients of viewers that did not negotiate their own number
+	defaultSubClients int
+
+	//Rebuilt whenever a viewer joins or leaves
+	addresses          []string
+	subClientAddresses []Recipients
+	//Counts every change of the viewers, their quality or how they are reached
+	version uint64
 }
 
 // messageData holds the last received time for an address.
@@ -27,27 +38,45 @@ type messageData struct {
 	lastTime time.Time
 }
 
-// NewViewers creates a new Viewers with a specified timeout duration.
-func NewViewers(timeout time.Duration) *Viewers {
-	return &Viewers{
-		messages:      make(map[string]*messageData),
-		viewerQuality: make(map[string]int),
-		mutex:         sync.RWMutex{},
-		timeout:       timeout,
+// NewViewers creates a new Viewers with a specified timeout duration, recipients are built for the given transport.
+// Messages are sent to subClients sub clients of every viewer unless the viewer negotiates another number.
+func NewViewers(timeout time.Duration, transport Transport, subClients int) *Viewers {
+	ms := &Viewers{
+		messages:          make(map[string]*messageData),
+		viewerQuality:     make(map[string]int),
+		chunkHeader:       make(map[string]int),
+		retransmits:       make(map[string]*rate.Limiter),
+		relays:            make(map[string]bool),
+		subClients:        make(map[string]int),
+		delivery:          make(map[string]*deliveryStats),
+		mutex:             sync.RWMutex{},
+		timeout:           timeout,
+		transport:         transport,
+		defaultSubClients: subClients,
 	}
+
+	//Start with empty recipients, segments are published before anyone joins
+	ms.setAddresses()
+	return ms
 }
 
-// AddOrUpdateAddress updates the last received time for an address or adds it if not present.
-func (ms *Viewers) AddOrUpdateAddress(address string) (isNew bool) {
+// AddOrUpdateAddress updates the last received time for an address or adds it if not present,
+// the viewer receives chunks with the given chunk header version.
+func (ms *Viewers) AddOrUpdateAddress(address string, chunkHeader int) (isNew bool) {
 	ms.mutex.Lock()
 	defer ms.mutex.Unlock()
 
+	if current, ok := ms.chunkHeader[address]; ok && current != chunkHeader {
+		ms.version++
+	}
+	ms.chunkHeader[address] = chunkHeader
+
 	data, ok := ms.messages[address]
 	if !ok {
 		data = &messageData{lastTime: time.Now()}
 		ms.messages[address] = data
 		ms.viewerQuality[address] = 1
-		ms.SetAddresses()
+		ms.setAddresses()
 	} else {
 		data.lastTime = time.Now()
 	}
@@ -55,27 +84,257 @@ func (ms *Viewers) AddOrUpdateAddress(address string) (isNew bool) {
 	return !ok
 }
 
-// GetAddresses returns an array of all addresses in the store.
-func (ms *Viewers) SetAddresses() {
+// setAddresses rebuilds the address list and the recipients of all viewer subclients, the lock must be held.
+func (ms *Viewers) setAddresses() {
 	//addresses strings
 	addresses := make([]string, 0, len(ms.messages))
 	for address := range ms.messages {
 		addresses = append(addresses, address)
 	}
-	viewerAddresses = addresses
+	ms.addresses = addresses
+	ms.subClientAddresses = ms.recipients(addresses, false)
+	ms.version++
+}
 
-	//create nkn string arrays for all viewer subclients
-	nknAddrStrings := [VIEWER_SUB_CLIENTS]*nkngomobile.StringArray{}
-	for i := 0; i < VIEWER_SUB_CLIENTS; i++ {
-		prefixedAddresses := make([]string, len(viewerAddresses))
-		for j, address := range viewerAddresses {
-			prefixedAddresses[j] = "__" + strconv.Itoa(i) + "__." + address
+// subClientAddress is the address of sub client i of a viewer multiclient
+func subClientAddress(address string, i int) string {
+	return "__" + strconv.Itoa(i) + "__." + address
+}
+
+// addressesOf lists the addresses a message to a viewer is sent to, one for every sub client, or the address itself
+// for a viewer with a single client. Chunks go to fewer sub clients while delivery is healthy. The lock must be held.
+func (ms *Viewers) addressesOf(address string, chunks bool) []string {
+	subClients, ok := ms.subClients[address]
+	if !ok {
+		subClients = ms.defaultSubClients
+	}
+	if subClients == 0 {
+		return []string{address}
+	}
+	if delivery, ok := ms.delivery[address]; ok && chunks {
+		subClients = delivery.redundancy(subClients)
+	}
+
+	addresses := make([]string, subClients)
+	for i := range addresses {
+		addresses[i] = subClientAddress(address, i)
+	}
+	return addresses
+}
+
+// recipients builds the recipients of the viewers per sub client in batches of at most RECIPIENT_BATCH_SIZE,
+// the batches of sub client i reach the i-th sub client of every viewer that has one. The lock must be held.
+func (ms *Viewers) recipients(addresses []string, chunks bool) []Recipients {
+	var lists [][]string
+	for _, address := range addresses {
+		for i, subClient := range ms.addressesOf(address, chunks) {
+			if i == len(lists) {
+				lists = append(lists, make([]string, 0, len(addresses)))
+			}
+			lists[i] = append(lists[i], subClient)
+		}
+	}
+
+	var recipients []Recipients
+	for _, list := range lists {
+		for start := 0; start < len(list); start += RECIPIENT_BATCH_SIZE {
+			recipients = append(recipients, ms.transport.Recipients(list[start:min(start+RECIPIENT_BATCH_SIZE, len(list))]...))
 		}
+	}
+	return recipients
+}
+
+// Count returns the number of viewers.
+func (ms *Viewers) Count() int {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	return len(ms.addresses)
+}
 
-		nknAddrStrings[i] = nkn.NewStringArray(prefixedAddresses...)
+// Addresses returns the addresses of all viewers.
+func (ms *Viewers) Addresses() []string {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	return ms.addresses
+}
+
+// Version changes whenever viewers join or leave, change quality or how they are reached.
+func (ms *Viewers) Version() uint64 {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	return ms.version
+}
+
+// SubClientRecipients returns the recipients of all viewers for every viewer subclient.
+func (ms *Viewers) SubClientRecipients() []Recipients {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	return ms.subClientAddresses
+}
+
+// Recipients returns the recipients of the given viewers for every viewer subclient.
+func (ms *Viewers) Recipients(addresses ...string) []Recipients {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	return ms.recipients(addresses, false)
+}
+
+// ChunkRecipients returns the recipients of segment chunks for the given viewers, viewers with healthy delivery
+// are sent fewer copies.
+func (ms *Viewers) ChunkRecipients(addresses ...string) []Recipients {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	return ms.recipients(addresses, true)
+}
+
+// SetSubClients sets the number of sub clients messages to a viewer are sent to, 0 for a viewer with a single client.
+// Unknown viewers are ignored.
+func (ms *Viewers) SetSubClients(address string, subClients int) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if _, ok := ms.messages[address]; !ok {
+		return
 	}
+	if current, ok := ms.subClients[address]; !ok || current != subClients {
+		ms.subClients[address] = subClients
+		ms.setAddresses()
+	}
+}
+
+// SetQuality sets the quality level a viewer receives, unknown viewers are ignored.
+func (ms *Viewers) SetQuality(address string, level int) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if _, ok := ms.messages[address]; ok && ms.viewerQuality[address] != level {
+		ms.viewerQuality[address] = level
+		ms.version++
+	}
+}
+
+// SetRelay marks a viewer as relay, relays receive every quality level. Unknown viewers are ignored.
+func (ms *Viewers) SetRelay(address string) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
 
-	viewerSubClientAddresses = nknAddrStrings
+	if _, ok := ms.messages[address]; ok && !ms.relays[address] {
+		ms.relays[address] = true
+		ms.version++
+	}
+}
+
+// Relays returns the addresses of the viewers that are relays.
+func (ms *Viewers) Relays() []string {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	relays := make([]string, 0, len(ms.relays))
+	for address := range ms.relays {
+		relays = append(relays, address)
+	}
+	return relays
+}
+
+// ReportDelivery takes the chunks a viewer received, lost and received late since its previous report,
+// the viewer is sent fewer copies of every chunk while delivery is healthy. Unknown viewers are ignored.
+func (ms *Viewers) ReportDelivery(address string, received int, lost int, late int) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if _, ok := ms.messages[address]; !ok {
+		return
+	}
+
+	before := len(ms.addressesOf(address, true))
+	delivery, ok := ms.delivery[address]
+	if !ok {
+		delivery = &deliveryStats{}
+		ms.delivery[address] = delivery
+	}
+	delivery.report(received, lost, late)
+
+	if len(ms.addressesOf(address, true)) != before {
+		ms.version++
+	}
+}
+
+// Loss returns the average loss of the viewers that report their delivery and how many do.
+func (ms *Viewers) Loss() (loss float64, reporting int) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	for _, delivery := range ms.delivery {
+		if delivery.reports > 0 {
+			loss += delivery.loss
+			reporting++
+		}
+	}
+	if reporting > 0 {
+		loss /= float64(reporting)
+	}
+	return loss, reporting
+}
+
+// Redundancy returns the average number of copies of every chunk sent to a viewer.
+func (ms *Viewers) Redundancy() float64 {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	if len(ms.addresses) == 0 {
+		return 0
+	}
+	copies := 0
+	for _, address := range ms.addresses {
+		copies += len(ms.addressesOf(address, true))
+	}
+	return float64(copies) / float64(len(ms.addresses))
+}
+
+// AllowRetransmit takes up to the number of chunks a viewer may have retransmitted now and returns how many it may,
+// each viewer gets RETRANSMIT_CHUNKS_PER_SECOND chunks per second with bursts of RETRANSMIT_BURST chunks.
+func (ms *Viewers) AllowRetransmit(address string, chunks int) int {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if _, ok := ms.messages[address]; !ok {
+		return 0
+	}
+
+	limiter, ok := ms.retransmits[address]
+	if !ok {
+		limiter = rate.NewLimiter(RETRANSMIT_CHUNKS_PER_SECOND, RETRANSMIT_BURST)
+		ms.retransmits[address] = limiter
+	}
+	now := time.Now()
+	allowed := min(chunks, int(limiter.TokensAt(now)))
+	if allowed <= 0 || !limiter.AllowN(now, allowed) {
+		return 0
+	}
+	return allowed
+}
+
+// QualityGroups groups the addresses of viewers with the chunk header version by quality level,
+// levels beyond the available ones get the lowest quality. Relays are in every group.
+func (ms *Viewers) QualityGroups(qualityLevels int, chunkHeader int) [][]string {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	groups := make([][]string, qualityLevels)
+	for address := range ms.messages {
+		if ms.chunkHeader[address] != chunkHeader {
+			continue
+		}
+		if ms.relays[address] {
+			for level := range groups {
+				groups[level] = append(groups[level], address)
+			}
+			continue
+		}
+		level := min(max(ms.viewerQuality[address], 0), qualityLevels-1)
+		groups[level] = append(groups[level], address)
+	}
+	return groups
 }
 
 // Cleanup removes addresses from the store that haven't received messages in the timeout duration.
@@ -89,29 +348,41 @@ func (ms *Viewers) Cleanup() {
 	for address, data := range ms.messages {
 		if data.lastTime.Before(timeout) {
 			delete(ms.messages, address)
+			delete(ms.viewerQuality, address)
+			delete(ms.chunkHeader, address)
+			delete(ms.retransmits, address)
+			delete(ms.relays, address)
+			delete(ms.subClients, address)
+			delete(ms.delivery, address)
 			log.Println("viewer left - timeout")
 			anyDeleted = true
 		}
 	}
 
 	if anyDeleted {
-		ms.SetAddresses()
+		ms.setAddresses()
 	}
 }
 
+// StartCleanup runs RunCleanup in a goroutine.
 func (ms *Viewers) StartCleanup(ctx context.Context, interval time.Duration) {
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				log.Println("viewerCleanup: stopping")
-				return
-			default:
-				time.Sleep(interval)
-				ms.Cleanup()
-			}
+	go ms.RunCleanup(ctx, interval)
+}
+
+// RunCleanup calls Cleanup every interval until the context is done.
+func (ms *Viewers) RunCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("viewerCleanup: stopping")
+			return
+		case <-ticker.C:
+			ms.Cleanup()
 		}
-	}()
+	}
 }
 
 // Remove an address
@@ -119,6 +390,12 @@ func (ms *Viewers) Remove(address string) {
 	ms.mutex.Lock()
 	defer ms.mutex.Unlock()
 	delete(ms.messages, address)
+	delete(ms.viewerQuality, address)
+	delete(ms.chunkHeader, address)
+	delete(ms.retransmits, address)
+	delete(ms.relays, address)
+	delete(ms.subClients, address)
+	delete(ms.delivery, address)
 	log.Println("viewer left - disconnected")
-	ms.SetAddresses()
+	ms.setAddresses()
 }
@@ -45,7 +45,6 @@ require (
 	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51 // indirect
 	github.com/klauspost/cpuid v1.2.3 // indirect
 	github.com/klauspost/cpuid/v2 v2.2.4 // indirect
-	github.com/klauspost/reedsolomon v1.9.3 // indirect
 	github.com/leodido/go-urn v1.2.4 // indirect
 	github.com/matthewhartstonge/argon2 v1.0.0 // indirect
 	github.com/mattn/go-isatty v0.0.19 // indirect
@@ -105,7 +104,6 @@ require (
 	golang.org/x/sys v0.19.0 // indirect
 	golang.org/x/term v0.19.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
-	golang.org/x/time v0.5.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -117,8 +115,10 @@ require (
 
 require (
 	github.com/bluenviron/mediamtx v1.7.0
+	github.com/klauspost/reedsolomon v1.9.3
 	github.com/nknorg/nkn v1.1.7-beta
 	github.com/nknorg/nkngomobile v0.0.0-20220615081414-671ad1afdfa9
+	golang.org/x/time v0.5.0
 )
 
 replace code.cloudfoundry.org/bytefmt => github.com/cloudfoundry/bytefmt v0.0.0-20211005130812-5bb3c17173e5